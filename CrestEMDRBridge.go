@@ -1,23 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"encoding/csv"
-	"encoding/json"
-	"encoding/xml"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"compress/gzip"
+	"flag"
 	"os"
-	"regexp"
 	"strconv"
 	"time"
-
-	"github.com/jmcvetta/napping"
 )
 
+// Bridge name and version, as reported to EMDR.
+var generatorName = "EveData.Org"
+var generatorVersion = "0.025a"
+
 // Maximum GoRoutines
 // Prevent overloading CCP & EMDR servers
 var maxGoRoutines = 25
@@ -25,279 +19,470 @@ var maxGoRoutines = 25
 // CREST URL
 var crestUrl string = "https://public-crest.eveonline.com/"
 
+// XML API URL
+var apiUrl string = "https://api.eveonline.com/"
+
+// ESI URL and datasource
+var esiUrl string = "https://esi.evetech.net/latest/"
+var esiDatasource string = "tranquility"
+
+// Known API servers
+// Singularity is the test server, used to validate against upcoming changes.
+var servers = map[string]struct{ crest, api, esi, datasource string }{
+	"tranquility": {"https://public-crest.eveonline.com/", "https://api.eveonline.com/", "https://esi.evetech.net/latest/", "tranquility"},
+	"singularity": {"https://public-crest-sisi.testeveonline.com/", "https://api.testeveonline.com/", "https://esi.evetech.net/latest/", "singularity"},
+}
+
+var serverName = flag.String("server", "tranquility", "API server to scan: tranquility or singularity")
+var crestUrlFlag = flag.String("crest-url", "", "override the CREST base URL")
+var apiUrlFlag = flag.String("api-url", "", "override the XML API base URL")
+var esiUrlFlag = flag.String("esi-url", "", "override the ESI base URL")
+
 // EMDR Upload URL
 var uploadUrl string = "http://upload.eve-emdr.com/upload/"
 
-var stations map[int64]int64
+// Upload goroutine pool bounds
+// The pool is resized between these against measured upload latency.
+var minUploaders = flag.Int("uploaders", 11, "minimum number of upload goroutines")
+var maxUploaders = flag.Int("max-uploaders", 64, "maximum number of upload goroutines")
+
+// Upload compression
+// EMDR accepts gzip encoded uploads, which shrink order rowsets by about
+// 90%. Destinations can override this.
+var uploadGzipLevel = flag.Int("upload-gzip", gzip.DefaultCompression, "gzip level for uploads, 1 (fastest) to 9 (smallest), -1 for the default or 0 not to compress")
+
+// Largest message posted before it is split up, so a huge order book isn't
+// rejected whole by a gateway's request size limit.
+var uploadMaxBytes = flag.Int("upload-max-bytes", 8<<20, "encoded JSON size above which a message is split into several, or 0 for no limit")
+
+// Upload bandwidth cap, shared by every destination, so a bridge on a home
+// connection doesn't saturate its upstream on big regions.
+var uploadBandwidth = flag.Int("upload-bandwidth", 0, "most bytes per second uploaded, or 0 for no limit")
+
+// Upload rate limit per destination, kept apart from the market API limit
+// so a slow gateway backs up its own queue without slowing fetching.
+var uploadRate = flag.Float64("upload-rate", 0, "most posts per second to each destination, or 0 for no limit")
+
+// Market API request rate limit
+// Match these to whatever CCP currently allows.
+var crestRate = flag.Float64("crest-rate", 30, "market API requests per second")
+var crestBurst = flag.Int("crest-burst", 1, "market API requests allowed in a burst")
+
+// Adaptive throttling
+// The rate is lowered while the API is erroring or slow, returning to
+// -crest-rate as it recovers.
+var adaptiveRate = flag.Bool("adaptive-rate", true, "lower the request rate while the market API is struggling")
+var rateFloor = flag.Float64("rate-floor", 1, "lowest market API requests per second adaptive throttling goes to")
+var latencyTarget = flag.Duration("latency-target", time.Second*2, "market API latency above which the request rate is lowered")
+
+// Pipelines to skip
+// History only changes daily so many operators run orders only.
+var noHistory = flag.Bool("no-history", false, "do not collect market history")
+var noOrders = flag.Bool("no-orders", false, "do not collect market orders")
+
+// Concurrent fetches allowed per pipeline
+var historyConcurrency = flag.Int("history-concurrency", maxGoRoutines, "concurrent market history fetches")
+var ordersConcurrency = flag.Int("orders-concurrency", maxGoRoutines, "concurrent market order fetches")
+
+// Explicit list of typeIDs to scan instead of crawling market/types.
+var typesFile = flag.String("types-file", "", "file of typeIDs to scan, one per line")
 
 func main() {
-	goCrestEMDRBridge()
+	flag.Usage = usage
+	flag.Parse()
+	fatalCheck(setupLogging())
+	if *noHistory && *noOrders {
+		logs.fatalf("Nothing to do with both -no-history and -no-orders")
+	}
+	if !(*crestRate > 0) {
+		logs.fatalf("-crest-rate must be above 0, not %g", *crestRate)
+	}
+	if *historyConcurrency < 1 || *ordersConcurrency < 1 {
+		logs.fatalf("-history-concurrency and -orders-concurrency must be at least 1")
+	}
+
+	fatalCheck(loadUploadKey())
+	setupHTTP()
+
+	command, args := "run", []string{}
+	if flag.NArg() > 0 {
+		command, args = flag.Arg(0), flag.Args()[1:]
+	}
+
+	switch command {
+	case "run":
+		selectServer()
+		goCrestEMDRBridge()
+	case "dump-regions":
+		selectServer()
+		fatalCheck(dumpRegions())
+	case "dump-types":
+		selectServer()
+		fatalCheck(dumpTypes())
+	case "verify":
+		selectServer()
+		fatalCheck(verify(args))
+	case "simulate":
+		if len(args) != 1 {
+			logs.fatalf("simulate needs a change-frequency file")
+		}
+		fatalCheck(runSimulation(args[0]))
+	case "replay-spool":
+		fatalCheck(replaySpool(args))
+	case "dump-archive":
+		fatalCheck(dumpArchive(args))
+	default:
+		run, ok := extraCommands[command]
+		if !ok {
+			usage()
+			os.Exit(2)
+		}
+		fatalCheck(run(args))
+	}
+}
+
+// selectServer points the API URLs at the chosen server.
+func selectServer() {
+	server, ok := servers[*serverName]
+	if !ok {
+		logs.fatalf("Unknown server %q", *serverName)
+	}
+	crestUrl, apiUrl = server.crest, server.api
+	esiUrl, esiDatasource = server.esi, server.datasource
+
+	if *crestUrlFlag != "" {
+		crestUrl = *crestUrlFlag
+	}
+	if *apiUrlFlag != "" {
+		apiUrl = *apiUrlFlag
+	}
+	if *esiUrlFlag != "" {
+		esiUrl = *esiUrlFlag
+	}
+
+	selectSource()
 }
 
 func fatalCheck(e error) {
 	if e != nil {
-		log.Fatal(e)
+		logs.fatalf("%s", e)
 	}
 }
 
 func warnCheck(e error) {
 	if e != nil {
-		log.Print(e)
+		logs.warnf("%s", e)
 	}
 }
 
-func getStationsFromAPI() {
-	type stationList struct {
-		Stations []struct {
-			StationID     int64 `xml:"stationID,attr"`
-			SolarSystemID int64 `xml:"solarSystemID,attr"`
-		} `xml:"result>rowset>row"`
-	}
-
-	// Grab the station list from CCP API
-	response, err := http.Get("https://api.eveonline.com/eve/ConquerableStationList.xml.aspx")
-	warnCheck(err)
-	defer response.Body.Close()
+func goCrestEMDRBridge() {
+	config, err := loadConfig(*configFile)
+	fatalCheck(err)
+	handleShutdown()
+	fatalCheck(features.configure(config.Features))
+	fatalCheck(loadSSO())
+
+	regions, err := loadRegions()
+	fatalCheck(err)
+	progress.load("regions", len(regions))
+	types, err := loadTypes()
+	fatalCheck(err)
+	progress.load("types", len(types))
+	fatalCheck(loadStations())
+	progress.load("stations", stations.count())
+	startStationRefresh()
+	fatalCheck(loadEnrichment(regions))
+	scanTypes.replace(types)
+	leaders.setTypes(types)
+	leaders.start()
+	live.set(regions, types)
+	startGC()
+	startTypeRefresh(regions)
 
-	// Decode XML to an array of stations.
-	sL := stationList{}
-	err = xml.NewDecoder(response.Body).Decode(&sL)
-	warnCheck(err)
+	// FanOut response channel for posters
+	postChannel := make(chan *marketUUDIF)
+
+	startStatusServer()
+	startStatsd()
+	startAdminServer()
+	startPprofServer()
+
+	// Every message is delivered to each sink whose filter it matches.
+	sinkConfigs = config.Sinks
+	sinks := []sink{}
+	if *archiveDir != "" {
+		archive, err := newArchiveSink(*archiveDir)
+		fatalCheck(err)
+		sinks = append(sinks, routed(archive))
+	}
 
-	// Merge with the NPC station list
-	for _, s := range sL.Stations {
-		stations[s.StationID] = s.SolarSystemID
+	// Pool of uploaders per destination.
+	startUploadLimiter()
+	startUploadSummary()
+	warnCheck(loadEndpointStats())
+	startEndpointStats()
+	for _, d := range config.Destinations {
+		u, err := newUploader(d)
+		fatalCheck(err)
+		u.start()
+		progress.expectUploads()
+		sinks = append(sinks, filterSink(u, d.Filter))
 	}
-}
 
-func goCrestEMDRBridge() {
+	if *stdoutSinkEnabled {
+		sinks = append(sinks, routed(newNDJSONSink("stdout", os.Stdout)))
+	}
+	for _, newSink := range sinkFactories {
+		s, err := newSink()
+		fatalCheck(err)
+		if s != nil {
+			sinks = append(sinks, routed(s))
+		}
+	}
+	if *telemetryEnabled {
+		sinks = append(sinks, newTelemetrySink())
+	}
 
-	var err error
+	// Bounded queue between the posters and the sinks.
+	queue, err := newPostQueue(*postQueueSize, *postOverflow)
+	fatalCheck(err)
+	queued := make(chan *marketUUDIF)
+	queue.start(postChannel, queued)
 
-	type regionKey struct {
-		RegionID int64
-		TypeID   int64
+	if *batchRowsets > 1 {
+		batched := make(chan *marketUUDIF)
+		go batch(queued, batched, *batchRowsets, *batchRows, *batchWait)
+		go fanOut(batched, sinks)
+	} else {
+		go fanOut(queued, sinks)
 	}
 
-	type marketRegions struct {
-		RegionID   int64  `db:"regionID"`
-		RegionName string `db:"regionName"`
+	if *watchDir != "" {
+		fatalCheck(startWatchFolder(*watchDir, postChannel))
 	}
 
-	type marketTypes struct {
-		TypeID   int64  `db:"typeID"`
-		TypeName string `db:"typeName"`
-	}
+	// semaphore to prevent runaways
+	sem := make(chan bool, maxGoRoutines)
+
+	// Separate fetch pools so slow history can't starve order freshness.
+	historySem := make(chan bool, *historyConcurrency)
+	ordersSem := make(chan bool, *ordersConcurrency)
+	publishPipeline(sem, historySem, ordersSem)
+
+	downtime.start()
+	startSchedules()
+
+scan:
+	for {
+		// Types published since the last pass are picked up here.
+		types := scanTypes.get()
+		dispatched := 0
 
-	// Pool of CREST sessions
-	crestSession := napping.Session{}
-	regions := []marketRegions{}
-	types := []marketTypes{}
-	stations = make(map[int64]int64)
-
-	// Scope to allow garbage colect to reclaim startup data.
-	{
-		type crestRegions_s struct {
-			TotalCount_Str string
-			Items          []struct {
-				HRef string
-				Name string
+		// loop through all regions
+		for _, r := range regions {
+			if downtime.rescanDue() {
+				logs.infof("Starting a fresh pass after downtime")
+				historySchedule.reset()
+				continue scan
 			}
-			PageCount  int64
-			TotalCount int64
-		}
 
-		type crestTypes_s struct {
-			TotalCount_Str string
-			Items          []struct {
-				Type struct {
-					ID   int64
-					Name string
+			regionStart := dispatched
+			scan := newRegionScan(r)
+
+			// Fetch the whole region's orders at once where the source
+			// can, then split them into each type's books.
+			regionWide := false
+			if ro, ok := source.(regionOrderSource); ok && !*noOrders && features.enabled(featureRegionWideFetching) {
+				regionWide = true
+				rk := regionKey{r.RegionID, 0}
+				if ordersSchedule.take(rk, clk.Now()) {
+					dispatched++
+					scan.dispatch()
+					ordersSem <- true
+					go func() {
+						defer func() { <-ordersSem }()
+						defer scan.done()
+						books, code, err := fetchRegionOrders(ro, rk.RegionID)
+						if err != nil {
+							logs.with(logFields{"regionID": rk.RegionID}).err(err).warnf("Region orders fetch failed")
+							ordersSchedule.failed(rk)
+							scan.fail()
+							return
+						}
+						ordersSchedule.done(rk, clk.Now(), code == 200)
+						if code != 200 {
+							scan.fetched(0, code)
+							return
+						}
+						buy, sell := books.buy, books.sell
+						for _, t := range types {
+							if len(buy[t.TypeID].Items) > 0 || len(sell[t.TypeID].Items) > 0 {
+								scan.fetched(t.TypeID, code)
+							}
+							sem <- true
+							go postOrders(sem, postChannel, buy[t.TypeID], 1, rk.RegionID, t.TypeID)
+							sem <- true
+							go postOrders(sem, postChannel, sell[t.TypeID], 0, rk.RegionID, t.TypeID)
+						}
+					}()
 				}
 			}
-			PageCount  int64
-			TotalCount int64
-			Next       struct {
-				HRef string `json:"href,omitempty"`
-			}
-		}
 
-		// Collect Regions from CREST servers.
-		crestRegions := crestRegions_s{}
-		_, err = crestSession.Get(crestUrl+"regions/", nil, &crestRegions, nil)
-		fatalCheck(err)
-
-		// Extract the ID out of the URI.
-		for _, r := range crestRegions.Items {
-			re := regexp.MustCompile("([0-9]+)")
-			regionID, _ := strconv.ParseInt(re.FindString(r.HRef), 10, 64)
-			regions = append(regions, marketRegions{regionID, r.Name})
-		}
-		log.Printf("Loaded %d Regions", len(regions))
+			// and each item per region, unless there is nothing left to
+			// fetch per type
+			for _, t := range types {
+				if regionWide && *noHistory {
+					break
+				}
 
-		// Collect Types from CREST servers.
-		crestTypes := crestTypes_s{}
-		_, err = crestSession.Get(crestUrl+"market/types/", nil, &crestTypes, nil)
-		fatalCheck(err)
+				rk := regionKey{r.RegionID, t.TypeID}
 
-		// Translate the first page.
-		for _, t := range crestTypes.Items {
-			types = append(types, marketTypes{t.Type.ID, t.Type.Name})
-		}
+				if failures.skip(rk) {
+					scan.skip()
+					continue
+				}
 
-		// Loop the next pages.
-		for {
-			last := crestTypes.Next.HRef
+				if !*noHistory && historySchedule.take(rk, clk.Now()) {
+					dispatched++
+					scan.dispatch()
+					historySem <- true
+					go func() {
+						defer func() { <-historySem }()
+						defer scan.done()
+						// Process Market History
+						h, code, err := fetchHistory(rk.RegionID, rk.TypeID)
+						if err != nil {
+							logs.with(logFields{"regionID": rk.RegionID, "typeID": rk.TypeID}).err(err).warnf("History fetch failed")
+							historySchedule.failed(rk)
+							failures.failed(rk)
+							scan.fail()
+							return
+						}
+						scan.fetched(rk.TypeID, code)
+						historySchedule.done(rk, clk.Now(), code == 200)
+						if code == 404 {
+							failures.failed(rk)
+						} else {
+							failures.succeeded(rk)
+						}
+						if code == 200 {
+							leaders.record(rk.RegionID, rk.TypeID, h)
+							sem <- true
+							go postHistory(sem, postChannel, h, rk.RegionID, rk.TypeID)
+						}
+					}()
+				}
 
-			_, err = crestSession.Get(crestTypes.Next.HRef, nil, &crestTypes, nil)
-			fatalCheck(err)
-			for _, t := range crestTypes.Items {
-				types = append(types, marketTypes{t.Type.ID, t.Type.Name})
+				if !*noOrders && !regionWide && ordersSchedule.take(rk, clk.Now()) {
+					dispatched++
+					scan.dispatch()
+					ordersSem <- true
+					go func() {
+						defer func() { <-ordersSem }()
+						defer scan.done()
+						changed, notFound := false, false
+						// Process Market Buy and Sell Orders
+						for _, side := range []string{"buy", "sell"} {
+							o, code, err := fetchOrders(rk.RegionID, rk.TypeID, side)
+							if err != nil {
+								logs.with(logFields{"regionID": rk.RegionID, "typeID": rk.TypeID, "side": side}).err(err).warnf("Orders fetch failed")
+								ordersSchedule.failed(rk)
+								failures.failed(rk)
+								scan.fail()
+								return
+							}
+							scan.fetched(rk.TypeID, code)
+							if code == 404 {
+								notFound = true
+							}
+							if code == 200 {
+								changed = true
+								buy := 0
+								if side == "buy" {
+									buy = 1
+								}
+								sem <- true
+								go postOrders(sem, postChannel, o, buy, rk.RegionID, rk.TypeID)
+							}
+						}
+						ordersSchedule.done(rk, clk.Now(), changed)
+						if notFound {
+							failures.failed(rk)
+						} else {
+							failures.succeeded(rk)
+						}
+					}()
+				}
 			}
 
-			if crestTypes.Next.HRef == last {
-				break
+			// Regions with nothing due aren't counted as scanned. The
+			// summary is logged once the region's last fetch finishes.
+			if dispatched > regionStart {
+				scan.close()
+				status.regionScanned(r.RegionID, r.RegionName)
 			}
 		}
 
-		log.Printf("Loaded %d Types", len(types))
-
-		// Load NPC stations from file.
-		file, err := os.Open("stations")
-		fatalCheck(err)
-		defer file.Close()
-		reader := csv.NewReader(file)
-		reader.Comma = '\t' // Tab delimited.
-
-		for {
-			record, err := reader.Read()
-			if err == io.EOF {
-				break
-			}
-			stationID, err := strconv.ParseInt(record[0], 10, 64)
-			fatalCheck(err)
-			systemID, err := strconv.ParseInt(record[1], 10, 64)
-			fatalCheck(err)
-			stations[stationID] = systemID
+		if dispatched == 0 {
+			// Nothing was due; wait for something to be.
+			now := clk.Now()
+			clk.Sleep(idleUntil(now).Sub(now))
+			continue
 		}
-		log.Printf("Loaded %d NPC Stations", len(stations))
-
-		// Load player stations from API
-		getStationsFromAPI()
-		log.Printf("Added Player Stations: %d Total Stations", len(stations))
+		failures.nextPass()
+		status.passCompleted()
 	}
+}
 
-	// FanOut response channel for posters
-	postChannel := make(chan []byte)
-
-	// Pool of transports.
-	transport := &http.Transport{DisableKeepAlives: false}
-	client := &http.Client{Transport: transport}
-
-	go func() {
-		for i := 0; i < 11; i++ {
-			// Don't spawn them all at once.
-			time.Sleep(time.Second / 2)
-
-			go func() {
-				for {
-					msg := <-postChannel
-
-					response, err := client.Post(uploadUrl, "application/json", bytes.NewBuffer(msg))
-					if err != nil {
-						log.Println("EMDRCrestBridge:", err)
-					} else {
-						if response.Status != "200 OK" {
-							body, _ := ioutil.ReadAll(response.Body)
-							log.Println("EMDRCrestBridge:", string(body))
-							log.Println("EMDRCrestBridge:", string(response.Status))
-						}
-						// Must read everything to close the body and reuse connection
-						ioutil.ReadAll(response.Body)
-						response.Body.Close()
-					}
-				}
-			}()
+func postHistory(sem chan bool, postChan chan *marketUUDIF, h marketHistory, regionID int64, typeID int64) {
+	defer func() { <-sem }()
+
+	if *historyNewOnly {
+		h = historySent.trim(regionKey{regionID, typeID}, h)
+		if len(h.Items) == 0 {
+			skippedStats.Add("historyUnchanged", 1)
+			return
 		}
-	}()
-	// Throttle Crest Requests
-	rate := time.Second / 30
-	throttle := time.Tick(rate)
+	}
 
-	// semaphore to prevent runaways
-	sem := make(chan bool, maxGoRoutines)
-	sem2 := make(chan bool, maxGoRoutines)
+	u := newHistoryUUDIF(h, regionID, typeID)
+	if !valid(&u) {
+		return
+	}
 
-	for {
-		// loop through all regions
-		for _, r := range regions {
-			log.Printf("Scanning Region: %s", r.RegionName)
-			// and each item per region
-			for _, t := range types {
-				<-throttle // impliment throttle
-				sem2 <- true
+	status.itemGenerated()
+	post(postChan, &u)
+}
 
-				rk := regionKey{r.RegionID, t.TypeID}
-				go func() {
-					defer func() { <-sem2 }()
-					// Process Market History
-					h := marketHistory{}
-					url := fmt.Sprintf("https://public-crest.eveonline.com/market/%d/types/%d/history/", rk.RegionID, rk.TypeID)
-
-					response, err := crestSession.Get(url, nil, &h, nil)
-					if err != nil {
-						log.Printf("EMDRCrestBridge: %s", err)
-						return
-					}
-					if response.Status() == 200 {
-						sem <- true
-						go postHistory(sem, postChannel, h, rk.RegionID, rk.TypeID)
-					}
-				}()
-
-				sem2 <- true
-				go func() {
-					defer func() { <-sem2 }()
-					// Process Market Buy Orders
-					b := marketOrders{}
-					url := fmt.Sprintf("https://public-crest.eveonline.com/market/%d/orders/buy/?type=https://public-crest.eveonline.com/types/%d/", rk.RegionID, rk.TypeID)
-
-					response, err := crestSession.Get(url, nil, &b, nil)
-					if err != nil {
-						log.Printf("EMDRCrestBridge: %s", err)
-						return
-					}
-					if response.Status() == 200 {
-						sem <- true
-						go postOrders(sem, postChannel, b, 1, rk.RegionID, rk.TypeID)
-					}
-				}()
-
-				sem2 <- true
-				go func() {
-					defer func() { <-sem2 }()
-					// Process Market Sell Orders
-					s := marketOrders{}
-					url := fmt.Sprintf("https://public-crest.eveonline.com/market/%d/orders/sell/?type=https://public-crest.eveonline.com/types/%d/", rk.RegionID, rk.TypeID)
-
-					response, err := crestSession.Get(url, nil, &s, nil)
-					if err != nil {
-						log.Printf("EMDRCrestBridge: %s", err)
-						return
-					}
-					if response.Status() == 200 {
-						sem <- true
-						go postOrders(sem, postChannel, s, 0, rk.RegionID, rk.TypeID)
-					}
-				}()
-			}
+func postOrders(sem chan bool, postChan chan *marketUUDIF, o marketOrders, buy int, regionID int64, typeID int64) {
+	defer func() { <-sem }()
+
+	u := newOrdersUUDIF(o, regionID, typeID)
+	u.Rowsets[0].Side = "sell"
+	if buy == 1 {
+		u.Rowsets[0].Side = "buy"
+	}
+	if !valid(&u) {
+		return
+	}
+	k := snapshotKey{regionKey{regionID, typeID}, buy}
+	if features.enabled(featureDeltaPublishing) {
+		// Only books whose orders came, went or moved since the last pass.
+		if !books.diff(k, o.Items).any() {
+			skippedStats.Add("unchanged", 1)
+			return
 		}
+	} else if *skipUnchanged && !snapshots.changed(k, u.Rowsets[0].Rows) {
+		skippedStats.Add("unchanged", 1)
+		return
 	}
-}
 
-func postHistory(sem chan bool, postChan chan []byte, h marketHistory, regionID int64, typeID int64) {
-	defer func() { <-sem }()
+	status.itemGenerated()
+	post(postChan, &u)
+}
 
+// newHistoryUUDIF builds the UUDIF message for a type's market history.
+func newHistoryUUDIF(h marketHistory, regionID int64, typeID int64) marketUUDIF {
 	u := newUUDIFHeader()
 	u.ResultType = "history"
 	u.Columns = []string{"date", "orders", "quantity", "low", "high", "average"}
@@ -306,7 +491,7 @@ func postHistory(sem chan bool, postChan chan []byte, h marketHistory, regionID
 
 	u.Rowsets[0].RegionID = regionID
 	u.Rowsets[0].TypeID = typeID
-	u.Rowsets[0].GeneratedAt = time.Now()
+	u.Rowsets[0].GeneratedAt = clk.Now()
 
 	u.Rowsets[0].Rows = make([][]interface{}, len(h.Items))
 
@@ -320,17 +505,11 @@ func postHistory(sem chan bool, postChan chan []byte, h marketHistory, regionID
 		u.Rowsets[0].Rows[i][5] = e.AvgPrice
 	}
 
-	enc, err := json.Marshal(u)
-	if err != nil {
-		log.Println("EMDRCrestBridge:", err)
-	} else {
-		postChan <- enc
-	}
+	return u
 }
 
-func postOrders(sem chan bool, postChan chan []byte, o marketOrders, buy int, regionID int64, typeID int64) {
-	defer func() { <-sem }()
-
+// newOrdersUUDIF builds the UUDIF message for a type's orders.
+func newOrdersUUDIF(o marketOrders, regionID int64, typeID int64) marketUUDIF {
 	u := newUUDIFHeader()
 	u.ResultType = "orders"
 	u.Columns = []string{"price", "volRemaining", "range", "orderID", "volEntered", "minVolume", "bid", "issueDate", "duration", "stationID", "solarSystemID"}
@@ -339,9 +518,10 @@ func postOrders(sem chan bool, postChan chan []byte, o marketOrders, buy int, re
 
 	u.Rowsets[0].RegionID = regionID
 	u.Rowsets[0].TypeID = typeID
-	u.Rowsets[0].GeneratedAt = time.Now()
+	u.Rowsets[0].GeneratedAt = clk.Now()
 
 	u.Rowsets[0].Rows = make([][]interface{}, len(o.Items))
+	systems := orderSystems(o.Items)
 
 	for i, e := range o.Items {
 
@@ -368,15 +548,13 @@ func postOrders(sem chan bool, postChan chan []byte, o marketOrders, buy int, re
 		u.Rowsets[0].Rows[i][7] = e.Issued + "+00:00"
 		u.Rowsets[0].Rows[i][8] = e.Duration
 		u.Rowsets[0].Rows[i][9] = e.Location.ID
-		u.Rowsets[0].Rows[i][10] = stations[e.Location.ID]
+		u.Rowsets[0].Rows[i][10] = e.SolarSystemID
+		if e.SolarSystemID == 0 {
+			u.Rowsets[0].Rows[i][10] = systems[e.Location.ID]
+		}
 	}
 
-	enc, err := json.Marshal(u)
-	if err != nil {
-		log.Println("EMDRCrestBridge:", err)
-	} else {
-		postChan <- enc
-	}
+	return u
 }
 
 func newUUDIFHeader() marketUUDIF {
@@ -384,22 +562,42 @@ func newUUDIFHeader() marketUUDIF {
 
 	n.Version = "0.1"
 
-	n.Generator.Name = "EveData.Org"
-	n.Generator.Version = "0.025a"
+	n.Generator.Name = generatorName
+	n.Generator.Version = generatorVersion
 
-	n.UploadKeys = make([]uploadKeysUUDIF, 1)
-	n.UploadKeys[0] = uploadKeysUUDIF{"EveData.Org", "TheCheeseIsBree"}
+	n.UploadKeys = nextUploadKeys()
 
-	n.CurrentTime = time.Now()
+	n.CurrentTime = clk.Now()
 
 	return n
 }
 
+type marketRegions struct {
+	RegionID   int64  `db:"regionID"`
+	RegionName string `db:"regionName"`
+}
+
+type marketTypes struct {
+	TypeID   int64  `db:"typeID"`
+	TypeName string `db:"typeName"`
+}
+
+// regionKey identifies one market: a type in a region.
+type regionKey struct {
+	RegionID int64
+	TypeID   int64
+}
+
 type rowsetsUUDIF struct {
 	GeneratedAt time.Time       `json:"generatedAt"`
 	RegionID    int64           `json:"regionID"`
 	TypeID      int64           `json:"typeID"`
 	Rows        [][]interface{} `json:"rows"`
+
+	// Side of the book an orders rowset holds, "buy" or "sell", while the
+	// bridge still knows it. Not part of UUDIF, where only the rows say,
+	// so an empty book read back from JSON has none.
+	Side string `json:"-"`
 }
 
 type uploadKeysUUDIF struct {
@@ -422,38 +620,49 @@ type marketUUDIF struct {
 
 type marketHistory struct {
 	TotalCount_Str string
-	Items          []struct {
-		OrderCount int64
-		LowPrice   float64
-		HighPrice  float64
-		AvgPrice   float64
-		Volume     int64
-		Date       string
-	}
-	PageCount  int64
-	TotalCount int64
+	Items          []marketHistoryItem
+	PageCount      int64
+	TotalCount     int64
+}
+
+type marketHistoryItem struct {
+	OrderCount int64
+	LowPrice   float64
+	HighPrice  float64
+	AvgPrice   float64
+	Volume     int64
+	Date       string
 }
 
 type marketOrders struct {
-	Items []struct {
-		Buy           bool
-		Issued        string
-		Price         float64
-		VolumeEntered int64
-		MinVolume     int64
-		Volume        int64
-		Range         string
-		Duration      int64
-		ID            int64
-		Location      struct {
-			ID   int64
-			Name string
-		}
-		Type struct {
-			ID   int64
-			Name string
-		}
-	}
+	Items      []marketOrder
 	PageCount  int64
 	TotalCount int64
+	Next       struct {
+		HRef string `json:"href,omitempty"`
+	}
+}
+
+type marketOrder struct {
+	Buy           bool
+	Issued        string
+	Price         float64
+	VolumeEntered int64
+	MinVolume     int64
+	Volume        int64
+	Range         string
+	Duration      int64
+	ID            int64
+	Location      struct {
+		ID   int64
+		Name string
+	}
+	Type struct {
+		ID   int64
+		Name string
+	}
+
+	// Filled in by sources that know it. Otherwise it is looked up from
+	// the station.
+	SolarSystemID int64
 }
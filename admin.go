@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Admin API
+// Authenticated with a bearer token and served on its own address, which
+// should normally be loopback only.
+var adminAddr = flag.String("admin-addr", "", "address to serve the admin API on, e.g. 127.0.0.1:8081")
+var adminTokenFile = flag.String("admin-token-file", "", "file holding the admin API bearer token (or set BRIDGE_ADMIN_TOKEN)")
+
+// adminMux holds every handler served on the admin address.
+var adminMux = http.NewServeMux()
+
+func init() {
+	// Includes the command line, which may hold secrets, so never public.
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	adminMux.HandleFunc("/admin/features", adminFeaturesHandler)
+	adminMux.HandleFunc("/admin/features/", adminFeatureHandler)
+}
+
+// startAdminServer serves the admin API in the background.
+func startAdminServer() {
+	if *adminAddr == "" {
+		return
+	}
+
+	token := os.Getenv("BRIDGE_ADMIN_TOKEN")
+	if *adminTokenFile != "" {
+		var err error
+		token, err = readSecretFile(*adminTokenFile)
+		fatalCheck(err)
+	}
+	if token == "" {
+		logs.fatalf("The admin API needs a token from -admin-token-file or BRIDGE_ADMIN_TOKEN")
+	}
+
+	go func() {
+		logs.infof("Serving admin API on %s", *adminAddr)
+		fatalCheck(http.ListenAndServe(*adminAddr, requireToken(token, adminMux)))
+	}()
+}
+
+// requireToken rejects requests without the bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminFeaturesHandler lists the feature flags.
+func adminFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, features.list())
+}
+
+// adminFeatureHandler overrides a feature flag with PUT {"enabled": bool}
+// or drops the override with DELETE.
+func adminFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/features/")
+
+	var err error
+	switch r.Method {
+	case "PUT":
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) != nil || body.Enabled == nil {
+			http.Error(w, `body must be {"enabled": true|false}`, http.StatusBadRequest)
+			return
+		}
+		err = features.override(name, *body.Enabled)
+	case "DELETE":
+		err = features.clear(name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, features.list())
+}
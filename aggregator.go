@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Destination formats
+// EMDR takes UUDIF. Newer aggregators take ESI shaped orders and history.
+const (
+	formatUUDIF      = "uudif"
+	formatAggregator = "aggregator"
+)
+
+// Aggregator field names for the UUDIF columns, which match ESI's.
+// Columns without one, such as enrichment, keep their UUDIF names.
+var aggregatorFields = map[string]map[string]string{
+	"orders": {
+		"price":         "price",
+		"volRemaining":  "volume_remain",
+		"range":         "range",
+		"orderID":       "order_id",
+		"volEntered":    "volume_total",
+		"minVolume":     "min_volume",
+		"bid":           "is_buy_order",
+		"issueDate":     "issued",
+		"duration":      "duration",
+		"stationID":     "location_id",
+		"solarSystemID": "system_id",
+	},
+	"history": {
+		"date":     "date",
+		"orders":   "order_count",
+		"quantity": "volume",
+		"low":      "lowest",
+		"high":     "highest",
+		"average":  "average",
+	},
+}
+
+// aggregatorPayload is the body posted to an aggregator.
+type aggregatorPayload struct {
+	ResultType string `json:"resultType"`
+	Generator  struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"generator"`
+	GeneratedAt time.Time          `json:"generatedAt"`
+	Markets     []aggregatorMarket `json:"markets"`
+}
+
+type aggregatorMarket struct {
+	RegionID    int64                    `json:"region_id"`
+	TypeID      int64                    `json:"type_id"`
+	GeneratedAt time.Time                `json:"generated_at"`
+	Rows        []map[string]interface{} `json:"rows"`
+}
+
+// toAggregator reshapes a UUDIF message's rowsets into ESI style records.
+func toAggregator(m *marketUUDIF) aggregatorPayload {
+	p := aggregatorPayload{ResultType: m.ResultType, GeneratedAt: m.CurrentTime}
+	p.Generator = m.Generator
+
+	names := make([]string, len(m.Columns))
+	for i, c := range m.Columns {
+		if f, ok := aggregatorFields[m.ResultType][c]; ok {
+			names[i] = f
+		} else {
+			names[i] = c
+		}
+	}
+
+	for _, rs := range m.Rowsets {
+		market := aggregatorMarket{RegionID: rs.RegionID, TypeID: rs.TypeID, GeneratedAt: rs.GeneratedAt}
+		market.Rows = make([]map[string]interface{}, len(rs.Rows))
+		for i, row := range rs.Rows {
+			r := make(map[string]interface{}, len(row))
+			for j, v := range row {
+				if j < len(names) {
+					r[names[j]] = v
+				}
+			}
+			if rng, ok := r["range"]; ok && m.ResultType == "orders" {
+				r["range"] = esiRange(rng)
+			}
+			market.Rows[i] = r
+		}
+		p.Markets = append(p.Markets, market)
+	}
+
+	return p
+}
+
+// esiRange turns a UUDIF order range back into ESI's.
+func esiRange(v interface{}) interface{} {
+	r, ok := wholeNumber(v)
+	if !ok {
+		return v
+	}
+	switch r {
+	case -1:
+		return "station"
+	case 0:
+		return "solarsystem"
+	case 32767:
+		return "region"
+	}
+	return strconv.FormatInt(r, 10)
+}
+
+// encode marshals a message in the destination's format.
+func (u *uploader) encode(m *marketUUDIF) ([]byte, error) {
+	if u.format == formatAggregator {
+		return json.Marshal(toAggregator(m))
+	}
+	return json.Marshal(m)
+}
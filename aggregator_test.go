@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEsiRangeDecodedNumbers(t *testing.T) {
+	for _, test := range []struct {
+		v    interface{}
+		want interface{}
+	}{
+		{-1, "station"},
+		{int64(0), "solarsystem"},
+		{float64(32767), "region"},
+		{json.Number("5"), "5"},
+		{"station", "station"},
+	} {
+		if got := esiRange(test.v); got != test.want {
+			t.Errorf("esiRange(%T %v) = %v, want %v", test.v, test.v, got, test.want)
+		}
+	}
+}
+
+func TestToAggregatorDecodedMessage(t *testing.T) {
+	o := marketOrder{Issued: "2015-06-01T12:00:00", Price: 5, VolumeEntered: 10, Volume: 10, Range: "region", Duration: 90, ID: 4242, SolarSystemID: 30000142}
+	o.Location.ID = 60003760
+	m := newOrdersUUDIF(marketOrders{Items: []marketOrder{o}}, 10000002, 34)
+
+	// Read back plainly, as anything outside decodeUUDIF would.
+	b, _ := json.Marshal(m)
+	back := &marketUUDIF{}
+	if err := json.Unmarshal(b, back); err != nil {
+		t.Fatal(err)
+	}
+	if got := toAggregator(back).Markets[0].Rows[0]["range"]; got != "region" {
+		t.Errorf("range came out as %v, want region", got)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory to archive every generated message into, one file per day.
+var archiveDir = flag.String("archive-dir", "", "directory to archive generated UUDIF messages into")
+
+// Current version of the archive record layout.
+// Bump this and add a migration whenever archiveRecord changes shape.
+const archiveSchemaVersion = 1
+
+// archiveRecord is one line of an archive file.
+type archiveRecord struct {
+	Schema   int             `json:"schema"`
+	Archived time.Time       `json:"archived"`
+	Message  json.RawMessage `json:"message"`
+}
+
+// Migrations upgrade a raw record from the keyed version to the next.
+var archiveMigrations = map[int]func(raw []byte) ([]byte, error){
+	// Version 0 archives were bare UUDIF messages, one per line.
+	0: func(raw []byte) ([]byte, error) {
+		return json.Marshal(archiveRecord{Schema: 1, Message: json.RawMessage(raw)})
+	},
+}
+
+// archiveWriter appends stamped records to daily archive files.
+type archiveWriter struct {
+	dir string
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+func newArchiveWriter(dir string) (*archiveWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &archiveWriter{dir: dir}, nil
+}
+
+func (a *archiveWriter) write(m *marketUUDIF) error {
+	msg, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	now := clk.Now().UTC()
+	line, err := json.Marshal(archiveRecord{archiveSchemaVersion, now, json.RawMessage(msg)})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Roll over to a new file each day.
+	day := now.Format("2006-01-02")
+	if a.file == nil || a.day != day {
+		if a.file != nil {
+			a.file.Close()
+		}
+		a.file, err = os.OpenFile(filepath.Join(a.dir, "uudif-"+day+".ndjson"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			a.file = nil
+			return err
+		}
+		a.day = day
+	}
+
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// newArchiveSink archives messages in the background.
+func newArchiveSink(dir string) (sink, error) {
+	w, err := newArchiveWriter(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newQueuedSink("archive", w.write), nil
+}
+
+// dumpArchive prints the message in every record of the given archive
+// files, one per line, ready to be fed to anything reading UUDIF.
+func dumpArchive(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("dump-archive needs archive files to read")
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	for _, path := range args {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = readArchive(f, func(rec archiveRecord) error {
+			if _, err := out.Write(rec.Message); err != nil {
+				return err
+			}
+			return out.WriteByte('\n')
+		})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// readArchive calls fn for every record in an archive, migrating records
+// written by older versions of the bridge to the current layout first.
+func readArchive(r io.Reader, fn func(archiveRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024) // Order rowsets can be large.
+
+	for scanner.Scan() {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		rec, err := migrateArchiveRecord(raw)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func migrateArchiveRecord(raw []byte) (archiveRecord, error) {
+	rec := archiveRecord{}
+
+	for {
+		// Records without a schema field predate versioning.
+		var probe struct {
+			Schema int `json:"schema"`
+		}
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return rec, err
+		}
+
+		if probe.Schema == archiveSchemaVersion {
+			err := json.Unmarshal(raw, &rec)
+			return rec, err
+		}
+		if probe.Schema > archiveSchemaVersion {
+			return rec, fmt.Errorf("archive schema %d is newer than supported %d", probe.Schema, archiveSchemaVersion)
+		}
+
+		migrate, ok := archiveMigrations[probe.Schema]
+		if !ok {
+			return rec, fmt.Errorf("no migration from archive schema %d", probe.Schema)
+		}
+
+		var err error
+		raw, err = migrate(raw)
+		if err != nil {
+			return rec, err
+		}
+	}
+}
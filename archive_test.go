@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadArchiveMigrates(t *testing.T) {
+	archive := strings.Join([]string{
+		`{"resultType":"orders","version":"0.1"}`,
+		``,
+		`{"schema":1,"archived":"2015-06-01T12:00:00Z","message":{"resultType":"history","version":"0.1"}}`,
+	}, "\n")
+
+	messages := []string{}
+	err := readArchive(strings.NewReader(archive), func(rec archiveRecord) error {
+		if rec.Schema != archiveSchemaVersion {
+			t.Errorf("record at schema %d", rec.Schema)
+		}
+		messages = append(messages, string(rec.Message))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`{"resultType":"orders","version":"0.1"}`, `{"resultType":"history","version":"0.1"}`}
+	if strings.Join(messages, "\n") != strings.Join(want, "\n") {
+		t.Errorf("read %q, want %q", messages, want)
+	}
+}
+
+func TestReadArchiveRejectsNewerSchema(t *testing.T) {
+	err := readArchive(strings.NewReader(`{"schema":99,"message":{}}`), func(archiveRecord) error { return nil })
+	if err == nil {
+		t.Fatal("read a record from a newer schema")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EVE SSO
+// Authenticated ESI endpoints, such as structure markets, need an access
+// token obtained with a refresh token from an SSO application.
+var ssoClientID = flag.String("sso-client-id", "", "EVE SSO application client ID")
+var ssoSecretFile = flag.String("sso-secret-file", "", "file holding the EVE SSO application secret (or set ESI_CLIENT_SECRET)")
+var ssoTokenFile = flag.String("sso-token-file", "", "file holding the EVE SSO refresh token; rewritten when SSO rotates it")
+var ssoTokenUrl = flag.String("sso-url", "https://login.eveonline.com/v2/oauth/token", "EVE SSO token endpoint")
+
+// Scopes the refresh token must have been granted.
+var ssoScopes = []string{"esi-universe.read_structures.v1", "esi-markets.structure_markets.v1"}
+
+// Access tokens are refreshed this long before they expire.
+var ssoRefreshMargin = time.Minute
+
+// ssoAuth keeps an access token fresh.
+type ssoAuth struct {
+	clientID  string
+	secret    string
+	tokenFile string
+	client    *http.Client
+
+	mu      sync.Mutex
+	refresh string
+	access  string
+	expires time.Time
+}
+
+// sso is nil unless authenticated ESI was configured.
+var sso *ssoAuth
+
+type ssoTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// loadSSO sets up authentication if a refresh token was given and checks
+// it works and carries the scopes needed.
+func loadSSO() error {
+	if *ssoTokenFile == "" {
+		return nil
+	}
+	if *ssoClientID == "" {
+		return fmt.Errorf("-sso-token-file needs -sso-client-id")
+	}
+
+	secret := os.Getenv("ESI_CLIENT_SECRET")
+	if *ssoSecretFile != "" {
+		var err error
+		if secret, err = readSecretFile(*ssoSecretFile); err != nil {
+			return err
+		}
+	}
+	if secret == "" {
+		return fmt.Errorf("-sso-token-file needs a secret from -sso-secret-file or ESI_CLIENT_SECRET")
+	}
+
+	refresh, err := readSecretFile(*ssoTokenFile)
+	if err != nil {
+		return err
+	}
+
+	a := &ssoAuth{
+		clientID:  *ssoClientID,
+		secret:    secret,
+		tokenFile: *ssoTokenFile,
+		client:    newClient(newTransport(1)),
+		refresh:   refresh,
+	}
+	if _, err := a.token(); err != nil {
+		return err
+	}
+	sso = a
+
+	logs.infof("Authenticated to ESI as client %s", a.clientID)
+	return nil
+}
+
+// token returns a current access token, refreshing it if need be.
+func (a *ssoAuth) token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.access != "" && clk.Now().Add(ssoRefreshMargin).Before(a.expires) {
+		return a.access, nil
+	}
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {a.refresh}}
+	req, err := newRequest("POST", *ssoTokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(a.clientID, a.secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return "", fmt.Errorf("SSO token refresh: %s: %s", response.Status, body)
+	}
+
+	t := ssoTokenResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if err := checkScopes(t.AccessToken, ssoScopes); err != nil {
+		return "", err
+	}
+
+	// SSO may rotate the refresh token; the old one stops working.
+	if t.RefreshToken != "" && t.RefreshToken != a.refresh {
+		if err := writeSecretFile(a.tokenFile, t.RefreshToken); err != nil {
+			return "", err
+		}
+		a.refresh = t.RefreshToken
+	}
+
+	a.access = t.AccessToken
+	a.expires = clk.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+
+	return a.access, nil
+}
+
+// authorize adds the bearer token to a request's headers.
+func (a *ssoAuth) authorize(h http.Header) error {
+	token, err := a.token()
+	if err != nil {
+		return err
+	}
+	h.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// checkScopes makes sure an access token was granted every scope wanted.
+// The token comes straight from SSO over TLS, so its claims are read
+// without verifying the signature.
+func checkScopes(token string, want []string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("SSO access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+
+	claims := struct {
+		Scp json.RawMessage `json:"scp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+
+	// A single scope is a string, several an array.
+	granted := []string{}
+	if err := json.Unmarshal(claims.Scp, &granted); err != nil {
+		var one string
+		if json.Unmarshal(claims.Scp, &one) == nil {
+			granted = []string{one}
+		}
+	}
+
+	have := make(map[string]bool)
+	for _, s := range granted {
+		have[s] = true
+	}
+	for _, s := range want {
+		if !have[s] {
+			return fmt.Errorf("SSO token is missing scope %s", s)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// Message batching
+// UUDIF messages can carry many rowsets. Coalescing those of the same
+// result type saves the gateways a request per market.
+var batchRowsets = flag.Int("batch-rowsets", 1, "most rowsets coalesced into one message, or 1 not to batch")
+var batchRows = flag.Int("batch-rows", 20000, "most rows in a batched message")
+var batchWait = flag.Duration("batch-wait", time.Second*2, "longest a rowset waits to be batched")
+
+// batch coalesces messages from in by result type, passing each batch on
+// once it is full or has waited long enough.
+func batch(in <-chan *marketUUDIF, out chan<- *marketUUDIF, maxRowsets, maxRows int, wait time.Duration) {
+	pending := make(map[string]*marketUUDIF)
+	rows := make(map[string]int)
+
+	flush := func(resultType string) {
+		if b, ok := pending[resultType]; ok {
+			out <- b
+			delete(pending, resultType)
+			delete(rows, resultType)
+		}
+	}
+
+	tick := clk.After(wait)
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				for t := range pending {
+					flush(t)
+				}
+				close(out)
+				return
+			}
+
+			n := 0
+			for _, rs := range m.Rowsets {
+				n += len(rs.Rows)
+			}
+			if rows[m.ResultType]+n > maxRows {
+				flush(m.ResultType)
+			}
+
+			if b, ok := pending[m.ResultType]; ok {
+				b.Rowsets = append(b.Rowsets, m.Rowsets...)
+				b.CurrentTime = m.CurrentTime
+			} else {
+				// Copied, as messages may be shared with other sinks.
+				b := *m
+				b.Rowsets = append([]rowsetsUUDIF(nil), m.Rowsets...)
+				pending[m.ResultType] = &b
+			}
+			rows[m.ResultType] += n
+
+			if len(pending[m.ResultType].Rowsets) >= maxRowsets {
+				flush(m.ResultType)
+			}
+
+		case <-tick:
+			for t := range pending {
+				flush(t)
+			}
+			tick = clk.After(wait)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+)
+
+// Failing market blacklist
+// Markets that keep failing, or don't exist, are skipped for a while rather
+// than retried every time they are due. Each further blacklisting doubles
+// the time skipped; each success halves it again.
+var blacklistAfter = flag.Int("blacklist-after", 3, "consecutive failures before a market is skipped")
+var blacklistFor = flag.Duration("blacklist-for", time.Minute*30, "how long a failing market is first skipped for")
+
+// Longest a market is ever skipped for.
+var blacklistMax = time.Hour * 24
+
+type failureEntry struct {
+	failures  int // consecutive
+	strikes   uint
+	skipUntil time.Time
+}
+
+// failureTracker counts failures per market and decides what to skip.
+type failureTracker struct {
+	clock clock
+
+	mu      sync.Mutex
+	logged  int // markets skipped when last logged
+	entries map[regionKey]*failureEntry
+}
+
+var failures = &failureTracker{clock: clk, entries: make(map[regionKey]*failureEntry)}
+
+// failed notes a fetch that errored or found nothing there.
+func (t *failureTracker) failed(k regionKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[k]
+	if !ok {
+		e = &failureEntry{}
+		t.entries[k] = e
+	}
+	e.failures++
+	if e.failures < *blacklistAfter {
+		return
+	}
+
+	skip := *blacklistFor << e.strikes
+	if skip > blacklistMax || skip <= 0 || e.strikes > 32 {
+		skip = blacklistMax
+	}
+	e.skipUntil = t.clock.Now().Add(skip)
+	e.failures = 0
+	e.strikes++
+}
+
+// succeeded notes a fetch that worked, decaying past strikes.
+func (t *failureTracker) succeeded(k regionKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[k]
+	if !ok {
+		return
+	}
+	e.failures = 0
+	e.strikes /= 2
+	if e.strikes == 0 {
+		delete(t.entries, k)
+	}
+}
+
+// skip reports whether a market is blacklisted now.
+func (t *failureTracker) skip(k regionKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[k]
+	return ok && t.clock.Now().Before(e.skipUntil)
+}
+
+// nextPass logs how many markets are being skipped, when that changes.
+func (t *failureTracker) nextPass() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.skippedLocked()
+	if n > 0 && n != t.logged {
+		logs.warnf("Skipping %d markets after repeated failures", n)
+	}
+	t.logged = n
+}
+
+func (t *failureTracker) skippedLocked() int {
+	now := t.clock.Now()
+	n := 0
+	for _, e := range t.entries {
+		if now.Before(e.skipUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+// prune forgets markets no longer scanned.
+func (t *failureTracker) prune(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for k := range t.entries {
+		if !live.market(k) {
+			delete(t.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerPruner("failures", failures.prune)
+	fetchStats.Set("blacklisted", expvar.Func(func() interface{} {
+		failures.mu.Lock()
+		defer failures.mu.Unlock()
+		return failures.skippedLocked()
+	}))
+}
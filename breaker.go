@@ -0,0 +1,92 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+)
+
+// Market fetch circuit breakers
+// After enough consecutive failures a pipeline stops fetching for a
+// cooldown instead of spending the request budget on a dead endpoint.
+var fetchBreakerFailures = flag.Int("fetch-breaker-failures", 10, "consecutive failed fetches that pause a pipeline")
+var fetchBreakerCooldown = flag.Duration("fetch-breaker-cooldown", time.Minute, "how long a pipeline is paused after repeated fetch failures")
+
+// fetchBreaker is the circuit breaker for one class of market endpoint.
+type fetchBreaker struct {
+	class string
+	clock clock
+
+	mu       sync.Mutex
+	failures int // consecutive
+	openedAt time.Time
+}
+
+// One breaker per pipeline.
+var historyBreaker = &fetchBreaker{class: "history", clock: clk}
+var ordersBreaker = &fetchBreaker{class: "orders", clock: clk}
+
+// wait blocks while the circuit is open.
+func (b *fetchBreaker) wait() {
+	for {
+		b.mu.Lock()
+		left := time.Duration(0)
+		if !b.openedAt.IsZero() {
+			left = *fetchBreakerCooldown - b.clock.Now().Sub(b.openedAt)
+		}
+		b.mu.Unlock()
+
+		if left <= 0 {
+			return
+		}
+		b.clock.Sleep(left)
+	}
+}
+
+// record notes the outcome of a fetch, opening the circuit after too many
+// failures in a row.
+func (b *fetchBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		if !b.openedAt.IsZero() {
+			logs.infof("%s fetches recovered", b.class)
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures >= *fetchBreakerFailures {
+		// Opens, or re-opens after a failed half-open attempt.
+		b.openedAt = b.clock.Now()
+		fetchStats.Add(b.class+"BreakerOpened", 1)
+		logs.warnf("%d %s fetches failed in a row, pausing them for %s", b.failures, b.class, *fetchBreakerCooldown)
+	}
+}
+
+func (b *fetchBreaker) circuit() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.openedAt.IsZero():
+		return circuitClosed
+	case b.clock.Now().Sub(b.openedAt) < *fetchBreakerCooldown:
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+func init() {
+	fetchStats.Set("breakers", expvar.Func(func() interface{} {
+		return map[string]string{
+			historyBreaker.class: historyBreaker.circuit(),
+			ordersBreaker.class:  ordersBreaker.circuit(),
+		}
+	}))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFetchBreaker(t *testing.T) {
+	c := newSimClock(simStart)
+	b := &fetchBreaker{class: "test", clock: c}
+
+	for i := 1; i < *fetchBreakerFailures; i++ {
+		b.record(false)
+	}
+	if got := b.circuit(); got != circuitClosed {
+		t.Fatalf("circuit %s one failure short of opening", got)
+	}
+	b.record(false)
+	if got := b.circuit(); got != circuitOpen {
+		t.Fatalf("circuit %s after %d failures", got, *fetchBreakerFailures)
+	}
+
+	// Fetches wait out the cooldown.
+	done := make(chan time.Time)
+	go func() {
+		b.wait()
+		done <- c.Now()
+	}()
+	waitSleeping(t, c, 1)
+	c.AdvanceToNext()
+	if at := <-done; at.Sub(simStart) != *fetchBreakerCooldown {
+		t.Errorf("waited %s, want the %s cooldown", at.Sub(simStart), *fetchBreakerCooldown)
+	}
+	if got := b.circuit(); got != circuitHalfOpen {
+		t.Fatalf("circuit %s after the cooldown", got)
+	}
+
+	// A failed attempt re-opens it straight away.
+	b.record(false)
+	if got := b.circuit(); got != circuitOpen {
+		t.Fatalf("circuit %s after a failed half-open attempt", got)
+	}
+
+	c.Advance(*fetchBreakerCooldown)
+	b.wait()
+	b.record(true)
+	if got := b.circuit(); got != circuitClosed {
+		t.Fatalf("circuit %s after a success", got)
+	}
+
+	// And the count starts over.
+	b.record(false)
+	if got := b.circuit(); got != circuitClosed {
+		t.Errorf("circuit %s after one new failure", got)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Region and type catalog
+// The last regions and types loaded are cached so the API being
+// unreachable, or failing part way through pagination, doesn't stop the
+// bridge starting. Off unless a file is given, so nothing is written to
+// the working directory.
+var catalogCache = flag.String("catalog-cache", "", "file to cache the region and type catalog in, e.g. /var/lib/crestemdr/catalog.json")
+
+// Limits on paging through a catalog.
+var catalogMaxPages = 1000
+var catalogPageRetries = 3
+var catalogRetryBackoff = time.Second * 2
+
+// cachedCatalog is the layout of the catalog cache file.
+type cachedCatalog struct {
+	Saved   time.Time       `json:"saved"`
+	Regions []marketRegions `json:"regions"`
+	Types   []marketTypes   `json:"types"`
+}
+
+// retryPage fetches one page of a catalog, retrying with a doubling
+// backoff. Pagination carries on from the failed page rather than starting
+// over.
+func retryPage(page string, fetch func() error) error {
+	backoff := catalogRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fetch()
+		if err == nil {
+			return nil
+		}
+		if attempt >= catalogPageRetries {
+			return fmt.Errorf("%s: %s", page, err)
+		}
+
+		logs.with(logFields{"page": page}).err(err).warnf("Catalog page failed, retrying")
+		clk.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// saveCatalog updates the catalog cache.
+func saveCatalog(path string, update func(c *cachedCatalog)) error {
+	c, err := loadCatalog(path)
+	if err != nil {
+		c = &cachedCatalog{}
+	}
+	update(c)
+	c.Saved = clk.Now().UTC()
+
+	enc, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated cache.
+	if err := ioutil.WriteFile(path+".tmp", enc, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadCatalog reads the catalog cache.
+func loadCatalog(path string) (*cachedCatalog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	c := &cachedCatalog{}
+	if err := json.NewDecoder(file).Decode(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// How often the type catalog is crawled again for newly published types.
+var typesRefresh = flag.Duration("types-refresh", time.Hour*24, "how often to look for newly published market types, or 0 never to")
+
+// typeSet is the types being scanned, which grows as new ones are
+// published.
+type typeSet struct {
+	mu   sync.Mutex
+	list []marketTypes
+	ids  map[int64]bool
+}
+
+var scanTypes = &typeSet{ids: make(map[int64]bool)}
+
+// get returns the types to scan.
+func (s *typeSet) get() []marketTypes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list
+}
+
+// replace makes types the ones scanned, returning those added and those
+// dropped.
+func (s *typeSet) replace(types []marketTypes) (added, removed []marketTypes) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(map[int64]bool)
+	for _, t := range types {
+		ids[t.TypeID] = true
+		if !s.ids[t.TypeID] {
+			added = append(added, t)
+		}
+	}
+	for _, t := range s.list {
+		if !ids[t.TypeID] {
+			removed = append(removed, t)
+		}
+	}
+	// A new list rather than changed in place; passes hold on to the old.
+	s.ids, s.list = ids, append([]marketTypes{}, types...)
+
+	return added, removed
+}
+
+// startTypeRefresh reloads the types in the background, adding new ones
+// to the scan and dropping those no longer marketable, so their state is
+// pruned.
+func startTypeRefresh(regions []marketRegions) {
+	if *typesRefresh <= 0 || *typesFile != "" {
+		return
+	}
+
+	crawl := source.types
+	if *sdeDatabase != "" {
+		crawl = sdeTypes
+	}
+
+	go func() {
+		for {
+			clk.Sleep(*typesRefresh)
+
+			types, err := crawl()
+			if err != nil {
+				logs.err(err).warnf("Refreshing types failed")
+				continue
+			}
+			types = filterMarketable(types)
+			if len(types) == 0 {
+				continue // Never stop scanning everything on a bad crawl.
+			}
+			added, removed := scanTypes.replace(types)
+			if len(added) == 0 && len(removed) == 0 {
+				continue
+			}
+
+			logs.infof("Added %d new Types, dropped %d", len(added), len(removed))
+			leaders.setTypes(added)
+			all := scanTypes.get()
+			live.set(regions, all)
+			if *catalogCache != "" {
+				warnCheck(saveCatalog(*catalogCache, func(c *cachedCatalog) { c.Types = all }))
+			}
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// setChecksum adds an integrity header over the body as sent, so the
+// gateway can tell a truncated or corrupted upload from a bad one.
+func setChecksum(h http.Header, algorithm string, body []byte) {
+	switch algorithm {
+	case "md5":
+		sum := md5.Sum(body)
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	case "sha256":
+		sum := sha256.Sum256(body)
+		h.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
+
+// intact says whether a stored payload is whole: gzip's own checksum for
+// compressed ones, and well formed JSON for the rest.
+func intact(msg []byte, gzipped bool) bool {
+	if gzipped {
+		var err error
+		if msg, err = decompress(msg); err != nil {
+			return false
+		}
+	}
+	return json.Valid(msg)
+}
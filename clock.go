@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// clock abstracts time for the scheduler, rate limiters and retry logic so
+// they can be driven by a simulated clock.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// Clock used by everything that doesn't have one handed to it.
+var clk clock = realClock{}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// simClock is a clock that only moves when told to. Sleepers are woken in
+// deadline order as it is advanced, so hours of scheduling can be replayed
+// deterministically in moments.
+type simClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []simWaiter
+}
+
+type simWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newSimClock(start time.Time) *simClock {
+	return &simClock{now: start}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *simClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *simClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	w := simWaiter{c.now.Add(d), ch}
+	i := sort.Search(len(c.waiters), func(i int) bool { return c.waiters[i].at.After(w.at) })
+	c.waiters = append(c.waiters, simWaiter{})
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = w
+
+	return ch
+}
+
+// Advance moves the clock forward by d, waking each sleeper due in that
+// time in turn.
+func (c *simClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for c.fireNext(target) {
+	}
+
+	c.mu.Lock()
+	c.now = target
+	c.mu.Unlock()
+}
+
+// AdvanceToNext jumps straight to the next sleeper's deadline and wakes it.
+// It returns false if nothing is sleeping.
+func (c *simClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	if len(c.waiters) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	at := c.waiters[0].at
+	c.mu.Unlock()
+
+	return c.fireNext(at)
+}
+
+// fireNext wakes the earliest sleeper due by target.
+func (c *simClock) fireNext(target time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.waiters) == 0 || c.waiters[0].at.After(target) {
+		return false
+	}
+
+	w := c.waiters[0]
+	c.waiters = c.waiters[1:]
+	c.now = w.at
+	w.ch <- w.at
+
+	return true
+}
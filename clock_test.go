@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var simStart = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// waitSleeping blocks until n goroutines are asleep on c, failing the test
+// if they never get there.
+func waitSleeping(t *testing.T, c *simClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		c.mu.Lock()
+		sleeping := len(c.waiters)
+		c.mu.Unlock()
+		if sleeping >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines asleep, waited for %d", sleeping, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSimClockWakesInDeadlineOrder(t *testing.T) {
+	c := newSimClock(simStart)
+	late, early := c.After(time.Minute), c.After(time.Second)
+
+	c.Advance(time.Second * 30)
+	select {
+	case at := <-early:
+		if !at.Equal(simStart.Add(time.Second)) {
+			t.Errorf("early sleeper woke at %s", at)
+		}
+	default:
+		t.Fatal("early sleeper still asleep")
+	}
+	select {
+	case <-late:
+		t.Fatal("late sleeper woke early")
+	default:
+	}
+	if !c.Now().Equal(simStart.Add(time.Second * 30)) {
+		t.Errorf("clock at %s after advancing", c.Now())
+	}
+
+	if !c.AdvanceToNext() {
+		t.Fatal("no sleeper to advance to")
+	}
+	if at := <-late; !at.Equal(simStart.Add(time.Minute)) {
+		t.Errorf("late sleeper woke at %s", at)
+	}
+	if c.AdvanceToNext() {
+		t.Error("advanced with nothing asleep")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// derivedColumn is an operator defined column computed from the others
+// in each row, written as "name = expression". Expressions are arithmetic
+// over column names and numbers, e.g. "totalValue = price * volRemaining".
+type derivedColumn struct {
+	name string
+	expr exprNode
+	refs []string // columns the expression reads
+}
+
+// exprNode is part of a parsed expression. eval returns false when the
+// value can't be worked out for the row.
+type exprNode interface {
+	eval(columns map[string]int, row []interface{}) (float64, bool)
+}
+
+type exprNumber float64
+
+func (n exprNumber) eval(columns map[string]int, row []interface{}) (float64, bool) {
+	return float64(n), true
+}
+
+type exprColumn string
+
+func (c exprColumn) eval(columns map[string]int, row []interface{}) (float64, bool) {
+	i, ok := columns[string(c)]
+	if !ok || i >= len(row) {
+		return 0, false
+	}
+	switch v := row[i].(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type exprNegate struct {
+	x exprNode
+}
+
+func (n exprNegate) eval(columns map[string]int, row []interface{}) (float64, bool) {
+	x, ok := n.x.eval(columns, row)
+	return -x, ok
+}
+
+type exprBinary struct {
+	op   byte
+	l, r exprNode
+}
+
+func (b exprBinary) eval(columns map[string]int, row []interface{}) (float64, bool) {
+	l, ok := b.l.eval(columns, row)
+	if !ok {
+		return 0, false
+	}
+	r, ok := b.r.eval(columns, row)
+	if !ok {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	case '/':
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	}
+	return 0, false
+}
+
+// parseColumn reads a "name = expression" column definition.
+func parseColumn(def string) (derivedColumn, error) {
+	i := strings.Index(def, "=")
+	if i < 0 {
+		return derivedColumn{}, fmt.Errorf("column %q: want name = expression", def)
+	}
+	c := derivedColumn{name: strings.TrimSpace(def[:i])}
+	if c.name == "" {
+		return c, fmt.Errorf("column %q: missing name", def)
+	}
+
+	p := &exprParser{src: def[i+1:]}
+	var err error
+	if c.expr, err = p.parseSum(); err == nil && p.peek() != 0 {
+		err = fmt.Errorf("unexpected %q", p.src[p.pos:])
+	}
+	if err != nil {
+		return c, fmt.Errorf("column %s: %s", c.name, err)
+	}
+	c.refs = p.refs
+
+	return c, nil
+}
+
+// exprParser is a recursive descent parser for column expressions.
+type exprParser struct {
+	src  string
+	pos  int
+	refs []string
+}
+
+// peek skips spaces and returns the next character, or 0 at the end.
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	l, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l = exprBinary{op, l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	l, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		l = exprBinary{op, l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseFactor() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '-':
+		p.pos++
+		x, err := p.parseFactor()
+		return exprNegate{x}, err
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	case c == '.' || unicode.IsDigit(rune(c)):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		return exprNumber(n), err
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		p.refs = append(p.refs, name)
+		return exprColumn(name), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", c)
+}
+
+// addColumns returns a copy of a message with derived columns appended.
+// A column is only added to messages having every column it reads, and is
+// null in rows it can't be worked out for.
+func addColumns(m *marketUUDIF, derived []derivedColumn) *marketUUDIF {
+	columns := make(map[string]int)
+	for i, c := range m.Columns {
+		columns[c] = i
+	}
+
+	add := []derivedColumn{}
+	for _, d := range derived {
+		ok := true
+		for _, ref := range d.refs {
+			if _, found := columns[ref]; !found {
+				ok = false
+			}
+		}
+		if ok {
+			add = append(add, d)
+		}
+	}
+	if len(add) == 0 {
+		return m
+	}
+
+	e := *m
+	e.Columns = append([]string{}, m.Columns...)
+	for _, d := range add {
+		e.Columns = append(e.Columns, d.name)
+	}
+
+	e.Rowsets = make([]rowsetsUUDIF, len(m.Rowsets))
+	for i, rs := range m.Rowsets {
+		e.Rowsets[i] = rs
+		e.Rowsets[i].Rows = make([][]interface{}, len(rs.Rows))
+		for j, row := range rs.Rows {
+			r := append(make([]interface{}, 0, len(row)+len(add)), row...)
+			for _, d := range add {
+				var v interface{}
+				if x, ok := d.expr.eval(columns, row); ok {
+					v = x
+				}
+				r = append(r, v)
+			}
+			e.Rowsets[i].Rows[j] = r
+		}
+	}
+
+	return &e
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestParseColumn(t *testing.T) {
+	for _, test := range []struct {
+		def  string
+		name string
+		ok   bool
+	}{
+		{"total = price * volRemaining", "total", true},
+		{"spread=(high-low)/average", "spread", true},
+		{"neg = -price + 1.5", "neg", true},
+		{"price * 2", "", false},
+		{" = price", "", false},
+		{"total = price *", "", false},
+		{"total = (price + 1", "", false},
+		{"total = price volRemaining", "", false},
+		{"total = price % 2", "", false},
+		{"total = 1.2.3", "", false},
+	} {
+		c, err := parseColumn(test.def)
+		if test.ok && err != nil {
+			t.Errorf("%q: %v", test.def, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: parsed without error", test.def)
+		}
+		if test.ok && c.name != test.name {
+			t.Errorf("%q: named %q, want %q", test.def, c.name, test.name)
+		}
+	}
+}
+
+func TestColumnEval(t *testing.T) {
+	columns := map[string]int{"price": 0, "volRemaining": 1, "bid": 2, "issueDate": 3, "zero": 4}
+	row := []interface{}{2.5, int64(4), true, "2015-06-01T12:00:00+00:00", 0}
+
+	for _, test := range []struct {
+		expr string
+		want float64
+		ok   bool
+	}{
+		{"price * volRemaining", 10, true},
+		{"1 + 2 * 3", 7, true},
+		{"(1 + 2) * 3", 9, true},
+		{"10 - 4 - 3", 3, true},
+		{"12 / 3 / 2", 2, true},
+		{"-price * 2", -5, true},
+		{"-(1 + 2)", -3, true},
+		{"bid + 1", 2, true},
+		{"price / zero", 0, false},
+		{"price / (volRemaining - 4)", 0, false},
+		{"issueDate * 2", 0, false},
+		{"missing + 1", 0, false},
+	} {
+		c, err := parseColumn("x = " + test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		got, ok := c.expr.eval(columns, row)
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("%q = %g, %t; want %g, %t", test.expr, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestAddColumns(t *testing.T) {
+	total, _ := parseColumn("total = price * volRemaining")
+	other, _ := parseColumn("other = price * missing")
+
+	m := &marketUUDIF{ResultType: "orders", Columns: []string{"price", "volRemaining"}}
+	m.Rowsets = []rowsetsUUDIF{{RegionID: 10000002, TypeID: 34, Rows: [][]interface{}{
+		{2.5, int64(4)},
+		{"n/a", int64(4)},
+	}}}
+
+	e := addColumns(m, []derivedColumn{total, other})
+
+	// Columns reading ones the message hasn't are left out.
+	if len(e.Columns) != 3 || e.Columns[2] != "total" {
+		t.Fatalf("columns %v, want total added alone", e.Columns)
+	}
+	rows := e.Rowsets[0].Rows
+	if rows[0][2] != 10.0 {
+		t.Errorf("total %v, want 10", rows[0][2])
+	}
+	if rows[1][2] != nil {
+		t.Errorf("total %v for a non-numeric price, want null", rows[1][2])
+	}
+	if len(m.Rowsets[0].Rows[0]) != 2 {
+		t.Error("original message changed")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command]
+
+Commands:
+  run                         scan markets and upload them (default)
+  dump-regions                print the regions that would be scanned
+  dump-types                  print the types that would be scanned
+  verify <regionID> <typeID>  fetch one market and print its UUDIF messages
+  simulate <file>             compare scheduling policies against recorded
+                              change frequencies
+  replay-spool <path>...      re-upload spooled and dead-lettered messages,
+                              removing each once posted
+  dump-archive <file>...      print the messages in archive files, one per
+                              line, upgrading records from older versions
+  smoke                       scan a few live markets into a fake EMDR and
+                              check the results (built with -tags=live)
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// Commands only built in with build tags, by name.
+var extraCommands = map[string]func(args []string) error{}
+
+// dumpRegions prints the regions that would be scanned.
+func dumpRegions() error {
+	regions, err := loadRegions()
+	if err != nil {
+		return err
+	}
+	for _, r := range regions {
+		fmt.Printf("%d\t%s\n", r.RegionID, r.RegionName)
+	}
+	return nil
+}
+
+// dumpTypes prints the types that would be scanned.
+func dumpTypes() error {
+	types, err := loadTypes()
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		fmt.Printf("%d\t%s\n", t.TypeID, t.TypeName)
+	}
+	return nil
+}
+
+// verify fetches a single market and prints the messages it would upload.
+func verify(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("verify needs a regionID and a typeID")
+	}
+	regionID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	typeID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if err := loadStations(); err != nil {
+		return err
+	}
+
+	messages := []marketUUDIF{}
+
+	if !*noHistory {
+		h, code, err := fetchHistory(regionID, typeID)
+		if err != nil {
+			return err
+		}
+		if code != 200 {
+			return fmt.Errorf("history returned status %d", code)
+		}
+		messages = append(messages, newHistoryUUDIF(h, regionID, typeID))
+	}
+
+	if !*noOrders {
+		for _, side := range []string{"buy", "sell"} {
+			o, code, err := fetchOrders(regionID, typeID, side)
+			if err != nil {
+				return err
+			}
+			if code != 200 {
+				return fmt.Errorf("%s orders returned status %d", side, code)
+			}
+			messages = append(messages, newOrdersUUDIF(o, regionID, typeID))
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	for _, m := range messages {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Optional JSON configuration file
+// Holds settings too structured for the command line.
+var configFile = flag.String("config", "", "path to a JSON configuration file")
+
+// bridgeConfig is the layout of the configuration file.
+type bridgeConfig struct {
+	// Upload gateways for the default EMDR destination, balanced by weight
+	// and observed latency. Ignored when Destinations is set.
+	Endpoints []endpointConfig `json:"endpoints"`
+
+	// Every message is posted to each destination.
+	Destinations []destinationConfig `json:"destinations"`
+
+	// Whether archive write failures should fail readiness. Superseded by
+	// Critical in the archive's entry in Sinks.
+	ArchiveCritical bool `json:"archiveCritical"`
+
+	// Queue and retry settings for each sink enabled from the command
+	// line, keyed by its name, e.g. "postgres" or "kafka".
+	Sinks map[string]sinkConfig `json:"sinks"`
+
+	// Experimental features to enable at startup.
+	Features map[string]bool `json:"features"`
+}
+
+type endpointConfig struct {
+	URL    string  `json:"url"`
+	Weight float64 `json:"weight"`
+}
+
+// destinationConfig describes one place messages are uploaded to.
+type destinationConfig struct {
+	Name      string           `json:"name"`
+	Endpoints []endpointConfig `json:"endpoints"`
+
+	// What is posted: "uudif" messages for EMDR, the default, or
+	// "aggregator" for ESI shaped records as newer aggregators take them.
+	Format string `json:"format"`
+
+	// Messages waiting beyond this are dropped for this destination only.
+	QueueSize int `json:"queueSize"`
+
+	// Upload goroutine pool bounds, defaulting to the command line flags.
+	Uploaders    int `json:"uploaders"`
+	MaxUploaders int `json:"maxUploaders"`
+
+	// Most posts per second, defaulting to -upload-rate. 0 for no limit.
+	Rate *float64 `json:"rate"`
+
+	// Failed posts are retried this many times, doubling the backoff
+	// between attempts. Defaults to 3.
+	Retries      *int     `json:"retries"`
+	RetryBackoff duration `json:"retryBackoff"`
+
+	// Gzip level for uploads, or 0 to send them uncompressed. Defaults to
+	// -upload-gzip.
+	GzipLevel *int `json:"gzipLevel"`
+
+	// Messages encoding to more JSON than this are split into several.
+	// Defaults to -upload-max-bytes.
+	MaxMessageBytes int `json:"maxMessageBytes"`
+
+	// Add solar system security and region names to rows. Only for
+	// private ingest services; EMDR rejects columns it doesn't know.
+	Enrich bool `json:"enrich"`
+
+	// Extra columns computed from each row, as "name = expression", such
+	// as "totalValue = price * volRemaining". Like Enrich, not for EMDR.
+	Columns []string `json:"columns"`
+
+	// How orders in player-owned structures are sent: "station" as is,
+	// "placeholder" with StructurePlaceholder as the stationID, or
+	// "exclude" to leave them out. Defaults to "station".
+	StructureLocations   string `json:"structureLocations"`
+	StructurePlaceholder int64  `json:"structurePlaceholder"`
+
+	// Integrity header sent with every post: "md5" for Content-MD5,
+	// "sha256" for a Digest header, or empty for neither.
+	Checksum string `json:"checksum"`
+
+	// Extra headers sent with every post, such as an API key for an
+	// authenticated ingest service. $VAR and ${VAR} in values are replaced
+	// from the environment, so secrets needn't be kept in the file.
+	Headers map[string]string `json:"headers"`
+
+	// Client certificate and CA for endpoints that require them.
+	TLS *tlsSettings `json:"tls"`
+
+	// Whether this destination being unhealthy fails readiness.
+	// Defaults to true.
+	Critical *bool `json:"critical"`
+
+	// Only markets matching this are uploaded here, e.g. just The Forge's
+	// orders with {"resultTypes": ["orders"], "regions": [10000002]}.
+	Filter *filterConfig `json:"filter"`
+}
+
+// sinkConfig is how one sink queues and retries messages. Each sink has
+// its own queue, so a slow one only drops its own messages.
+type sinkConfig struct {
+	// Messages waiting beyond this are dropped for this sink only.
+	// Defaults to 1000.
+	QueueSize int `json:"queueSize"`
+
+	// Failed writes are retried this many times, doubling the backoff
+	// between attempts.
+	Retries      int      `json:"retries"`
+	RetryBackoff duration `json:"retryBackoff"`
+
+	// Whether this sink being unhealthy fails readiness. Defaults to false.
+	Critical *bool `json:"critical"`
+
+	// Only markets matching this are handed to the sink.
+	Filter *filterConfig `json:"filter"`
+}
+
+// duration reads a time.Duration from a string such as "1m30s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// loadConfig reads the configuration file if one was given and fills in
+// defaults for anything left out.
+func loadConfig(path string) (*bridgeConfig, error) {
+	c := &bridgeConfig{}
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		if err := json.NewDecoder(file).Decode(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Sinks == nil {
+		c.Sinks = map[string]sinkConfig{}
+	}
+	if a := c.Sinks["archive"]; a.Critical == nil && c.ArchiveCritical {
+		a.Critical = &c.ArchiveCritical
+		c.Sinks["archive"] = a
+	}
+	for name, sc := range c.Sinks {
+		if sc.QueueSize < 0 || sc.Retries < 0 {
+			return nil, fmt.Errorf("sink %s: queueSize and retries can't be negative", name)
+		}
+		if sc.Filter != nil {
+			if err := sc.Filter.check(); err != nil {
+				return nil, fmt.Errorf("sink %s: %s", name, err)
+			}
+		}
+	}
+
+	if len(c.Destinations) == 0 {
+		c.Destinations = []destinationConfig{{Name: "emdr", Endpoints: c.Endpoints}}
+	}
+
+	// Names key the spool, dead letters and stats, so must be unique.
+	names := make(map[string]bool)
+	for i := range c.Destinations {
+		d := &c.Destinations[i]
+		if d.Name == "" {
+			return nil, fmt.Errorf("destination %d has no name", i+1)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("destination %s is named twice", d.Name)
+		}
+		names[d.Name] = true
+		if len(d.Endpoints) == 0 {
+			d.Endpoints = []endpointConfig{{URL: uploadUrl}}
+		}
+		for j := range d.Endpoints {
+			if d.Endpoints[j].Weight <= 0 {
+				d.Endpoints[j].Weight = 1
+			}
+		}
+		if d.QueueSize <= 0 {
+			d.QueueSize = 1000
+		}
+		if d.Uploaders <= 0 {
+			d.Uploaders = *minUploaders
+		}
+		if d.MaxUploaders <= 0 {
+			d.MaxUploaders = *maxUploaders
+		}
+		if d.Retries == nil {
+			retries := 3
+			d.Retries = &retries
+		}
+		if *d.Retries < 0 {
+			return nil, fmt.Errorf("%s: retries can't be negative", d.Name)
+		}
+		if d.RetryBackoff.Duration <= 0 {
+			d.RetryBackoff.Duration = time.Second
+		}
+		if d.Rate == nil {
+			rate := *uploadRate
+			d.Rate = &rate
+		}
+		if d.GzipLevel == nil {
+			level := *uploadGzipLevel
+			d.GzipLevel = &level
+		}
+		if *d.GzipLevel < gzip.HuffmanOnly || *d.GzipLevel > gzip.BestCompression {
+			return nil, fmt.Errorf("%s: gzip level %d out of range", d.Name, *d.GzipLevel)
+		}
+		if d.MaxMessageBytes == 0 {
+			d.MaxMessageBytes = *uploadMaxBytes
+		}
+		if d.StructureLocations == "" {
+			d.StructureLocations = structuresAsStation
+		}
+		if err := checkStructurePolicy(d.StructureLocations); err != nil {
+			return nil, fmt.Errorf("%s: %s", d.Name, err)
+		}
+		for _, def := range d.Columns {
+			if _, err := parseColumn(def); err != nil {
+				return nil, fmt.Errorf("%s: %s", d.Name, err)
+			}
+		}
+		switch d.Format {
+		case "":
+			d.Format = formatUUDIF
+		case formatUUDIF, formatAggregator:
+		default:
+			return nil, fmt.Errorf("%s: unknown format %q", d.Name, d.Format)
+		}
+		if d.Filter != nil {
+			if err := d.Filter.check(); err != nil {
+				return nil, fmt.Errorf("%s: %s", d.Name, err)
+			}
+		}
+		switch d.Checksum {
+		case "", "md5", "sha256":
+		default:
+			return nil, fmt.Errorf("%s: unknown checksum %q", d.Name, d.Checksum)
+		}
+		if d.TLS != nil {
+			if _, err := d.TLS.clientConfig(); err != nil {
+				return nil, fmt.Errorf("%s: %s", d.Name, err)
+			}
+		}
+		if d.Critical == nil {
+			critical := true
+			d.Critical = &critical
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadConfigDestinationNames(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		ok     bool
+	}{
+		{`{"destinations": [{"name": "emdr"}, {"name": "mirror"}]}`, true},
+		{`{"destinations": [{"name": "emdr"}, {}]}`, false},
+		{`{"destinations": [{"name": "emdr"}, {"name": "emdr"}]}`, false},
+	} {
+		file, err := ioutil.TempFile("", "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(test.config)
+		file.Close()
+
+		_, err = loadConfig(file.Name())
+		os.Remove(file.Name())
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: loaded without error", test.config)
+		}
+	}
+}
+
+func TestLoadConfigRetriesDefault(t *testing.T) {
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := *c.Destinations[0].Retries; got != 3 {
+		t.Errorf("default destination retries %d times, want 3", got)
+	}
+}
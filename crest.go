@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+type crestRegions_s struct {
+	TotalCount_Str string
+	Items          []struct {
+		HRef string
+		Name string
+	}
+	PageCount  int64
+	TotalCount int64
+}
+
+type crestTypes_s struct {
+	TotalCount_Str string
+	Items          []struct {
+		Type struct {
+			ID   int64
+			Name string
+		}
+	}
+	PageCount  int64
+	TotalCount int64
+	Next       struct {
+		HRef string `json:"href,omitempty"`
+	}
+}
+
+// crestSource fetches market data from the legacy CREST API.
+type crestSource struct{}
+
+func (crestSource) regions() ([]marketRegions, error) {
+	regions := []marketRegions{}
+
+	crestRegions := crestRegions_s{}
+	response, err := market.get(crestUrl+"regions/", nil, nil, &crestRegions, false)
+	if err != nil {
+		return nil, err
+	}
+	if response.status != 200 {
+		return nil, fmt.Errorf("regions returned status %d", response.status)
+	}
+
+	// Extract the ID out of the URI.
+	re := regexp.MustCompile("([0-9]+)")
+	for _, r := range crestRegions.Items {
+		regionID, _ := strconv.ParseInt(re.FindString(r.HRef), 10, 64)
+		regions = append(regions, marketRegions{regionID, r.Name})
+	}
+
+	return regions, nil
+}
+
+func (crestSource) types() ([]marketTypes, error) {
+	types := []marketTypes{}
+
+	// Collect Types from CREST servers, following the Next links until
+	// there aren't any more.
+	seen := make(map[string]bool)
+	for next, pages := crestUrl+"market/types/", 0; next != ""; pages++ {
+		if pages >= catalogMaxPages {
+			return nil, fmt.Errorf("market/types: gave up after %d pages", pages)
+		}
+		if seen[next] {
+			// A page pointing back to one already read is the end.
+			break
+		}
+		seen[next] = true
+
+		crestTypes := crestTypes_s{}
+		err := retryPage(next, func() error {
+			response, err := market.get(next, nil, nil, &crestTypes, false)
+			if err != nil {
+				return err
+			}
+			if response.status != 200 {
+				return fmt.Errorf("status %d", response.status)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range crestTypes.Items {
+			types = append(types, marketTypes{t.Type.ID, t.Type.Name})
+		}
+		next = crestTypes.Next.HRef
+	}
+
+	return types, nil
+}
+
+func (crestSource) history(regionID int64, typeID int64) (marketHistory, int, error) {
+	h := marketHistory{}
+	url := fmt.Sprintf("%smarket/%d/types/%d/history/", crestUrl, regionID, typeID)
+
+	response, err := market.get(url, nil, nil, &h, true)
+	if err != nil {
+		return h, 0, err
+	}
+	return h, response.status, nil
+}
+
+func (crestSource) orders(regionID int64, typeID int64, side string) (marketOrders, int, error) {
+	o := marketOrders{}
+	next := fmt.Sprintf("%smarket/%d/orders/%s/?type=%stypes/%d/", crestUrl, regionID, side, crestUrl, typeID)
+
+	// Large books are split over pages; gather them all into one.
+	var first *marketResponse
+	seen := make(map[string]bool)
+	for pages := 0; next != "" && !seen[next]; pages++ {
+		if pages >= catalogMaxPages {
+			return o, 0, fmt.Errorf("%d/%d %s orders: gave up after %d pages", regionID, typeID, side, pages)
+		}
+		seen[next] = true
+
+		// The pages change together, so if the first hasn't changed
+		// neither has the rest of the book. Its ETag is only kept once
+		// every page has been read, so a book cut short is fetched again.
+		page := marketOrders{}
+		response, err := market.stream(next, nil, nil, pages == 0, func(dec *json.Decoder) error {
+			return dec.Decode(&page)
+		})
+		if err != nil {
+			return o, 0, err
+		}
+		if response.status != 200 {
+			return o, response.status, nil
+		}
+		if first == nil {
+			first = response
+		}
+
+		o.Items = append(o.Items, page.Items...)
+		o.PageCount = page.PageCount
+		next = page.Next.HRef
+	}
+	o.TotalCount = int64(len(o.Items))
+	first.keepETag()
+
+	return o, 200, nil
+}
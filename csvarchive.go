@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// CSV archive
+// Every message is appended to a gzipped CSV file per result type per day,
+// in the column layout of the old public market dumps, for keeping long
+// term archives. Each message is its own gzip member, which readers see
+// as one stream, so a crash can only lose the message being written.
+var csvArchiveDir = flag.String("csv-archive-dir", "", "directory daily gzipped CSV archives of orders and history are written to")
+
+// Archive columns, as the old dumps had them.
+var csvOrderColumns = []string{"orderid", "regionid", "systemid", "stationid", "typeid", "bid", "price", "minvolume", "volremain", "volenter", "issued", "duration", "range", "reportedby", "reportedtime"}
+var csvHistoryColumns = []string{"regionid", "typeid", "date", "orders", "quantity", "low", "high", "average", "reportedtime"}
+
+// How times are written in the archives.
+const csvTimeFormat = "2006-01-02 15:04:05"
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *csvArchiveDir == "" {
+			return nil, nil
+		}
+		if err := os.MkdirAll(*csvArchiveDir, 0755); err != nil {
+			return nil, err
+		}
+		return newQueuedSink("csv archive", csvArchiveWriter(*csvArchiveDir)), nil
+	})
+}
+
+// csvArchiveName is the archive for a result type on a day.
+func csvArchiveName(dir, resultType string, day time.Time) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.csv.gz", resultType, day.UTC().Format("2006-01-02")))
+}
+
+// csvArchiveWriter returns a write func appending messages to dir's archives.
+func csvArchiveWriter(dir string) func(m *marketUUDIF) error {
+	return func(m *marketUUDIF) error {
+		columns := csvOrderColumns
+		switch m.ResultType {
+		case "orders":
+		case "history":
+			columns = csvHistoryColumns
+		default:
+			return nil
+		}
+
+		index := make(map[string]int)
+		for i, c := range m.Columns {
+			index[c] = i
+		}
+
+		// Rows are filed by when they were generated, so a message can
+		// straddle midnight.
+		days := map[string][][]string{}
+		for _, rs := range m.Rowsets {
+			name := csvArchiveName(dir, m.ResultType, rs.GeneratedAt)
+			for _, row := range rs.Rows {
+				if m.ResultType == "orders" {
+					days[name] = append(days[name], csvOrder(rs, index, row))
+				} else {
+					days[name] = append(days[name], csvHistory(rs, index, row))
+				}
+			}
+		}
+
+		for name, rows := range days {
+			if err := appendCSVArchive(name, columns, rows); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// appendCSVArchive adds rows to an archive as a new gzip member, starting it
+// with a header if it is new.
+func appendCSVArchive(name string, columns []string, rows [][]string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	w := csv.NewWriter(z)
+	if info.Size() == 0 {
+		w.Write(columns)
+	}
+	w.WriteAll(rows)
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+func csvOrder(rs rowsetsUUDIF, index map[string]int, row []interface{}) []string {
+	bid, _ := exprColumn("bid").eval(index, row)
+	price, _ := exprColumn("price").eval(index, row)
+	return []string{
+		csvInt(rowInt(index, row, "orderID")),
+		csvInt(rs.RegionID),
+		csvInt(rowInt(index, row, "solarSystemID")),
+		csvInt(rowInt(index, row, "stationID")),
+		csvInt(rs.TypeID),
+		csvInt(int64(bid)),
+		strconv.FormatFloat(price, 'f', 2, 64),
+		csvInt(rowInt(index, row, "minVolume")),
+		csvInt(rowInt(index, row, "volRemaining")),
+		csvInt(rowInt(index, row, "volEntered")),
+		rowTime(index, row, "issueDate").UTC().Format(csvTimeFormat),
+		csvInt(rowInt(index, row, "duration")),
+		csvInt(rowInt(index, row, "range")),
+		"0", // Reporting characters aren't known.
+		rs.GeneratedAt.UTC().Format(csvTimeFormat),
+	}
+}
+
+func csvHistory(rs rowsetsUUDIF, index map[string]int, row []interface{}) []string {
+	low, _ := exprColumn("low").eval(index, row)
+	high, _ := exprColumn("high").eval(index, row)
+	average, _ := exprColumn("average").eval(index, row)
+	return []string{
+		csvInt(rs.RegionID),
+		csvInt(rs.TypeID),
+		rowTime(index, row, "date").UTC().Format("2006-01-02"),
+		csvInt(rowInt(index, row, "orders")),
+		csvInt(rowInt(index, row, "quantity")),
+		strconv.FormatFloat(low, 'f', 2, 64),
+		strconv.FormatFloat(high, 'f', 2, 64),
+		strconv.FormatFloat(average, 'f', 2, 64),
+		rs.GeneratedAt.UTC().Format(csvTimeFormat),
+	}
+}
+
+func csvInt(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dead letters
+// Messages a gateway rejects outright are kept with its response, one
+// directory per destination, so operators can see what it didn't like.
+var deadLetterDir = flag.String("dead-letter-dir", "", "directory rejected uploads are kept in with the gateway's response, or empty not to keep them")
+var deadLetterMaxAge = flag.Duration("dead-letter-max-age", time.Hour*24*7, "how long rejected uploads are kept")
+
+// deadLetter is one rejected message as written to disk.
+type deadLetter struct {
+	Destination string          `json:"destination"`
+	Rejected    time.Time       `json:"rejected"`
+	Status      string          `json:"status"`
+	Response    string          `json:"response"`
+	Message     json.RawMessage `json:"message"`
+}
+
+// deadLetterStore writes rejected messages for one destination.
+type deadLetterStore struct {
+	name  string
+	dir   string
+	clock clock
+
+	mu  sync.Mutex
+	seq int64
+}
+
+func newDeadLetterStore(name, dir string) (*deadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	d := &deadLetterStore{name: name, dir: dir, clock: clk}
+	registerPruner(name+" dead letters", d.prune)
+	return d, nil
+}
+
+// put keeps a rejected message along with why it was rejected.
+func (d *deadLetterStore) put(msg []byte, gzipped bool, rejection *uploadError) error {
+	if gzipped {
+		var err error
+		if msg, err = decompress(msg); err != nil {
+			return err
+		}
+	}
+
+	now := d.clock.Now().UTC()
+	b, err := json.MarshalIndent(deadLetter{
+		Destination: d.name,
+		Rejected:    now,
+		Status:      rejection.status,
+		Response:    string(rejection.body),
+		Message:     json.RawMessage(msg),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.seq++
+	name := filepath.Join(d.dir, fmt.Sprintf("%s-%06d.json", now.Format("20060102T150405"), d.seq%1000000))
+	d.mu.Unlock()
+
+	return ioutil.WriteFile(name, b, 0600)
+}
+
+// prune drops dead letters older than the age limit.
+func (d *deadLetterStore) prune(now time.Time) int {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") && now.Sub(f.ModTime()) > *deadLetterMaxAge {
+			if os.Remove(filepath.Join(d.dir, f.Name())) == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Order and history columns generated as whole numbers. The rest are
+// floats, strings or bools, apart from range which is an int.
+var wholeColumns = map[string]bool{
+	"volRemaining":  true,
+	"orderID":       true,
+	"volEntered":    true,
+	"minVolume":     true,
+	"duration":      true,
+	"stationID":     true,
+	"solarSystemID": true,
+	"orders":        true,
+	"quantity":      true,
+}
+
+// decodeUUDIF reads back a message the bridge encoded, with its rows
+// holding the same types they were generated with rather than float64 for
+// every number, so messages that were written out and read back are
+// handled like fresh ones.
+func decodeUUDIF(b []byte) (*marketUUDIF, error) {
+	m := &marketUUDIF{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(m); err != nil {
+		return nil, err
+	}
+
+	for _, rs := range m.Rowsets {
+		for _, row := range rs.Rows {
+			for i, v := range row {
+				n, ok := v.(json.Number)
+				if !ok {
+					continue
+				}
+				row[i] = columnNumber(m.Columns, i, n)
+			}
+		}
+	}
+	return m, nil
+}
+
+// wholeNumber reads a whole number cell whichever way it was decoded.
+func wholeNumber(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case float64:
+		if n == float64(int64(n)) {
+			return int64(n), true
+		}
+	case json.Number:
+		if w, err := n.Int64(); err == nil {
+			return w, true
+		}
+		if f, err := n.Float64(); err == nil {
+			return wholeNumber(f)
+		}
+	}
+	return 0, false
+}
+
+// columnNumber converts a decoded number to its column's type.
+func columnNumber(columns []string, i int, n json.Number) interface{} {
+	name := ""
+	if i < len(columns) {
+		name = columns[i]
+	}
+	if name == "range" || wholeColumns[name] {
+		if w, ok := wholeNumber(n); ok {
+			if name == "range" {
+				return int(w)
+			}
+			return w
+		}
+	}
+	f, _ := n.Float64()
+	return f
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"sync"
+	"time"
+)
+
+// Daily downtime
+// Every API call fails while the cluster is down, so fetching stops a
+// little before it and starts again once the cluster is back, with a fresh
+// pass so the new day's history goes out first.
+var downtimeStart = flag.String("downtime", "11:00", "daily downtime start as HH:MM UTC, or empty to ignore downtime")
+var downtimeLead = flag.Duration("downtime-lead", time.Minute*5, "how long before downtime to stop fetching")
+
+// Downtime lasts at least this long; after it the cluster is polled.
+var downtimeMinimum = time.Minute * 10
+var downtimePollInterval = time.Second * 30
+
+// downtimeWatcher pauses fetching over downtime.
+type downtimeWatcher struct {
+	clock clock
+
+	mu     sync.Mutex
+	rescan bool
+}
+
+var downtime = &downtimeWatcher{clock: clk}
+
+// start watches for downtime in the background.
+func (d *downtimeWatcher) start() {
+	if *downtimeStart == "" {
+		return
+	}
+	at, err := time.Parse("15:04", *downtimeStart)
+	fatalCheck(err)
+
+	go func() {
+		for {
+			// Next downtime start.
+			now := d.clock.Now().UTC()
+			start := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+			if !start.Add(-*downtimeLead).After(now) {
+				start = start.AddDate(0, 0, 1)
+			}
+
+			d.clock.Sleep(start.Add(-*downtimeLead).Sub(now))
+			fetchGate.pauseUntil(start.Add(downtimeMinimum), "daily downtime")
+			d.clock.Sleep(start.Add(downtimeMinimum).Sub(d.clock.Now()))
+
+			// Hold fetching until the cluster answers again.
+			for !clusterUp() {
+				fetchGate.pauseUntil(d.clock.Now().Add(downtimePollInterval), "cluster still down")
+				d.clock.Sleep(downtimePollInterval)
+			}
+			logs.infof("Cluster is back after downtime")
+
+			d.mu.Lock()
+			d.rescan = true
+			d.mu.Unlock()
+		}
+	}()
+}
+
+// rescanDue reports, once, that downtime has ended and a fresh pass
+// should start.
+func (d *downtimeWatcher) rescanDue() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	due := d.rescan
+	d.rescan = false
+	return due
+}
+
+// clusterUp checks whether the API is serving again. It bypasses the
+// fetch gate, which is closed while this is asked.
+func clusterUp() bool {
+	if *sourceName != "esi" {
+		req, err := newRequest("GET", crestUrl, nil)
+		if err != nil {
+			return false
+		}
+		response, err := fetchClient.Do(req)
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return response.StatusCode == 200
+	}
+
+	req, err := newRequest("GET", esiUrl+"status/?datasource="+esiDatasource, nil)
+	if err != nil {
+		return false
+	}
+	response, err := fetchClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+
+	s := struct {
+		Players int  `json:"players"`
+		VIP     bool `json:"vip"`
+	}{}
+	if response.StatusCode != 200 || json.NewDecoder(response.Body).Decode(&s) != nil {
+		return false
+	}
+	return !s.VIP
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Long-term upload endpoint statistics
+// Kept across restarts so chronically bad gateways are avoided from the
+// start and operators can see which to prune. Off unless a file is given,
+// so nothing is written to the working directory.
+var endpointStatsFile = flag.String("endpoint-stats", "", "file to keep upload endpoint statistics in across restarts, e.g. /var/lib/crestemdr/endpoint-stats.json")
+
+// How often endpoint statistics are saved.
+var endpointStatsSaveInterval = time.Minute * 5
+
+// endpointRecord is the history of posts to one endpoint URL.
+type endpointRecord struct {
+	URL       string    `json:"url"`
+	Successes int64     `json:"successes"`
+	Failures  int64     `json:"failures"`
+	Latency   duration  `json:"latency"` // moving average of successful posts
+	Updated   time.Time `json:"updated"`
+}
+
+// successRate is the fraction of posts that worked, starting from an even
+// chance so a few early results don't swing it to either extreme.
+func (r endpointRecord) successRate() float64 {
+	return float64(r.Successes+1) / float64(r.Successes+r.Failures+2)
+}
+
+var endpointRecords = struct {
+	sync.Mutex
+	m map[string]*endpointRecord
+}{m: make(map[string]*endpointRecord)}
+
+// loadEndpointStats reads the statistics saved by an earlier run.
+func loadEndpointStats() error {
+	if *endpointStatsFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(*endpointStatsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	records := []*endpointRecord{}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+
+	endpointRecords.Lock()
+	defer endpointRecords.Unlock()
+	for _, r := range records {
+		endpointRecords.m[r.URL] = r
+	}
+
+	return nil
+}
+
+// saveEndpointStats writes the statistics out.
+func saveEndpointStats() error {
+	enc, err := json.MarshalIndent(endpointList(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*endpointStatsFile+".tmp", enc, 0644); err != nil {
+		return err
+	}
+	return os.Rename(*endpointStatsFile+".tmp", *endpointStatsFile)
+}
+
+// startEndpointStats saves the statistics in the background.
+func startEndpointStats() {
+	if *endpointStatsFile == "" {
+		return
+	}
+	go func() {
+		for {
+			clk.Sleep(endpointStatsSaveInterval)
+			warnCheck(saveEndpointStats())
+		}
+	}()
+}
+
+// recordEndpoint notes the outcome of a post.
+func recordEndpoint(url string, ok bool, took time.Duration) {
+	endpointRecords.Lock()
+	defer endpointRecords.Unlock()
+
+	r, found := endpointRecords.m[url]
+	if !found {
+		r = &endpointRecord{URL: url}
+		endpointRecords.m[url] = r
+	}
+	if ok {
+		r.Successes++
+		if r.Latency.Duration == 0 {
+			r.Latency.Duration = took
+		} else {
+			r.Latency.Duration = (r.Latency.Duration*31 + took) / 32
+		}
+	} else {
+		r.Failures++
+	}
+	r.Updated = clk.Now().UTC()
+}
+
+// endpointHistory returns what is known about an endpoint, if anything.
+func endpointHistory(url string) (endpointRecord, bool) {
+	endpointRecords.Lock()
+	defer endpointRecords.Unlock()
+
+	r, ok := endpointRecords.m[url]
+	if !ok {
+		return endpointRecord{URL: url}, false
+	}
+	return *r, true
+}
+
+// endpointList is every endpoint's record, best first.
+func endpointList() []endpointRecord {
+	endpointRecords.Lock()
+	defer endpointRecords.Unlock()
+
+	list := []endpointRecord{}
+	for _, r := range endpointRecords.m {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].successRate() > list[j].successRate() })
+
+	return list
+}
+
+type endpointReport struct {
+	endpointRecord
+	SuccessRate float64 `json:"successRate"`
+}
+
+func endpointsHandler(w http.ResponseWriter, r *http.Request) {
+	report := []endpointReport{}
+	for _, e := range endpointList() {
+		report = append(report, endpointReport{e, e.successRate()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(report)
+}
+
+func init() {
+	// Upload URLs may carry credentials, so only on the admin API.
+	adminMux.HandleFunc("/admin/endpoints", endpointsHandler)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// SDE extract of solar systems: solarSystemID, regionID, security.
+// Tab delimited, like the stations file.
+var systemsFile = flag.String("systems-file", "", "tab delimited SDE extract of solarSystemID, regionID and security")
+
+// Lookups for enriched output, filled once at startup.
+var systemSecurity = make(map[int64]float64)
+var regionNames = make(map[int64]string)
+
+// loadEnrichment fills the enrichment lookups from the regions being
+// scanned and the systems file, if there is one.
+func loadEnrichment(regions []marketRegions) error {
+	for _, r := range regions {
+		regionNames[r.RegionID] = r.RegionName
+	}
+
+	if *systemsFile == "" {
+		return nil
+	}
+
+	file, err := os.Open(*systemsFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comma = '\t' // Tab delimited.
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 3 {
+			return fmt.Errorf("%s line %d: want 3 fields, got %d", *systemsFile, line, len(record))
+		}
+		systemID, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		security, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return err
+		}
+		systemSecurity[systemID] = security
+	}
+	logs.infof("Loaded %d Solar Systems", len(systemSecurity))
+
+	return nil
+}
+
+// enrichUUDIF returns a copy of a message with extra columns appended to
+// every row: the region name, and for orders the security status of the
+// order's solar system. These aren't part of UUDIF so must never be sent
+// to EMDR.
+func enrichUUDIF(m *marketUUDIF) *marketUUDIF {
+	e := *m
+	e.Columns = append(append([]string{}, m.Columns...), "regionName")
+
+	// Orders carry their solar system in the last column.
+	system := -1
+	if m.ResultType == "orders" {
+		system = len(m.Columns) - 1
+		e.Columns = append(e.Columns, "solarSystemSecurity")
+	}
+
+	e.Rowsets = make([]rowsetsUUDIF, len(m.Rowsets))
+	for i, rs := range m.Rowsets {
+		e.Rowsets[i] = rs
+		e.Rowsets[i].Rows = make([][]interface{}, len(rs.Rows))
+
+		name := regionNames[rs.RegionID]
+		for j, row := range rs.Rows {
+			r := append(append(make([]interface{}, 0, len(row)+2), row...), name)
+			if system >= 0 {
+				var security interface{}
+				if id, ok := wholeNumber(row[system]); ok {
+					if s, ok := systemSecurity[id]; ok {
+						security = s
+					}
+				}
+				r = append(r, security)
+			}
+			e.Rowsets[i].Rows[j] = r
+		}
+	}
+
+	return &e
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Regions at or above this are wormhole and abyssal space, with no market.
+const esiFirstNonMarketRegion = 11000000
+
+// Most IDs ESI will resolve to names in one call.
+const esiNamesPerCall = 1000
+
+type esiHistory struct {
+	Average    float64 `json:"average"`
+	Date       string  `json:"date"`
+	Highest    float64 `json:"highest"`
+	Lowest     float64 `json:"lowest"`
+	OrderCount int64   `json:"order_count"`
+	Volume     int64   `json:"volume"`
+}
+
+type esiOrder struct {
+	Duration     int64   `json:"duration"`
+	IsBuyOrder   bool    `json:"is_buy_order"`
+	Issued       string  `json:"issued"`
+	LocationID   int64   `json:"location_id"`
+	MinVolume    int64   `json:"min_volume"`
+	OrderID      int64   `json:"order_id"`
+	Price        float64 `json:"price"`
+	Range        string  `json:"range"`
+	SystemID     int64   `json:"system_id"`
+	TypeID       int64   `json:"type_id"`
+	VolumeRemain int64   `json:"volume_remain"`
+	VolumeTotal  int64   `json:"volume_total"`
+}
+
+// esiSource fetches market data from ESI.
+type esiSource struct{}
+
+// esiGet fetches an ESI path into result, returning the HTTP status and
+// the number of pages the resource has.
+func esiGet(path string, params url.Values, result interface{}, conditional bool) (int, int, error) {
+	return esiFetch(path, params, http.Header{}, result, conditional)
+}
+
+// esiGetAuthed is esiGet for endpoints needing EVE SSO.
+func esiGetAuthed(path string, params url.Values, result interface{}, conditional bool) (int, int, error) {
+	if sso == nil {
+		return 0, 0, fmt.Errorf("%s needs EVE SSO, see -sso-token-file", path)
+	}
+	header := http.Header{}
+	if err := sso.authorize(header); err != nil {
+		return 0, 0, err
+	}
+	return esiFetch(path, params, header, result, conditional)
+}
+
+func esiFetch(path string, params url.Values, header http.Header, result interface{}, conditional bool) (int, int, error) {
+	response, pages, err := esiStream(path, params, header, conditional, func(dec *json.Decoder) error {
+		return dec.Decode(result)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	response.keepETag()
+	return response.status, pages, nil
+}
+
+// esiOrderPages streams every page of an orders path, calling each for
+// every order, and returns the status and number of pages. Each page is
+// only passed on once it has been read in full, so a retried page isn't
+// counted twice, and the first page's ETag is only kept once every page
+// has been passed on.
+func esiOrderPages(path string, params url.Values, each func(o marketOrder)) (int, int, error) {
+	var first *marketResponse
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		p.Set("page", strconv.Itoa(page))
+
+		// All pages are cached together, so if the first hasn't changed
+		// neither has the rest of the book.
+		var items []marketOrder
+		var response *marketResponse
+		var err error
+		response, pages, err = esiStream(path, p, nil, page == 1, func(dec *json.Decoder) error {
+			items = items[:0]
+			return eachElement(dec, func() error {
+				e := esiOrder{}
+				if err := dec.Decode(&e); err != nil {
+					return err
+				}
+				items = append(items, e.marketOrder())
+				return nil
+			})
+		})
+		if err != nil {
+			return 0, pages, err
+		}
+		if response.status != 200 {
+			return response.status, pages, nil
+		}
+		if first == nil {
+			first = response
+		}
+
+		for _, o := range items {
+			each(o)
+		}
+	}
+	first.keepETag()
+
+	return 200, pages, nil
+}
+
+// esiStream streams an ESI path, returning the response and the number
+// of pages the resource has.
+func esiStream(path string, params url.Values, header http.Header, conditional bool, decode func(dec *json.Decoder) error) (*marketResponse, int, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("datasource", esiDatasource)
+
+	response, err := market.stream(esiUrl+path, params, header, conditional, decode)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pages := 1
+	if p, err := strconv.Atoi(response.header.Get("X-Pages")); err == nil {
+		pages = p
+	}
+
+	return response, pages, nil
+}
+
+// esiNames resolves IDs to names.
+func esiNames(ids []int64) (map[int64]string, error) {
+	names := make(map[int64]string)
+
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > esiNamesPerCall {
+			chunk = chunk[:esiNamesPerCall]
+		}
+		ids = ids[len(chunk):]
+
+		resolved := []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		}{}
+		err := retryPage("universe/names", func() error {
+			response, err := market.post(esiUrl+"universe/names/?datasource="+esiDatasource, chunk, &resolved)
+			if err != nil {
+				return err
+			}
+			if response.status != 200 {
+				return fmt.Errorf("status %d", response.status)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range resolved {
+			names[n.ID] = n.Name
+		}
+	}
+
+	return names, nil
+}
+
+func (esiSource) regions() ([]marketRegions, error) {
+	ids := []int64{}
+	code, _, err := esiGet("universe/regions/", nil, &ids, false)
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("universe/regions returned status %d", code)
+	}
+
+	// Skip regions that can't have a market.
+	market := []int64{}
+	for _, id := range ids {
+		if id < esiFirstNonMarketRegion {
+			market = append(market, id)
+		}
+	}
+
+	names, err := esiNames(market)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := []marketRegions{}
+	for _, id := range market {
+		regions = append(regions, marketRegions{id, names[id]})
+	}
+
+	return regions, nil
+}
+
+// Market groups fetched at once while listing types.
+const esiGroupFetchers = 8
+
+func (esiSource) types() ([]marketTypes, error) {
+	// Every type in a market group is a market type, as CREST's
+	// market/types listed.
+	groups := []int64{}
+	err := retryPage("markets/groups", func() error {
+		code, _, err := esiGet("markets/groups/", nil, &groups, false)
+		if err != nil {
+			return err
+		}
+		if code != 200 {
+			return fmt.Errorf("status %d", code)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	seen := make(map[int64]bool)
+	ids := []int64{}
+
+	work := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < esiGroupFetchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				group := struct {
+					Types []int64 `json:"types"`
+				}{}
+				path := fmt.Sprintf("markets/groups/%d/", id)
+				err := retryPage(path, func() error {
+					code, _, err := esiGet(path, nil, &group, false)
+					if err != nil {
+						return err
+					}
+					if code != 200 {
+						return fmt.Errorf("status %d", code)
+					}
+					return nil
+				})
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				for _, t := range group.Types {
+					if !seen[t] {
+						seen[t] = true
+						ids = append(ids, t)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, id := range groups {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	names, err := esiNames(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	types := []marketTypes{}
+	for _, id := range ids {
+		types = append(types, marketTypes{id, names[id]})
+	}
+
+	return types, nil
+}
+
+func (esiSource) history(regionID int64, typeID int64) (marketHistory, int, error) {
+	h := marketHistory{}
+
+	items := []esiHistory{}
+	params := url.Values{"type_id": {strconv.FormatInt(typeID, 10)}}
+	code, _, err := esiGet(fmt.Sprintf("markets/%d/history/", regionID), params, &items, true)
+	if err != nil || code != 200 {
+		return h, code, err
+	}
+
+	for _, e := range items {
+		h.Items = append(h.Items, marketHistoryItem{
+			OrderCount: e.OrderCount,
+			LowPrice:   e.Lowest,
+			HighPrice:  e.Highest,
+			AvgPrice:   e.Average,
+			Volume:     e.Volume,
+			Date:       e.Date + "T00:00:00", // Match CREST's timestamps.
+		})
+	}
+	h.TotalCount = int64(len(h.Items))
+
+	return h, code, nil
+}
+
+func (esiSource) orders(regionID int64, typeID int64, side string) (marketOrders, int, error) {
+	o := marketOrders{}
+
+	params := url.Values{
+		"order_type": {side},
+		"type_id":    {strconv.FormatInt(typeID, 10)},
+	}
+	code, pages, err := esiOrderPages(fmt.Sprintf("markets/%d/orders/", regionID), params, func(m marketOrder) {
+		o.Items = append(o.Items, m)
+	})
+	o.PageCount = int64(pages)
+	o.TotalCount = int64(len(o.Items))
+
+	return o, code, err
+}
+
+// regionOrders fetches every order in a region, both sides of every type,
+// into their books as each page arrives.
+func (esiSource) regionOrders(regionID int64) (*regionBooks, int, error) {
+	books := newRegionBooks()
+
+	params := url.Values{"order_type": {"all"}}
+	code, _, err := esiOrderPages(fmt.Sprintf("markets/%d/orders/", regionID), params, books.add)
+
+	return books, code, err
+}
+
+// marketOrder converts an ESI order to the bridge's own layout.
+func (e esiOrder) marketOrder() marketOrder {
+	m := marketOrder{
+		Buy:           e.IsBuyOrder,
+		Issued:        strings.TrimSuffix(e.Issued, "Z"), // Match CREST's timestamps.
+		Price:         e.Price,
+		VolumeEntered: e.VolumeTotal,
+		MinVolume:     e.MinVolume,
+		Volume:        e.VolumeRemain,
+		Range:         e.Range,
+		Duration:      e.Duration,
+		ID:            e.OrderID,
+		SolarSystemID: e.SystemID,
+	}
+	m.Location.ID = e.LocationID
+	m.Type.ID = e.TypeID
+
+	return m
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Experimental features
+// Off unless turned on in the config file or through the admin API.
+const (
+	featureRegionWideFetching = "region-wide-fetching"
+	featureDeltaPublishing    = "delta-publishing"
+	featureAdaptiveScheduling = "adaptive-scheduling"
+)
+
+// featureFlags gates experimental behaviour. Each flag has a default from
+// the config file which the admin API can override while running.
+type featureFlags struct {
+	mu        sync.RWMutex
+	known     map[string]string // name to description
+	defaults  map[string]bool
+	overrides map[string]bool
+}
+
+var features = &featureFlags{
+	known: map[string]string{
+		featureRegionWideFetching: "fetch whole regions' order books instead of one type at a time",
+		featureDeltaPublishing:    "only publish order books that changed since the last pass",
+		featureAdaptiveScheduling: "fetch busy markets more often than quiet ones",
+	},
+	defaults:  make(map[string]bool),
+	overrides: make(map[string]bool),
+}
+
+// configure sets the defaults from the config file.
+func (f *featureFlags) configure(defaults map[string]bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for name, on := range defaults {
+		if _, ok := f.known[name]; !ok {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+		f.defaults[name] = on
+		if on {
+			logs.infof("Feature %s enabled", name)
+		}
+	}
+	return nil
+}
+
+func (f *featureFlags) enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if on, ok := f.overrides[name]; ok {
+		return on
+	}
+	return f.defaults[name]
+}
+
+// override turns a feature on or off until it is cleared.
+func (f *featureFlags) override(name string, on bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.known[name]; !ok {
+		return fmt.Errorf("unknown feature %q", name)
+	}
+	f.overrides[name] = on
+	logs.infof("Feature %s overridden to %t", name, on)
+	return nil
+}
+
+// clear drops an override, returning the feature to its configured state.
+func (f *featureFlags) clear(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.known[name]; !ok {
+		return fmt.Errorf("unknown feature %q", name)
+	}
+	delete(f.overrides, name)
+	logs.infof("Feature %s override cleared", name)
+	return nil
+}
+
+type featureState struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+	Overridden  bool   `json:"overridden"`
+}
+
+func (f *featureFlags) list() []featureState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	list := []featureState{}
+	for name, description := range f.known {
+		s := featureState{Name: name, Description: description, Default: f.defaults[name], Enabled: f.defaults[name]}
+		if on, ok := f.overrides[name]; ok {
+			s.Enabled, s.Overridden = on, true
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
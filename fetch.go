@@ -0,0 +1,166 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Market fetch statistics
+var fetchStats = expvar.NewMap("fetch")
+
+// Pause every fetch when ESI says fewer errors than this remain in the
+// current window, rather than risk the IP being banned.
+var esiErrorFloor = flag.Int("esi-error-floor", 10, "pause fetching when ESI's remaining error budget falls to this")
+
+// Market fetch retries
+// Transient failures are retried so they don't leave a market out of a
+// whole pass. Each backoff is doubled and varied by up to the jitter
+// fraction either way so retries from many workers spread out.
+var fetchRetries = flag.Int("fetch-retries", 3, "times a failed market fetch is retried")
+var fetchBackoff = flag.Duration("fetch-backoff", time.Second, "wait before the first market fetch retry, doubling after each")
+var fetchJitter = flag.Float64("fetch-jitter", 0.5, "fraction market fetch retry waits are randomly varied by")
+
+// retryFetch runs a fetch until it succeeds, fails in a way retrying won't
+// help, or runs out of retries. fetch returns the HTTP status.
+func retryFetch(what string, fetch func() (int, error)) (int, error) {
+	backoff := *fetchBackoff
+	for attempt := 0; ; attempt++ {
+		code, err := fetch()
+		if err == nil && code < 500 {
+			return code, nil
+		}
+		if attempt >= *fetchRetries {
+			return code, err
+		}
+
+		if err != nil {
+			logs.with(logFields{"fetch": what}).err(err).debugf("Fetch failed, retrying")
+		}
+		fetchStats.Add("retried", 1)
+		clk.Sleep(jitter(backoff, *fetchJitter))
+		backoff *= 2
+	}
+}
+
+// jitter varies d randomly by up to fraction of itself either way.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return time.Duration(float64(d) * (1 + fraction*(rand.Float64()*2-1)))
+}
+
+// fetchPause holds every fetch back until a point in time.
+type fetchPause struct {
+	clock clock
+	what  string // what is held back, for logging
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+var fetchGate = &fetchPause{clock: clk, what: "fetches"}
+
+// pauseUntil holds everything back until t, unless it already is for
+// longer.
+func (p *fetchPause) pauseUntil(t time.Time, why string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t.After(p.until) {
+		logs.warnf("Pausing %s for %s: %s", p.what, t.Sub(p.clock.Now()).Truncate(time.Second), why)
+		p.until = t
+	}
+}
+
+// wait blocks while paused.
+func (p *fetchPause) wait() {
+	for {
+		p.mu.Lock()
+		left := p.until.Sub(p.clock.Now())
+		p.mu.Unlock()
+
+		if left <= 0 {
+			return
+		}
+		p.clock.Sleep(left)
+	}
+}
+
+// ETags of the last response for each market URL.
+var etags = struct {
+	sync.Mutex
+	m map[string]etagEntry
+}{m: make(map[string]etagEntry)}
+
+type etagEntry struct {
+	etag string
+	used time.Time
+}
+
+// ETags not sent for this long are for markets no longer scanned.
+var etagMaxIdle = time.Hour * 24
+
+func init() {
+	registerPruner("etags", func(now time.Time) int {
+		etags.Lock()
+		defer etags.Unlock()
+
+		n := 0
+		for key, e := range etags.m {
+			if now.Sub(e.used) > etagMaxIdle {
+				delete(etags.m, key)
+				n++
+			}
+		}
+		return n
+	})
+}
+
+// checkErrorLimit pauses fetching until ESI's error window resets when the
+// remaining error budget gets low.
+func checkErrorLimit(h http.Header) {
+	remain, err := strconv.Atoi(h.Get("X-ESI-Error-Limit-Remain"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.Atoi(h.Get("X-ESI-Error-Limit-Reset"))
+	if err != nil {
+		return
+	}
+
+	if remain <= *esiErrorFloor {
+		fetchStats.Add("errorLimitPauses", 1)
+		fetchGate.pauseUntil(fetchGate.clock.Now().Add(time.Duration(reset)*time.Second), "ESI error limit "+strconv.Itoa(remain)+" remaining")
+	}
+}
+
+// checkRetryAfter pauses fetching for as long as an unavailable API asks,
+// given either in seconds or as a date.
+func checkRetryAfter(h http.Header) {
+	until, ok := retryAfter(h, fetchGate.clock.Now())
+	if !ok {
+		return
+	}
+
+	fetchStats.Add("retryAfterPauses", 1)
+	fetchGate.pauseUntil(until, "API unavailable")
+}
+
+// retryAfter reads a Retry-After header, in seconds or as a date.
+func retryAfter(h http.Header, now time.Time) (time.Time, bool) {
+	after := h.Get("Retry-After")
+	if after == "" {
+		return time.Time{}, false
+	}
+
+	if seconds, err := strconv.Atoi(after); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if t, err := http.ParseTime(after); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
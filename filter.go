@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+// marketFilter picks which markets of which result types a sink or
+// subscriber gets. Empty sets match everything.
+type marketFilter struct {
+	resultTypes map[string]bool
+	regions     map[int64]bool
+	types       map[int64]bool
+}
+
+// apply returns the part of a message the filter lets through, or nil.
+func (f marketFilter) apply(m *marketUUDIF) *marketUUDIF {
+	if len(f.resultTypes) > 0 && !f.resultTypes[m.ResultType] {
+		return nil
+	}
+	if len(f.regions) == 0 && len(f.types) == 0 {
+		return m
+	}
+
+	rowsets := []rowsetsUUDIF{}
+	for _, rs := range m.Rowsets {
+		if (len(f.regions) == 0 || f.regions[rs.RegionID]) && (len(f.types) == 0 || f.types[rs.TypeID]) {
+			rowsets = append(rowsets, rs)
+		}
+	}
+	if len(rowsets) == 0 {
+		return nil
+	}
+	filtered := *m
+	filtered.Rowsets = rowsets
+	return &filtered
+}
+
+// filterConfig is a marketFilter as written in the configuration file.
+type filterConfig struct {
+	ResultTypes []string `json:"resultTypes"`
+	Regions     []int64  `json:"regions"`
+	Types       []int64  `json:"types"`
+}
+
+func (c *filterConfig) compile() marketFilter {
+	f := marketFilter{resultTypes: map[string]bool{}, regions: map[int64]bool{}, types: map[int64]bool{}}
+	for _, t := range c.ResultTypes {
+		f.resultTypes[t] = true
+	}
+	for _, id := range c.Regions {
+		f.regions[id] = true
+	}
+	for _, id := range c.Types {
+		f.types[id] = true
+	}
+	return f
+}
+
+func (c *filterConfig) check() error {
+	for _, t := range c.ResultTypes {
+		if t != "orders" && t != "history" {
+			return fmt.Errorf("unknown result type %q", t)
+		}
+	}
+	return nil
+}
+
+// filteredSink is a sink only handed the markets its filter lets through.
+type filteredSink struct {
+	sink
+	filter marketFilter
+}
+
+func (s *filteredSink) deliver(m *marketUUDIF) {
+	if m = s.filter.apply(m); m != nil {
+		s.sink.deliver(m)
+	}
+}
+
+// filterSink puts a filter in front of a sink, if one is configured.
+func filterSink(s sink, c *filterConfig) sink {
+	if c == nil {
+		return s
+	}
+	return &filteredSink{s, c.compile()}
+}
+
+// routed puts a queued sink's configured filter in front of it.
+func routed(s sink) sink {
+	if q, ok := s.(*queuedSink); ok {
+		return filterSink(s, q.settings.Filter)
+	}
+	return s
+}
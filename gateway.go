@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Destination reachability states
+// An uploader starts out connecting and holds messages until one of its
+// gateways answers. It goes down when every gateway has, and holds them
+// again until one answers.
+const (
+	gatewayConnecting = "connecting"
+	gatewayUp         = "up"
+	gatewayDown       = "down"
+)
+
+// Fastest a destination that isn't up is probed. The wait doubles up to
+// -endpoint-check-interval.
+var gatewayRetryMin = time.Second
+
+// Returned instead of posting while a destination is unreachable.
+var errGatewayDown = errors.New("gateway unreachable")
+
+// setStateLocked moves the destination to state, reporting the change.
+func (u *uploader) setStateLocked(state string) {
+	if state == u.state {
+		return
+	}
+
+	now := u.clock.Now()
+	switch {
+	case state == gatewayUp && u.state == gatewayConnecting:
+		logs.with(logFields{"destination": u.name}).infof("Gateway reachable")
+	case state == gatewayUp:
+		logs.with(logFields{"destination": u.name}).infof("Gateway recovered after %s", now.Sub(u.stateSince).Truncate(time.Second))
+		u.stats.Add("recoveries", 1)
+	case state == gatewayDown:
+		logs.with(logFields{"destination": u.name}).warnf("Gateway unreachable, holding messages until it is back")
+	}
+
+	u.state, u.stateSince = state, now
+	u.stateChanged.Broadcast()
+
+	if state == gatewayUp && u.spool != nil {
+		u.spool.kick()
+	}
+}
+
+// allDownLocked says whether every endpoint is out of rotation.
+func (u *uploader) allDownLocked() bool {
+	for _, e := range u.endpoints {
+		if !e.down {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *uploader) up() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state == gatewayUp
+}
+
+// waitUp blocks until the destination is reachable, or for at most
+// upWait if that is set, saying whether it is.
+func (u *uploader) waitUp() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.state == gatewayUp {
+		return true
+	}
+
+	var deadline time.Time
+	if u.upWait > 0 {
+		deadline = u.clock.Now().Add(u.upWait)
+		go func() {
+			<-u.clock.After(u.upWait)
+			u.mu.Lock()
+			u.stateChanged.Broadcast()
+			u.mu.Unlock()
+		}()
+	}
+	for u.state != gatewayUp {
+		if !deadline.IsZero() && !u.clock.Now().Before(deadline) {
+			return false
+		}
+		u.stateChanged.Wait()
+	}
+	return true
+}
+
+// reach probes the endpoints while the destination isn't up, backing off
+// between rounds. Any HTTP response at all means a gateway is reachable;
+// whether it accepts posts is for the posts to find out.
+func (u *uploader) reach() {
+	wait := gatewayRetryMin
+	for {
+		u.mu.Lock()
+		for u.state == gatewayUp {
+			u.stateChanged.Wait()
+			wait = gatewayRetryMin
+		}
+		u.mu.Unlock()
+
+		if !u.probe() {
+			u.clock.Sleep(wait)
+			if wait *= 2; wait > *endpointCheckInterval {
+				wait = *endpointCheckInterval
+			}
+		}
+	}
+}
+
+// probe tries each endpoint in turn, marking the destination up as soon as
+// one answers, and says whether one did.
+func (u *uploader) probe() bool {
+	for _, e := range u.endpoints {
+		req, err := newRequest("GET", e.url, nil)
+		if err != nil {
+			continue
+		}
+		req.Header = u.header.Clone()
+		response, err := u.client.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+
+		u.mu.Lock()
+		u.setStateLocked(gatewayUp)
+		u.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+func (u *uploader) publishState() {
+	u.stats.Set("state", expvar.Func(func() interface{} {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return u.state
+	}))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+)
+
+// State garbage collection
+// Per-market state for regions and types no longer scanned is pruned on a
+// schedule so long running bridges don't grow without bound.
+var gcInterval = flag.Duration("gc-interval", time.Hour, "how often state for markets no longer scanned is pruned")
+
+// Entries pruned, keyed by what they were pruned from.
+var gcStats = expvar.NewMap("gc")
+
+// liveMarkets is the set of regions and types currently being scanned.
+type liveMarkets struct {
+	mu      sync.RWMutex
+	regions map[int64]bool
+	types   map[int64]bool
+}
+
+var live = &liveMarkets{}
+
+// set replaces the markets being scanned.
+func (l *liveMarkets) set(regions []marketRegions, types []marketTypes) {
+	r := make(map[int64]bool)
+	for _, region := range regions {
+		r[region.RegionID] = true
+	}
+	t := make(map[int64]bool)
+	for _, typ := range types {
+		t[typ.TypeID] = true
+	}
+
+	l.mu.Lock()
+	l.regions, l.types = r, t
+	l.mu.Unlock()
+}
+
+func (l *liveMarkets) region(regionID int64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.regions == nil || l.regions[regionID]
+}
+
+func (l *liveMarkets) market(k regionKey) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.regions == nil || (l.regions[k.RegionID] && l.types[k.TypeID])
+}
+
+// A pruner drops stale entries from one piece of state and says how many
+// went.
+type pruner func(now time.Time) int
+
+var pruners = struct {
+	sync.Mutex
+	names []string
+	fns   []pruner
+}{}
+
+// registerPruner adds state to be pruned on every collection.
+func registerPruner(name string, fn pruner) {
+	pruners.Lock()
+	defer pruners.Unlock()
+	pruners.names = append(pruners.names, name)
+	pruners.fns = append(pruners.fns, fn)
+}
+
+// collect runs every pruner once.
+func collect(now time.Time) {
+	pruners.Lock()
+	defer pruners.Unlock()
+
+	for i, fn := range pruners.fns {
+		if n := fn(now); n > 0 {
+			gcStats.Add(pruners.names[i], int64(n))
+			logs.debugf("Pruned %d stale %s entries", n, pruners.names[i])
+		}
+	}
+	gcStats.Add("runs", 1)
+}
+
+// startGC collects in the background.
+func startGC() {
+	go func() {
+		for {
+			clk.Sleep(*gcInterval)
+			collect(clk.Now())
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"net"
+
+	"github.com/antihax/CrestEMDRBridge/marketpb"
+	"google.golang.org/grpc"
+)
+
+// gRPC API
+// The stream is also served over gRPC, as typed market messages one per
+// market, for consumers in other services. See marketpb/market.proto.
+var grpcAddr = flag.String("grpc-addr", "", "address to serve the gRPC streaming API on, e.g. 127.0.0.1:8091")
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *grpcAddr == "" {
+			return nil, nil
+		}
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		s := grpc.NewServer()
+		marketpb.RegisterMarketServer(s, marketServer{})
+		go func() {
+			logs.infof("Serving gRPC on %s", *grpcAddr)
+			fatalCheck(s.Serve(lis))
+		}()
+
+		// Messages reach it through the stream hub.
+		return nil, nil
+	})
+}
+
+// marketServer implements marketpb.MarketServer over the stream hub.
+type marketServer struct {
+	marketpb.UnimplementedMarketServer
+}
+
+func (marketServer) Subscribe(req *marketpb.SubscribeRequest, stream marketpb.Market_SubscribeServer) error {
+	f := (&filterConfig{ResultTypes: req.ResultTypes, Regions: req.RegionIds, Types: req.TypeIds}).compile()
+
+	sub := streams.subscribe(f)
+	defer streams.unsubscribe(sub)
+
+	for {
+		select {
+		case m := <-sub.ch:
+			for _, msg := range toMarketMessages(m) {
+				if err := stream.Send(msg); err != nil {
+					return err
+				}
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// toMarketMessages converts a UUDIF message to one message per market.
+func toMarketMessages(m *marketUUDIF) []*marketpb.MarketMessage {
+	index := make(map[string]int)
+	for i, c := range m.Columns {
+		index[c] = i
+	}
+
+	msgs := []*marketpb.MarketMessage{}
+	for _, rs := range m.Rowsets {
+		msg := &marketpb.MarketMessage{
+			ResultType:  m.ResultType,
+			RegionId:    rs.RegionID,
+			TypeId:      rs.TypeID,
+			GeneratedAt: rs.GeneratedAt.Unix(),
+		}
+		for _, row := range rs.Rows {
+			switch m.ResultType {
+			case "orders":
+				bid, _ := exprColumn("bid").eval(index, row)
+				price, _ := exprColumn("price").eval(index, row)
+				msg.Orders = append(msg.Orders, &marketpb.Order{
+					OrderId:       rowInt(index, row, "orderID"),
+					Bid:           bid == 1,
+					Price:         price,
+					VolRemaining:  rowInt(index, row, "volRemaining"),
+					VolEntered:    rowInt(index, row, "volEntered"),
+					MinVolume:     rowInt(index, row, "minVolume"),
+					Range:         int32(rowInt(index, row, "range")),
+					Issued:        rowTime(index, row, "issueDate").Unix(),
+					Duration:      int32(rowInt(index, row, "duration")),
+					StationId:     rowInt(index, row, "stationID"),
+					SolarSystemId: rowInt(index, row, "solarSystemID"),
+				})
+			case "history":
+				low, _ := exprColumn("low").eval(index, row)
+				high, _ := exprColumn("high").eval(index, row)
+				average, _ := exprColumn("average").eval(index, row)
+				msg.History = append(msg.History, &marketpb.HistoryDay{
+					Date:     rowTime(index, row, "date").Unix(),
+					Orders:   rowInt(index, row, "orders"),
+					Quantity: rowInt(index, row, "quantity"),
+					Low:      low,
+					High:     high,
+					Average:  average,
+				})
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
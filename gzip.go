@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// gzipTransport asks for compressed responses and decompresses them,
+// counting the bytes actually received. Order pages compress very well.
+type gzipTransport struct {
+	next http.RoundTripper
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests must not be modified, so send a copy.
+	r := req.Clone(req.Context())
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	response, err := t.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &countingReader{ReadCloser: response.Body}
+	response.Body = body
+	if response.Header.Get("Content-Encoding") == "gzip" {
+		z, err := gzip.NewReader(body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		response.Body = &gzipBody{Reader: z, raw: body}
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+		response.ContentLength = -1
+		response.Uncompressed = true
+	}
+
+	return response, nil
+}
+
+// countingReader adds the bytes read from a response to the fetch stats.
+type countingReader struct {
+	io.ReadCloser
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	fetchStats.Add("bytesReceived", int64(n))
+	return n, err
+}
+
+// gzipBody decompresses a response body, closing the underlying one.
+type gzipBody struct {
+	*gzip.Reader
+	raw io.Closer
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.raw.Close()
+}
+
+// compress gzips an upload at the given level.
+func compress(msg []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	z, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := z.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress reverses compress.
+func decompress(msg []byte) ([]byte, error) {
+	z, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	return ioutil.ReadAll(z)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Liveness
+// /healthz fails once the bridge looks wedged: nothing fetched for
+// -health-max-age, or messages generated but none uploaded for that long,
+// so an orchestrator can restart it. Keep it longer than downtime, during
+// which nothing is fetched.
+var healthMaxAge = flag.Duration("health-max-age", time.Hour, "how long without a fetch or upload succeeding before /healthz fails")
+
+// Startup data the bridge can't run without.
+var startupData = []string{"regions", "types", "stations"}
+
+// progressTracker records when the bridge last made progress.
+type progressTracker struct {
+	mu          sync.Mutex
+	started     time.Time
+	loaded      map[string]int
+	destination bool
+	fetched     time.Time
+	generated   time.Time
+	uploaded    time.Time
+}
+
+var progress = &progressTracker{started: clk.Now(), loaded: make(map[string]int)}
+
+// load records that some startup data loaded, and how much of it.
+func (p *progressTracker) load(what string, n int) {
+	p.mu.Lock()
+	p.loaded[what] = n
+	p.mu.Unlock()
+}
+
+// expectUploads notes that a destination is configured, so uploads are
+// expected once messages are generated.
+func (p *progressTracker) expectUploads() {
+	p.mu.Lock()
+	p.destination = true
+	p.mu.Unlock()
+}
+
+func (p *progressTracker) fetch() {
+	p.mu.Lock()
+	p.fetched = clk.Now()
+	p.mu.Unlock()
+}
+
+func (p *progressTracker) generate() {
+	p.mu.Lock()
+	p.generated = clk.Now()
+	p.mu.Unlock()
+}
+
+func (p *progressTracker) upload() {
+	p.mu.Lock()
+	p.uploaded = clk.Now()
+	p.mu.Unlock()
+}
+
+// startupLoaded reports whether every piece of startup data has loaded.
+func (p *progressTracker) startupLoaded() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, what := range startupData {
+		if _, ok := p.loaded[what]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type healthReport struct {
+	Healthy    bool             `json:"healthy"`
+	Problems   []string         `json:"problems,omitempty"`
+	Loaded     map[string]int   `json:"loaded"`
+	LastFetch  *time.Time       `json:"lastFetch"`
+	LastUpload *time.Time       `json:"lastUpload"`
+	PostQueue  int64            `json:"postQueue"`
+	Queues     map[string]int64 `json:"queues"`
+}
+
+// health reports whether the bridge is loaded and making progress.
+func (p *progressTracker) health(now time.Time) healthReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := healthReport{Loaded: make(map[string]int)}
+	for _, what := range startupData {
+		n, ok := p.loaded[what]
+		if !ok {
+			r.Problems = append(r.Problems, what+" not loaded")
+			continue
+		}
+		r.Loaded[what] = n
+	}
+
+	// Give a fresh bridge as long to get going as it may later go idle.
+	if now.Sub(p.started) > *healthMaxAge {
+		if now.Sub(p.fetched) > *healthMaxAge {
+			r.Problems = append(r.Problems, "nothing fetched for "+(*healthMaxAge).String())
+		}
+		if p.destination && p.generated.Sub(p.uploaded) > *healthMaxAge {
+			r.Problems = append(r.Problems, "nothing uploaded for "+(*healthMaxAge).String())
+		}
+	}
+	if !p.fetched.IsZero() {
+		t := p.fetched.UTC()
+		r.LastFetch = &t
+	}
+	if !p.uploaded.IsZero() {
+		t := p.uploaded.UTC()
+		r.LastUpload = &t
+	}
+
+	r.PostQueue = expvarGauge(postQueueStats, "depth")
+	r.Queues = make(map[string]int64)
+	sinkStats.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(*expvar.Map); ok {
+			r.Queues[kv.Key] = expvarGauge(m, "queued")
+		}
+	})
+
+	sort.Strings(r.Problems)
+	r.Healthy = len(r.Problems) == 0
+	return r
+}
+
+// expvarGauge reads a count or a function returning one.
+func expvarGauge(m *expvar.Map, key string) int64 {
+	switch v := m.Get(key).(type) {
+	case *expvar.Int:
+		return v.Value()
+	case expvar.Func:
+		if n, ok := v().(int); ok {
+			return int64(n)
+		}
+	}
+	return 0
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := progress.health(clk.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func init() {
+	statusMux.HandleFunc("/healthz", healthHandler)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+// Incremental history
+// Optionally, only days not uploaded before are sent, apart from the whole
+// series every so often for consumers that missed earlier messages.
+var historyNewOnly = flag.Bool("history-new-only", false, "only upload market history days not uploaded before")
+var historyFullEvery = flag.Duration("history-full-every", time.Hour*24, "how often the full history series is uploaded anyway, or 0 never to")
+
+// historyMark is how far a market's history has been uploaded.
+type historyMark struct {
+	latest string    // date of the newest day sent
+	full   time.Time // when the whole series was last sent
+}
+
+type historyMarks struct {
+	mu    sync.Mutex
+	marks map[regionKey]historyMark
+	clock clock
+}
+
+var historySent = &historyMarks{marks: make(map[regionKey]historyMark), clock: clk}
+
+// trim returns the days of h to upload for k, marking them as sent.
+func (m *historyMarks) trim(k regionKey, h marketHistory) marketHistory {
+	now := m.clock.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mark := m.marks[k]
+	full := mark.full.IsZero() || (*historyFullEvery > 0 && now.Sub(mark.full) >= *historyFullEvery)
+
+	items := h.Items
+	if !full {
+		items = nil
+		for _, e := range h.Items {
+			if e.Date > mark.latest {
+				items = append(items, e)
+			}
+		}
+	} else {
+		mark.full = now
+	}
+
+	for _, e := range items {
+		if e.Date > mark.latest {
+			mark.latest = e.Date
+		}
+	}
+	m.marks[k] = mark
+
+	h.Items = items
+	return h
+}
+
+// forget drops a market's mark, so its whole series is sent next time.
+// Used when days it marked as sent didn't get there.
+func (m *historyMarks) forget(k regionKey) {
+	m.mu.Lock()
+	delete(m.marks, k)
+	m.mu.Unlock()
+}
+
+// prune drops markets no longer being scanned.
+func (m *historyMarks) prune(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for k := range m.marks {
+		if !live.market(k) {
+			delete(m.marks, k)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerPruner("history marks", historySent.prune)
+}
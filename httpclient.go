@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTP timeouts
+// Applied to every outbound request so a hung connection can't hold up a
+// worker forever.
+var connectTimeout = flag.Duration("connect-timeout", time.Second*10, "longest wait to connect to any server")
+var readTimeout = flag.Duration("read-timeout", time.Second*30, "longest wait for a response once a request is sent")
+var requestTimeout = flag.Duration("request-timeout", time.Minute*2, "longest any HTTP request may take in total")
+
+// User-Agent
+// CCP asks third party applications to say who they are and how to get in
+// touch with whoever runs them.
+var userAgentFlag = flag.String("user-agent", "", "User-Agent sent with every request, replacing the default")
+var contactEmail = flag.String("contact", "", "operator contact email added to the User-Agent")
+
+// userAgent is what the bridge identifies itself as.
+func userAgent() string {
+	if *userAgentFlag != "" {
+		return *userAgentFlag
+	}
+	ua := generatorName + "-CrestEMDRBridge/" + generatorVersion + " (+https://github.com/antihax/CrestEMDRBridge"
+	if *contactEmail != "" {
+		ua += "; " + *contactEmail
+	}
+	return ua + ")"
+}
+
+// Every outbound request is made with this, so shutting down can abandon
+// those in flight rather than wait out their timeouts.
+var requestCtx, cancelRequests = context.WithCancel(context.Background())
+
+// newRequest makes a request cancelled on shutdown.
+func newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(requestCtx, method, url, body)
+}
+
+// HTTP client for every market API request, set up once flags are parsed.
+var fetchClient *http.Client
+
+// setupHTTP builds the market API clients.
+func setupHTTP() {
+	fetchClient = newClient(&gzipTransport{newTransport(maxGoRoutines)})
+	market = newMarketClient(fetchClient, *crestRate, *crestBurst)
+}
+
+// newTransport returns a transport with the configured timeouts, keeping
+// up to idle connections to each host open.
+func newTransport(idle int) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   *connectTimeout,
+			KeepAlive: time.Second * 30,
+		}).DialContext,
+		TLSHandshakeTimeout:   *connectTimeout,
+		ResponseHeaderTimeout: *readTimeout,
+		IdleConnTimeout:       time.Second * 90,
+		MaxIdleConnsPerHost:   idle,
+	}
+}
+
+// newClient returns a client over rt with the overall request timeout.
+func newClient(rt http.RoundTripper) *http.Client {
+	return &http.Client{Transport: &userAgentTransport{userAgent(), rt}, Timeout: *requestTimeout}
+}
+
+// userAgentTransport identifies the bridge on every request.
+type userAgentTransport struct {
+	agent string
+	next  http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests must not be modified, so send a copy.
+	r := req.Clone(req.Context())
+	r.Header.Set("User-Agent", t.agent)
+	return t.next.RoundTrip(r)
+}
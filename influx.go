@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// InfluxDB
+// Each pass writes the best bid and ask, spread and volume of every market
+// scanned as points in line protocol, for graphing prices in Grafana. The
+// URL is the full write endpoint, e.g. http://localhost:8086/write?db=market
+// or .../api/v2/write?org=eve&bucket=market with -influx-token.
+var influxURL = flag.String("influx-url", "", "InfluxDB write endpoint market prices are written to")
+var influxToken = flag.String("influx-token", "", "InfluxDB API token, if it needs one")
+var influxMeasurement = flag.String("influx-measurement", "market", "InfluxDB measurement market prices are written as")
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *influxURL == "" {
+			return nil, nil
+		}
+		return newInfluxSink(), nil
+	})
+}
+
+// marketTop is the best of each side of a market. Orders for each side
+// arrive in separate messages, so the other side's last pass is kept to
+// work out the spread.
+type marketTop struct {
+	bid, ask             float64
+	bidVolume, askVolume int64
+	hasBid, hasAsk       bool
+}
+
+// influxSink writes market tops to InfluxDB.
+type influxSink struct {
+	client *http.Client
+
+	mu   sync.Mutex
+	tops map[regionKey]*marketTop
+}
+
+func newInfluxSink() sink {
+	s := &influxSink{
+		client: newClient(newTransport(1)),
+		tops:   make(map[regionKey]*marketTop),
+	}
+	registerPruner("influx tops", s.prune)
+	return newQueuedSink("influx", s.write)
+}
+
+// write sends a point for each market in an orders message.
+func (s *influxSink) write(m *marketUUDIF) error {
+	if m.ResultType != "orders" {
+		return nil
+	}
+
+	index := make(map[string]int)
+	for i, c := range m.Columns {
+		index[c] = i
+	}
+
+	var points bytes.Buffer
+	for _, rs := range m.Rowsets {
+		// An empty book doesn't say which side it was, so can't be used.
+		if len(rs.Rows) == 0 {
+			continue
+		}
+		top := s.update(regionKey{rs.RegionID, rs.TypeID}, index, rs.Rows)
+		writePoint(&points, rs, top)
+	}
+	if points.Len() == 0 {
+		return nil
+	}
+
+	req, err := newRequest("POST", *influxURL, &points)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if *influxToken != "" {
+		req.Header.Set("Authorization", "Token "+*influxToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// update replaces one side of a market's top with the best of rows,
+// returning a copy of both sides.
+func (s *influxSink) update(k regionKey, index map[string]int, rows [][]interface{}) marketTop {
+	var best float64
+	var volume int64
+	buy, _ := exprColumn("bid").eval(index, rows[0])
+	for i, row := range rows {
+		price, ok := exprColumn("price").eval(index, row)
+		if !ok {
+			continue
+		}
+		if i == 0 || (buy == 1 && price > best) || (buy == 0 && price < best) {
+			best = price
+		}
+		if v, ok := exprColumn("volRemaining").eval(index, row); ok {
+			volume += int64(v)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	top, ok := s.tops[k]
+	if !ok {
+		top = &marketTop{}
+		s.tops[k] = top
+	}
+	if buy == 1 {
+		top.bid, top.bidVolume, top.hasBid = best, volume, true
+	} else {
+		top.ask, top.askVolume, top.hasAsk = best, volume, true
+	}
+	return *top
+}
+
+// writePoint appends a market's top in line protocol.
+func writePoint(w *bytes.Buffer, rs rowsetsUUDIF, top marketTop) {
+	fmt.Fprintf(w, "%s,regionID=%d,typeID=%d ", *influxMeasurement, rs.RegionID, rs.TypeID)
+
+	fields := []string{}
+	if top.hasBid {
+		fields = append(fields, "best_bid="+strconv.FormatFloat(top.bid, 'f', -1, 64), fmt.Sprintf("bid_volume=%di", top.bidVolume))
+	}
+	if top.hasAsk {
+		fields = append(fields, "best_ask="+strconv.FormatFloat(top.ask, 'f', -1, 64), fmt.Sprintf("ask_volume=%di", top.askVolume))
+	}
+	if top.hasBid && top.hasAsk {
+		fields = append(fields, "spread="+strconv.FormatFloat(top.ask-top.bid, 'f', -1, 64))
+	}
+	for i, f := range fields {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(f)
+	}
+
+	fmt.Fprintf(w, " %d\n", rs.GeneratedAt.UnixNano())
+}
+
+// prune drops the tops of markets no longer being scanned.
+func (s *influxSink) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for k := range s.tops {
+		if !live.market(k) {
+			delete(s.tops, k)
+			n++
+		}
+	}
+	return n
+}
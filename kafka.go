@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// Kafka
+// Publishes every message to a topic keyed by regionID, so a region's
+// markets stay in order on one partition. With -kafka-records each order
+// or history row is published as a record of its own instead.
+var kafkaBrokers = flag.String("kafka-brokers", "", "comma separated Kafka brokers to publish UUDIF messages to")
+var kafkaTopic = flag.String("kafka-topic", "market", "Kafka topic messages are published to")
+var kafkaRecords = flag.Bool("kafka-records", false, "publish a flattened record per row rather than whole UUDIF messages")
+
+func init() {
+	registerSink(newKafkaSink)
+}
+
+func newKafkaSink() (sink, error) {
+	if *kafkaBrokers == "" {
+		return nil, nil
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "CrestEMDRBridge"
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Compression = sarama.CompressionSnappy
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(strings.Split(*kafkaBrokers, ","), config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newQueuedSink("kafka", func(m *marketUUDIF) error {
+		msgs := []*sarama.ProducerMessage{}
+		for _, market := range splitMarkets(m) {
+			if len(market.Rowsets) == 0 {
+				continue
+			}
+			key := sarama.StringEncoder(strconv.FormatInt(market.Rowsets[0].RegionID, 10))
+
+			values := []interface{}{market}
+			if *kafkaRecords {
+				values = values[:0]
+				for _, r := range flattenRows(market) {
+					values = append(values, r)
+				}
+			}
+			for _, v := range values {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				msgs = append(msgs, &sarama.ProducerMessage{Topic: *kafkaTopic, Key: key, Value: sarama.ByteEncoder(b)})
+			}
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		return producer.SendMessages(msgs)
+	}), nil
+}
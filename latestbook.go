@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// bookSides is the latest rowset of each side of a market. Each side's
+// orders arrive in a message of their own.
+type bookSides struct {
+	columns   []string
+	buy, sell *rowsetsUUDIF
+}
+
+// latestBooks keeps the latest orders of both sides of every market, for
+// sinks storing whole order books.
+type latestBooks struct {
+	mu    sync.Mutex
+	books map[regionKey]*bookSides
+}
+
+func newLatestBooks(name string) *latestBooks {
+	b := &latestBooks{books: make(map[regionKey]*bookSides)}
+	registerPruner(name, b.prune)
+	return b
+}
+
+// merge records one side of a market's orders, from a message with a
+// single rowset, returning both sides as one message. An empty rowset
+// doesn't say which side it was, so is skipped.
+func (b *latestBooks) merge(m *marketUUDIF) (*marketUUDIF, bool) {
+	rs := m.Rowsets[0]
+	if len(rs.Rows) == 0 {
+		return nil, false
+	}
+	index := make(map[string]int)
+	for i, c := range m.Columns {
+		index[c] = i
+	}
+	buy, ok := exprColumn("bid").eval(index, rs.Rows[0])
+	if !ok {
+		return nil, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	k := regionKey{rs.RegionID, rs.TypeID}
+	sides, ok := b.books[k]
+	if !ok || !sameColumns(sides.columns, m.Columns) {
+		sides = &bookSides{columns: m.Columns}
+		b.books[k] = sides
+	}
+	if buy == 1 {
+		sides.buy = &rs
+	} else {
+		sides.sell = &rs
+	}
+
+	book := *m
+	both := rowsetsUUDIF{RegionID: rs.RegionID, TypeID: rs.TypeID, GeneratedAt: rs.GeneratedAt}
+	for _, side := range []*rowsetsUUDIF{sides.buy, sides.sell} {
+		if side != nil {
+			both.Rows = append(both.Rows, side.Rows...)
+		}
+	}
+	book.Rowsets = []rowsetsUUDIF{both}
+	return &book, true
+}
+
+// prune drops the order books of markets no longer being scanned.
+func (b *latestBooks) prune(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for k := range b.books {
+		if !live.market(k) {
+			delete(b.books, k)
+			n++
+		}
+	}
+	return n
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ISK volume leaderboards
+// Top types by ISK traded per region, computed from the history we fetch.
+var leaderboardSize = flag.Int("leaderboard-size", 20, "number of types on each region's ISK volume leaderboard")
+var leaderboardDays = flag.Int("leaderboard-days", 7, "days of history counted towards the ISK volume leaderboards")
+var leaderboardInterval = flag.Duration("leaderboard-interval", time.Minute*10, "how often the ISK volume leaderboards are recomputed")
+
+// leaderboard collects ISK traded per type and periodically ranks them.
+type leaderboard struct {
+	mu        sync.Mutex
+	traded    map[regionKey]leaderboardEntry
+	typeNames map[int64]string
+
+	// Last computed boards, by regionID.
+	boards   map[int64][]leaderboardEntry
+	computed time.Time
+}
+
+type leaderboardEntry struct {
+	TypeID   int64   `json:"typeID"`
+	TypeName string  `json:"typeName"`
+	ISK      float64 `json:"isk"`
+	Volume   int64   `json:"volume"`
+}
+
+var leaders = &leaderboard{
+	traded:    make(map[regionKey]leaderboardEntry),
+	typeNames: make(map[int64]string),
+	boards:    make(map[int64][]leaderboardEntry),
+}
+
+func (l *leaderboard) setTypes(types []marketTypes) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, t := range types {
+		l.typeNames[t.TypeID] = t.TypeName
+	}
+}
+
+// record totals the ISK traded over the leaderboard window from a type's
+// history.
+func (l *leaderboard) record(regionID int64, typeID int64, h marketHistory) {
+	since := clk.Now().UTC().AddDate(0, 0, -*leaderboardDays)
+
+	t := leaderboardEntry{TypeID: typeID}
+	for _, e := range h.Items {
+		date, err := time.Parse("2006-01-02T15:04:05", e.Date)
+		if err != nil || date.Before(since) {
+			continue
+		}
+		t.ISK += float64(e.Volume) * e.AvgPrice
+		t.Volume += e.Volume
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.ISK > 0 {
+		l.traded[regionKey{regionID, typeID}] = t
+	} else {
+		delete(l.traded, regionKey{regionID, typeID})
+	}
+}
+
+// compute ranks every region's types.
+func (l *leaderboard) compute() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byRegion := make(map[int64][]leaderboardEntry)
+	for k, t := range l.traded {
+		t.TypeName = l.typeNames[k.TypeID]
+		byRegion[k.RegionID] = append(byRegion[k.RegionID], t)
+	}
+
+	for regionID, entries := range byRegion {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ISK > entries[j].ISK })
+		if len(entries) > *leaderboardSize {
+			entries = entries[:*leaderboardSize]
+		}
+		byRegion[regionID] = entries
+	}
+
+	l.boards = byRegion
+	l.computed = clk.Now().UTC()
+}
+
+// start recomputes the boards in the background.
+func (l *leaderboard) start() {
+	go func() {
+		for {
+			clk.Sleep(*leaderboardInterval)
+			l.compute()
+		}
+	}()
+}
+
+type leaderboardResponse struct {
+	Computed time.Time                    `json:"computed"`
+	Days     int                          `json:"days"`
+	Regions  map[int64][]leaderboardEntry `json:"regions"`
+}
+
+// leaderboardHandler serves every region's board, or one with ?region=.
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	leaders.mu.Lock()
+	resp := leaderboardResponse{Computed: leaders.computed, Days: *leaderboardDays, Regions: leaders.boards}
+	if id := r.URL.Query().Get("region"); id != "" {
+		regionID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			leaders.mu.Unlock()
+			http.Error(w, "bad region", http.StatusBadRequest)
+			return
+		}
+		resp.Regions = map[int64][]leaderboardEntry{regionID: leaders.boards[regionID]}
+	}
+	enc, err := json.Marshal(resp)
+	leaders.mu.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(leaderboardInterval.Seconds())))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(enc)
+}
+
+func init() {
+	statusMux.HandleFunc("/public/leaderboard", leaderboardHandler)
+	registerPruner("leaderboard", leaders.prune)
+}
+
+// prune drops totals for markets no longer scanned.
+func (l *leaderboard) prune(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for k := range l.traded {
+		if !live.market(k) {
+			delete(l.traded, k)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logging
+// Each line has a level and, where it applies, fields such as the regionID
+// and typeID it is about, so errors can be picked out of thousands of
+// fetches. json writes one object per line for log shippers; console writes
+//
+//	2015-06-01T12:00:00Z WARN  fetch failed error="..." regionID=10000002
+var logLevel = flag.String("log-level", "info", "least severe log lines written: debug, info, warn or error")
+var logFormat = flag.String("log-format", "console", "log line format: console or json")
+
+// Log levels, least severe first.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logFields are the key/value pairs attached to a log line.
+type logFields map[string]interface{}
+
+// logger writes lines with its fields attached.
+type logger struct {
+	fields logFields
+}
+
+// logs is the logger with no fields, which everything else derives from.
+var logs = &logger{}
+
+// The writer and settings every logger shares.
+var logOut = struct {
+	sync.Mutex
+	w     io.Writer
+	level int
+	json  bool
+}{w: os.Stderr, level: levelInfo}
+
+// setupLogging applies -log-level and -log-format.
+func setupLogging() error {
+	level := -1
+	for i, name := range levelNames {
+		if name == *logLevel {
+			level = i
+		}
+	}
+	if level < 0 {
+		return fmt.Errorf("unknown log level %q", *logLevel)
+	}
+	if *logFormat != "console" && *logFormat != "json" {
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+
+	logOut.Lock()
+	logOut.level, logOut.json = level, *logFormat == "json"
+	logOut.Unlock()
+	return nil
+}
+
+// with returns a logger adding fields to the ones l already has.
+func (l *logger) with(fields logFields) *logger {
+	merged := make(logFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &logger{fields: merged}
+}
+
+// err returns a logger with an error field.
+func (l *logger) err(err error) *logger {
+	return l.with(logFields{"error": err.Error()})
+}
+
+func (l *logger) debugf(format string, args ...interface{}) { l.write(levelDebug, format, args) }
+func (l *logger) infof(format string, args ...interface{})  { l.write(levelInfo, format, args) }
+func (l *logger) warnf(format string, args ...interface{})  { l.write(levelWarn, format, args) }
+func (l *logger) errorf(format string, args ...interface{}) { l.write(levelError, format, args) }
+
+// fatalf logs an error and exits.
+func (l *logger) fatalf(format string, args ...interface{}) {
+	l.write(levelError, format, args)
+	os.Exit(1)
+}
+
+func (l *logger) write(level int, format string, args []interface{}) {
+	logOut.Lock()
+	defer logOut.Unlock()
+	if level < logOut.level {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	msg := fmt.Sprintf(format, args...)
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if logOut.json {
+		line := logFields{"time": now, "level": levelNames[level], "msg": msg}
+		for _, k := range keys {
+			line[k] = l.fields[k]
+		}
+		b, err := json.Marshal(line)
+		if err != nil {
+			b, _ = json.Marshal(logFields{"time": now, "level": levelNames[level], "msg": msg})
+		}
+		logOut.w.Write(append(b, '\n'))
+		return
+	}
+
+	fmt.Fprintf(logOut.w, "%s %-5s %s", now, strings.ToUpper(levelNames[level]), msg)
+	for _, k := range keys {
+		v := l.fields[k]
+		if s, ok := v.(string); ok {
+			v = strconv.Quote(s)
+		}
+		fmt.Fprintf(logOut.w, " %s=%v", k, v)
+	}
+	fmt.Fprintln(logOut.w)
+}
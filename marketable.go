@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// SDE extract of types: typeID, marketGroupID, published. Tab delimited,
+// like the stations file, with an empty marketGroupID for types outside
+// the market.
+var sdeTypesFile = flag.String("sde-types-file", "", "tab delimited SDE extract of typeID, marketGroupID and published, used to skip types that can't be traded")
+
+// Types that can have orders, filled from the SDE extract. Empty when
+// there is no extract, in which case every type is scanned.
+var marketableTypes map[int64]bool
+
+// loadMarketable reads the SDE extract if there is one.
+func loadMarketable() error {
+	if *sdeTypesFile == "" {
+		return nil
+	}
+
+	file, err := os.Open(*sdeTypesFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comma = '\t' // Tab delimited.
+
+	m := make(map[int64]bool)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 3 {
+			return fmt.Errorf("%s line %d: want 3 fields, got %d", *sdeTypesFile, line, len(record))
+		}
+		typeID, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		group, _ := strconv.ParseInt(record[1], 10, 64)
+		if group > 0 && record[2] != "0" && record[2] != "False" {
+			m[typeID] = true
+		}
+	}
+	marketableTypes = m
+	logs.infof("Loaded %d Marketable Types", len(m))
+
+	return nil
+}
+
+// filterMarketable drops types without a market group or that aren't
+// published, which can never have orders.
+func filterMarketable(types []marketTypes) []marketTypes {
+	if marketableTypes == nil {
+		return types
+	}
+
+	kept := []marketTypes{}
+	for _, t := range types {
+		if marketableTypes[t.TypeID] {
+			kept = append(kept, t)
+		}
+	}
+	if dropped := len(types) - len(kept); dropped > 0 {
+		logs.infof("Skipping %d Types that can't be traded", dropped)
+	}
+
+	return kept
+}
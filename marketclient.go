@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// marketClient fetches JSON from the market APIs. It is the one place
+// requests are rate limited, retried, made conditional and counted.
+type marketClient interface {
+	// get fetches u into result when it comes back 200. Conditional
+	// requests send the ETag of the last response for the same URL, so an
+	// unchanged resource comes back as a 304 with nothing to decode.
+	// A 200's ETag is kept straight away.
+	get(u string, params url.Values, header http.Header, result interface{}, conditional bool) (*marketResponse, error)
+
+	// stream is get for large responses, handing the decoder to decode
+	// to read as it likes while the body arrives. decode may be called
+	// again if the request is retried. A 200's ETag is only kept once
+	// keepETag is called, so a resource spread over pages isn't taken as
+	// unchanged until every page has been read.
+	stream(u string, params url.Values, header http.Header, conditional bool, decode func(dec *json.Decoder) error) (*marketResponse, error)
+
+	// post sends payload as JSON, decoding a 200 response into result.
+	post(u string, payload interface{}, result interface{}) (*marketResponse, error)
+}
+
+// marketResponse is what callers need of a response besides its body.
+type marketResponse struct {
+	status int
+	header http.Header
+
+	// URL the ETag is kept for, if the request was conditional.
+	etagKey string
+}
+
+// keepETag remembers a 200's ETag for the next conditional request.
+func (r *marketResponse) keepETag() {
+	etag := r.header.Get("ETag")
+	if r.status != 200 || r.etagKey == "" || etag == "" {
+		return
+	}
+	etags.Lock()
+	etags.m[r.etagKey] = etagEntry{etag, clk.Now()}
+	etags.Unlock()
+}
+
+// Client every market API request goes through, set up once flags are
+// parsed.
+var market marketClient
+
+// httpMarketClient is a marketClient over net/http.
+type httpMarketClient struct {
+	client  *http.Client
+	limiter *tokenBucket
+	control *rateController // nil when the rate is fixed
+}
+
+func newMarketClient(client *http.Client, rate float64, burst int) *httpMarketClient {
+	c := &httpMarketClient{client: client, limiter: newTokenBucket(rate, burst)}
+	if *adaptiveRate {
+		c.control = newRateController(c.limiter, rate, *rateFloor, *latencyTarget)
+		c.control.start()
+	}
+	fetchStats.Set("rate", expvar.Func(func() interface{} { return c.limiter.currentRate() }))
+
+	return c
+}
+
+func (c *httpMarketClient) get(u string, params url.Values, header http.Header, result interface{}, conditional bool) (*marketResponse, error) {
+	response, err := c.stream(u, params, header, conditional, func(dec *json.Decoder) error {
+		return dec.Decode(result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.keepETag()
+	return response, nil
+}
+
+func (c *httpMarketClient) stream(u string, params url.Values, header http.Header, conditional bool, decode func(dec *json.Decoder) error) (*marketResponse, error) {
+	if len(params) > 0 {
+		if strings.Contains(u, "?") {
+			u += "&" + params.Encode()
+		} else {
+			u += "?" + params.Encode()
+		}
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	if conditional {
+		etags.Lock()
+		if e, ok := etags.m[u]; ok {
+			header.Set("If-None-Match", e.etag)
+			e.used = clk.Now()
+			etags.m[u] = e
+		}
+		etags.Unlock()
+	}
+
+	var response *marketResponse
+	_, err := retryFetch(u, func() (int, error) {
+		req, err := newRequest("GET", u, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header = header.Clone()
+
+		response, err = c.do(req, decode)
+		if err != nil {
+			return 0, err
+		}
+
+		if conditional {
+			response.etagKey = u
+		}
+		return response.status, nil
+	})
+
+	return response, err
+}
+
+func (c *httpMarketClient) post(u string, payload interface{}, result interface{}) (*marketResponse, error) {
+	enc, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var response *marketResponse
+	_, err = retryFetch(u, func() (int, error) {
+		req, err := newRequest("POST", u, bytes.NewReader(enc))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		response, err = c.do(req, func(dec *json.Decoder) error {
+			return dec.Decode(result)
+		})
+		if err != nil {
+			return 0, err
+		}
+		return response.status, nil
+	})
+
+	return response, err
+}
+
+// do sends one request once fetching isn't paused and the rate limit
+// allows, decoding a 200 response straight off the wire, counting the
+// outcome and pausing on the API's say so.
+func (c *httpMarketClient) do(req *http.Request, decode func(dec *json.Decoder) error) (*marketResponse, error) {
+	fetchGate.wait()
+	c.limiter.wait()
+
+	start := clk.Now()
+	response, err := c.client.Do(req)
+	if err != nil {
+		fetchStats.Add("errors", 1)
+		c.observe(false, clk.Now().Sub(start))
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == 200 {
+		if err := decode(json.NewDecoder(response.Body)); err != nil {
+			fetchStats.Add("errors", 1)
+			return nil, err
+		}
+	}
+	// Drain so the connection is reused.
+	io.Copy(ioutil.Discard, response.Body)
+
+	c.observe(response.StatusCode < 500 && response.StatusCode != 420 && response.StatusCode != 429, clk.Now().Sub(start))
+
+	checkErrorLimit(response.Header)
+	if response.StatusCode == 503 {
+		checkRetryAfter(response.Header)
+	}
+
+	switch response.StatusCode {
+	case 200:
+		fetchStats.Add("ok", 1)
+		progress.fetch()
+	case 304:
+		fetchStats.Add("notModified", 1)
+		progress.fetch()
+	default:
+		fetchStats.Add("status"+strconv.Itoa(response.StatusCode), 1)
+	}
+
+	return &marketResponse{status: response.StatusCode, header: response.Header}, nil
+}
+
+// eachElement decodes a JSON array one element at a time, calling fn to
+// decode each, so the whole array is never held in memory at once.
+func eachElement(dec *json.Decoder, fn func() error) error {
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// observe feeds a request's outcome to the rate controller, if any.
+func (c *httpMarketClient) observe(ok bool, took time.Duration) {
+	if c.control != nil {
+		c.control.observe(ok, took)
+	}
+}
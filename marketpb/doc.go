@@ -0,0 +1,5 @@
+// Package marketpb is the protobuf schema and gRPC service the bridge
+// streams market data with.
+package marketpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative market.proto
@@ -0,0 +1,86 @@
+// Stand-in for the protoc-gen-go output for market.proto, written by hand
+// where protoc wasn't available. Run go generate to replace it, and this
+// file's market_grpc.pb.go counterpart, with the real thing.
+
+package marketpb
+
+import proto "github.com/golang/protobuf/proto"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+
+type SubscribeRequest struct {
+	ResultTypes []string `protobuf:"bytes,1,rep,name=result_types" json:"result_types,omitempty"`
+	RegionIds   []int64  `protobuf:"varint,2,rep,name=region_ids" json:"region_ids,omitempty"`
+	TypeIds     []int64  `protobuf:"varint,3,rep,name=type_ids" json:"type_ids,omitempty"`
+}
+
+func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
+func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscribeRequest) ProtoMessage()    {}
+
+// MarketMessage is one market's orders or history.
+type MarketMessage struct {
+	ResultType  string        `protobuf:"bytes,1,opt,name=result_type" json:"result_type,omitempty"`
+	RegionId    int64         `protobuf:"varint,2,opt,name=region_id" json:"region_id,omitempty"`
+	TypeId      int64         `protobuf:"varint,3,opt,name=type_id" json:"type_id,omitempty"`
+	GeneratedAt int64         `protobuf:"varint,4,opt,name=generated_at" json:"generated_at,omitempty"`
+	Orders      []*Order      `protobuf:"bytes,5,rep,name=orders" json:"orders,omitempty"`
+	History     []*HistoryDay `protobuf:"bytes,6,rep,name=history" json:"history,omitempty"`
+}
+
+func (m *MarketMessage) Reset()         { *m = MarketMessage{} }
+func (m *MarketMessage) String() string { return proto.CompactTextString(m) }
+func (*MarketMessage) ProtoMessage()    {}
+
+func (m *MarketMessage) GetOrders() []*Order {
+	if m != nil {
+		return m.Orders
+	}
+	return nil
+}
+
+func (m *MarketMessage) GetHistory() []*HistoryDay {
+	if m != nil {
+		return m.History
+	}
+	return nil
+}
+
+type Order struct {
+	OrderId       int64   `protobuf:"varint,1,opt,name=order_id" json:"order_id,omitempty"`
+	Bid           bool    `protobuf:"varint,2,opt,name=bid" json:"bid,omitempty"`
+	Price         float64 `protobuf:"fixed64,3,opt,name=price" json:"price,omitempty"`
+	VolRemaining  int64   `protobuf:"varint,4,opt,name=vol_remaining" json:"vol_remaining,omitempty"`
+	VolEntered    int64   `protobuf:"varint,5,opt,name=vol_entered" json:"vol_entered,omitempty"`
+	MinVolume     int64   `protobuf:"varint,6,opt,name=min_volume" json:"min_volume,omitempty"`
+	Range         int32   `protobuf:"varint,7,opt,name=range" json:"range,omitempty"`
+	Issued        int64   `protobuf:"varint,8,opt,name=issued" json:"issued,omitempty"`
+	Duration      int32   `protobuf:"varint,9,opt,name=duration" json:"duration,omitempty"`
+	StationId     int64   `protobuf:"varint,10,opt,name=station_id" json:"station_id,omitempty"`
+	SolarSystemId int64   `protobuf:"varint,11,opt,name=solar_system_id" json:"solar_system_id,omitempty"`
+}
+
+func (m *Order) Reset()         { *m = Order{} }
+func (m *Order) String() string { return proto.CompactTextString(m) }
+func (*Order) ProtoMessage()    {}
+
+type HistoryDay struct {
+	Date     int64   `protobuf:"varint,1,opt,name=date" json:"date,omitempty"`
+	Orders   int64   `protobuf:"varint,2,opt,name=orders" json:"orders,omitempty"`
+	Quantity int64   `protobuf:"varint,3,opt,name=quantity" json:"quantity,omitempty"`
+	Low      float64 `protobuf:"fixed64,4,opt,name=low" json:"low,omitempty"`
+	High     float64 `protobuf:"fixed64,5,opt,name=high" json:"high,omitempty"`
+	Average  float64 `protobuf:"fixed64,6,opt,name=average" json:"average,omitempty"`
+}
+
+func (m *HistoryDay) Reset()         { *m = HistoryDay{} }
+func (m *HistoryDay) String() string { return proto.CompactTextString(m) }
+func (*HistoryDay) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*SubscribeRequest)(nil), "marketpb.SubscribeRequest")
+	proto.RegisterType((*MarketMessage)(nil), "marketpb.MarketMessage")
+	proto.RegisterType((*Order)(nil), "marketpb.Order")
+	proto.RegisterType((*HistoryDay)(nil), "marketpb.HistoryDay")
+}
@@ -0,0 +1,121 @@
+// Stand-in for the protoc-gen-go-grpc output for market.proto, written by
+// hand where protoc wasn't available. Run go generate to replace it, and
+// market.pb.go, with the real thing.
+
+package marketpb
+
+import (
+	context "context"
+	errors "errors"
+
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Client API for Market service
+
+type MarketClient interface {
+	// Subscribe streams every market generated from now on that matches
+	// the request. Empty lists match everything.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Market_SubscribeClient, error)
+}
+
+type marketClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewMarketClient(cc *grpc.ClientConn) MarketClient {
+	return &marketClient{cc}
+}
+
+func (c *marketClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Market_SubscribeClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Market_serviceDesc.Streams[0], c.cc, "/marketpb.Market/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &marketSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Market_SubscribeClient interface {
+	Recv() (*MarketMessage, error)
+	grpc.ClientStream
+}
+
+type marketSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *marketSubscribeClient) Recv() (*MarketMessage, error) {
+	m := new(MarketMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Market service
+
+type MarketServer interface {
+	// Subscribe streams every market generated from now on that matches
+	// the request. Empty lists match everything.
+	Subscribe(*SubscribeRequest, Market_SubscribeServer) error
+	mustEmbedUnimplementedMarketServer()
+}
+
+// UnimplementedMarketServer must be embedded by implementations, so
+// methods added to the service later don't break them.
+type UnimplementedMarketServer struct{}
+
+func (UnimplementedMarketServer) Subscribe(*SubscribeRequest, Market_SubscribeServer) error {
+	return errors.New("method Subscribe not implemented")
+}
+func (UnimplementedMarketServer) mustEmbedUnimplementedMarketServer() {}
+
+func RegisterMarketServer(s *grpc.Server, srv MarketServer) {
+	s.RegisterService(&_Market_serviceDesc, srv)
+}
+
+func _Market_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MarketServer).Subscribe(m, &marketSubscribeServer{stream})
+}
+
+type Market_SubscribeServer interface {
+	Send(*MarketMessage) error
+	grpc.ServerStream
+}
+
+type marketSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *marketSubscribeServer) Send(m *MarketMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Market_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "marketpb.Market",
+	HandlerType: (*MarketServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Market_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "market.proto",
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS
+// Publishes every market on its own subject, <prefix>.<resultType>.<regionID>,
+// so subscribers can pick what they want with wildcards. With -nats-stream
+// messages are published through JetStream into that stream, created over
+// <prefix>.> if it doesn't exist, so they are kept for later consumers.
+var natsURL = flag.String("nats-url", "", "NATS server to publish UUDIF messages to")
+var natsSubject = flag.String("nats-subject", "market", "prefix of the NATS subjects messages are published on")
+var natsStream = flag.String("nats-stream", "", "JetStream stream to persist messages in, or empty for plain publishing")
+
+func init() {
+	registerSink(newNATSSink)
+}
+
+func newNATSSink() (sink, error) {
+	if *natsURL == "" {
+		return nil, nil
+	}
+
+	nc, err := nats.Connect(*natsURL, nats.Name("CrestEMDRBridge"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	publish := nc.Publish
+	if *natsStream != "" {
+		js, err := nc.JetStream()
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if _, err := js.StreamInfo(*natsStream); err == nats.ErrStreamNotFound {
+			_, err = js.AddStream(&nats.StreamConfig{Name: *natsStream, Subjects: []string{*natsSubject + ".>"}})
+			if err != nil {
+				nc.Close()
+				return nil, err
+			}
+		} else if err != nil {
+			nc.Close()
+			return nil, err
+		}
+
+		// Waits for the stream to acknowledge each message.
+		publish = func(subject string, b []byte) error {
+			_, err := js.Publish(subject, b)
+			return err
+		}
+	}
+
+	return newQueuedSink("nats", func(m *marketUUDIF) error {
+		for _, market := range splitMarkets(m) {
+			if len(market.Rowsets) == 0 {
+				continue
+			}
+			b, err := json.Marshal(market)
+			if err != nil {
+				return err
+			}
+			subject := fmt.Sprintf("%s.%s.%d", *natsSubject, market.ResultType, market.Rowsets[0].RegionID)
+			if err := publish(subject, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Order changes seen between passes, with delta publishing enabled.
+var deltaStats = expvar.NewMap("delta")
+
+// orderState is what of an order is compared between passes.
+type orderState struct {
+	price  float64
+	volume int64
+}
+
+// orderDiff is how an order book changed since the last pass.
+type orderDiff struct {
+	added, changed, removed int
+	first                   bool // not seen before
+}
+
+func (d orderDiff) any() bool {
+	return d.first || d.added+d.changed+d.removed > 0
+}
+
+// orderBooks keeps the last pass's orders for each side of each market.
+type orderBooks struct {
+	mu    sync.Mutex
+	books map[snapshotKey]map[int64]orderState
+}
+
+var books = &orderBooks{books: make(map[snapshotKey]map[int64]orderState)}
+
+// diff compares orders with the last pass's, replacing them.
+func (b *orderBooks) diff(k snapshotKey, orders []marketOrder) orderDiff {
+	next := make(map[int64]orderState, len(orders))
+	for _, o := range orders {
+		next[o.ID] = orderState{o.Price, o.Volume}
+	}
+
+	b.mu.Lock()
+	last, ok := b.books[k]
+	b.books[k] = next
+	b.mu.Unlock()
+
+	d := orderDiff{first: !ok}
+	for id, s := range next {
+		if was, ok := last[id]; !ok {
+			d.added++
+		} else if was != s {
+			d.changed++
+		}
+	}
+	for id := range last {
+		if _, ok := next[id]; !ok {
+			d.removed++
+		}
+	}
+
+	deltaStats.Add("added", int64(d.added))
+	deltaStats.Add("changed", int64(d.changed))
+	deltaStats.Add("removed", int64(d.removed))
+	return d
+}
+
+// forget drops the orders kept for both sides of a market, so the next
+// pass publishes it whether or not it changed.
+func (b *orderBooks) forget(k regionKey) {
+	b.mu.Lock()
+	delete(b.books, snapshotKey{k, 0})
+	delete(b.books, snapshotKey{k, 1})
+	b.mu.Unlock()
+}
+
+// prune drops order books no longer being scanned.
+func (b *orderBooks) prune(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for k := range b.books {
+		if !live.market(k.regionKey) {
+			delete(b.books, k)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerPruner("order books", books.prune)
+}
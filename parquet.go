@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Parquet
+// Order and history rows are buffered and written out as Parquet files
+// partitioned the way Spark, DuckDB and pandas expect:
+//
+//	<dir>/resultType=orders/date=2006-01-02/regionID=10000002/part-<n>.parquet
+//
+// Parquet files can't be appended to, so each flush adds a part to each
+// partition it has rows for.
+var parquetDir = flag.String("parquet-dir", "", "directory order and history rows are written to as Parquet files")
+var parquetFlushInterval = flag.Duration("parquet-flush-interval", time.Minute*10, "how often buffered rows are written out as Parquet")
+var parquetFlushRows = flag.Int("parquet-flush-rows", 500000, "buffered rows that cause an early Parquet flush")
+
+// Goroutines each file is encoded with.
+var parquetParallel int64 = 2
+
+// parquetOrder is an orders row as written.
+type parquetOrder struct {
+	GeneratedAt     int64   `parquet:"name=generated_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	RegionID        int64   `parquet:"name=region_id, type=INT64"`
+	TypeID          int64   `parquet:"name=type_id, type=INT64"`
+	OrderID         int64   `parquet:"name=order_id, type=INT64"`
+	IsBuy           bool    `parquet:"name=is_buy, type=BOOLEAN"`
+	Price           float64 `parquet:"name=price, type=DOUBLE"`
+	VolumeRemaining int64   `parquet:"name=volume_remaining, type=INT64"`
+	VolumeEntered   int64   `parquet:"name=volume_entered, type=INT64"`
+	MinVolume       int64   `parquet:"name=min_volume, type=INT64"`
+	Range           int32   `parquet:"name=order_range, type=INT32"`
+	Issued          int64   `parquet:"name=issued, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Duration        int32   `parquet:"name=duration, type=INT32"`
+	StationID       int64   `parquet:"name=station_id, type=INT64"`
+	SolarSystemID   int64   `parquet:"name=solar_system_id, type=INT64"`
+}
+
+// parquetHistory is a history row as written.
+type parquetHistory struct {
+	GeneratedAt int64   `parquet:"name=generated_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	RegionID    int64   `parquet:"name=region_id, type=INT64"`
+	TypeID      int64   `parquet:"name=type_id, type=INT64"`
+	Date        int32   `parquet:"name=date, type=INT32, convertedtype=DATE"`
+	Orders      int64   `parquet:"name=orders, type=INT64"`
+	Quantity    int64   `parquet:"name=quantity, type=INT64"`
+	Low         float64 `parquet:"name=low, type=DOUBLE"`
+	High        float64 `parquet:"name=high, type=DOUBLE"`
+	Average     float64 `parquet:"name=average, type=DOUBLE"`
+}
+
+// parquetPartition is where a row is written.
+type parquetPartition struct {
+	resultType string
+	date       string
+	regionID   int64
+}
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *parquetDir == "" {
+			return nil, nil
+		}
+		if err := os.MkdirAll(*parquetDir, 0755); err != nil {
+			return nil, err
+		}
+		return newParquetSink(*parquetDir), nil
+	})
+}
+
+// parquetSink buffers rows by partition until they are flushed.
+type parquetSink struct {
+	dir string
+
+	mu    sync.Mutex
+	rows  map[parquetPartition][]interface{}
+	count int
+	seq   int64
+}
+
+func newParquetSink(dir string) sink {
+	s := &parquetSink{dir: dir, rows: make(map[parquetPartition][]interface{})}
+
+	go func() {
+		for {
+			clk.Sleep(*parquetFlushInterval)
+			if err := s.flush(); err != nil {
+				logs.with(logFields{"sink": "parquet"}).err(err).errorf("Flush failed")
+			}
+		}
+	}()
+
+	return newQueuedSink("parquet", s.write)
+}
+
+// write buffers a message's rows, flushing if there are enough.
+func (s *parquetSink) write(m *marketUUDIF) error {
+	index := make(map[string]int)
+	for i, c := range m.Columns {
+		index[c] = i
+	}
+
+	s.mu.Lock()
+	for _, rs := range m.Rowsets {
+		p := parquetPartition{m.ResultType, rs.GeneratedAt.UTC().Format("2006-01-02"), rs.RegionID}
+		for _, row := range rs.Rows {
+			var r interface{}
+			switch m.ResultType {
+			case "orders":
+				r = newParquetOrder(rs, index, row)
+			case "history":
+				r = newParquetHistory(rs, index, row)
+			default:
+				continue
+			}
+			s.rows[p] = append(s.rows[p], r)
+			s.count++
+		}
+	}
+	full := s.count >= *parquetFlushRows
+	s.mu.Unlock()
+
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush writes each partition's buffered rows to a new part.
+func (s *parquetSink) flush() error {
+	s.mu.Lock()
+	rows := s.rows
+	s.rows = make(map[parquetPartition][]interface{})
+	s.count = 0
+	s.mu.Unlock()
+
+	var first error
+	for p, r := range rows {
+		if err := s.writePart(p, r); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// writePart writes rows to a new file in their partition. It is written
+// aside and renamed so readers never see half a file.
+func (s *parquetSink) writePart(p parquetPartition, rows []interface{}) error {
+	dir := filepath.Join(s.dir, "resultType="+p.resultType, "date="+p.date, fmt.Sprintf("regionID=%d", p.regionID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.seq++
+	name := filepath.Join(dir, fmt.Sprintf("part-%d-%06d.parquet", clk.Now().UnixNano(), s.seq%1000000))
+	s.mu.Unlock()
+
+	f, err := local.NewLocalFileWriter(name + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	var schema interface{} = new(parquetOrder)
+	if p.resultType == "history" {
+		schema = new(parquetHistory)
+	}
+	w, err := writer.NewParquetWriter(f, schema, parquetParallel)
+	if err == nil {
+		for _, r := range rows {
+			if err = w.Write(r); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.WriteStop()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+
+	return os.Rename(name+".tmp", name)
+}
+
+func newParquetOrder(rs rowsetsUUDIF, index map[string]int, row []interface{}) parquetOrder {
+	bid, _ := exprColumn("bid").eval(index, row)
+	price, _ := exprColumn("price").eval(index, row)
+	return parquetOrder{
+		GeneratedAt:     rs.GeneratedAt.UnixNano() / int64(time.Millisecond),
+		RegionID:        rs.RegionID,
+		TypeID:          rs.TypeID,
+		OrderID:         rowInt(index, row, "orderID"),
+		IsBuy:           bid == 1,
+		Price:           price,
+		VolumeRemaining: rowInt(index, row, "volRemaining"),
+		VolumeEntered:   rowInt(index, row, "volEntered"),
+		MinVolume:       rowInt(index, row, "minVolume"),
+		Range:           int32(rowInt(index, row, "range")),
+		Issued:          rowTime(index, row, "issueDate").UnixNano() / int64(time.Millisecond),
+		Duration:        int32(rowInt(index, row, "duration")),
+		StationID:       rowInt(index, row, "stationID"),
+		SolarSystemID:   rowInt(index, row, "solarSystemID"),
+	}
+}
+
+func newParquetHistory(rs rowsetsUUDIF, index map[string]int, row []interface{}) parquetHistory {
+	low, _ := exprColumn("low").eval(index, row)
+	high, _ := exprColumn("high").eval(index, row)
+	average, _ := exprColumn("average").eval(index, row)
+	return parquetHistory{
+		GeneratedAt: rs.GeneratedAt.UnixNano() / int64(time.Millisecond),
+		RegionID:    rs.RegionID,
+		TypeID:      rs.TypeID,
+		Date:        int32(rowTime(index, row, "date").Unix() / 86400),
+		Orders:      rowInt(index, row, "orders"),
+		Quantity:    rowInt(index, row, "quantity"),
+		Low:         low,
+		High:        high,
+		Average:     average,
+	}
+}
+
+// rowInt is a whole number column of a row, or 0 if it hasn't one.
+func rowInt(index map[string]int, row []interface{}, column string) int64 {
+	switch v := rowField(index, row, column).(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	f, _ := exprColumn(column).eval(index, row)
+	return int64(f)
+}
+
+// rowTime is a timestamp column of a row, or the zero time if it hasn't
+// one.
+func rowTime(index map[string]int, row []interface{}, column string) time.Time {
+	t, _ := sqlValue(rowField(index, row, column)).(time.Time)
+	return t
+}
+
+func rowField(index map[string]int, row []interface{}, column string) interface{} {
+	i, ok := index[column]
+	if !ok || i >= len(row) {
+		return nil
+	}
+	return row[i]
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"sync/atomic"
+)
+
+// Backpressure gauges: goroutines, fetches and posters in flight against
+// their limits, and posters blocked handing messages to the post queue,
+// whose own depth is postQueue.depth. These climbing together is the
+// bridge falling behind.
+var pipelineStats = expvar.NewMap("pipeline")
+
+// Posters waiting to hand over a message.
+var postersWaiting int64
+
+func init() {
+	pipelineStats.Set("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	pipelineStats.Set("postersWaiting", expvar.Func(func() interface{} { return atomic.LoadInt64(&postersWaiting) }))
+}
+
+// publishPipeline exports how full each semaphore is.
+func publishPipeline(sem, historySem, ordersSem chan bool) {
+	for name, ch := range map[string]chan bool{"posters": sem, "historyFetches": historySem, "orderFetches": ordersSem} {
+		ch := ch
+		pipelineStats.Set(name, expvar.Func(func() interface{} { return len(ch) }))
+		pipelineStats.Set(name+"Max", expvar.Func(func() interface{} { return cap(ch) }))
+	}
+}
+
+// post hands a message to the post queue, counting the wait.
+func post(postChan chan *marketUUDIF, m *marketUUDIF) {
+	atomic.AddInt64(&postersWaiting, 1)
+	postChan <- m
+	atomic.AddInt64(&postersWaiting, -1)
+}
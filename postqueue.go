@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// Generated message queue
+// Messages wait here between being generated and being handed to the
+// sinks. When it is full, generating either blocks, makes room by dropping
+// the oldest message, or spills messages to disk under -spool-dir.
+var postQueueSize = flag.Int("post-queue", 1000, "most generated messages waiting for the sinks")
+var postOverflow = flag.String("post-overflow", overflowBlock, "what to do when the post queue is full: block, drop-oldest or spill")
+
+// Overflow policies
+const (
+	overflowBlock      = "block"
+	overflowDropOldest = "drop-oldest"
+	overflowSpill      = "spill"
+)
+
+// Queue counters and depth.
+var postQueueStats = expvar.NewMap("postQueue")
+
+// Returned when unspilling finds the queue full again.
+var errQueueFull = errors.New("queue full")
+
+// postQueue is a bounded queue of generated messages.
+type postQueue struct {
+	max    int
+	policy string
+	spill  *spool // only for the spill policy
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   []*marketUUDIF
+	spilled int // messages written to spill, roughly
+}
+
+func newPostQueue(max int, policy string) (*postQueue, error) {
+	q := &postQueue{max: max, policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	if q.max < 1 {
+		q.max = 1
+	}
+
+	switch policy {
+	case overflowBlock, overflowDropOldest:
+	case overflowSpill:
+		if *spoolDir == "" {
+			return nil, fmt.Errorf("the %s overflow policy needs -spool-dir", policy)
+		}
+		var err error
+		q.spill, err = newSpool("post queue", filepath.Join(*spoolDir, "post-queue"), postQueueStats)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", policy)
+	}
+
+	postQueueStats.Set("depth", expvar.Func(func() interface{} { return q.depth() }))
+	return q, nil
+}
+
+// start moves messages from in, through the queue, to out.
+func (q *postQueue) start(in <-chan *marketUUDIF, out chan<- *marketUUDIF) {
+	go func() {
+		for m := range in {
+			q.push(m)
+		}
+	}()
+	go func() {
+		for {
+			out <- q.pop()
+		}
+	}()
+}
+
+func (q *postQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// push queues a message, applying the overflow policy if it is full.
+func (q *postQueue) push(m *marketUUDIF) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Behind anything already spilled, so an older snapshot of a market
+	// is never sent after a newer one.
+	if q.policy == overflowSpill && q.spilled > 0 {
+		q.spillLocked(m)
+		return
+	}
+
+	for len(q.items) >= q.max {
+		switch q.policy {
+		case overflowDropOldest:
+			forgetSent(q.items[0])
+			q.items[0] = nil
+			q.items = q.items[1:]
+			postQueueStats.Add("dropped", 1)
+
+		case overflowSpill:
+			q.spillLocked(m)
+			return
+
+		default:
+			q.cond.Wait()
+		}
+	}
+
+	q.items = append(q.items, m)
+	q.cond.Broadcast()
+}
+
+// spillLocked writes a message to the spill.
+func (q *postQueue) spillLocked(m *marketUUDIF) {
+	b, err := json.Marshal(m)
+	if err == nil {
+		err = q.spill.put(b, false)
+	}
+	if err != nil {
+		logs.err(err).errorf("Post queue failed")
+		postQueueStats.Add("dropped", 1)
+		forgetSent(m)
+		return
+	}
+	q.spilled++
+	q.cond.Broadcast()
+}
+
+// pop takes the oldest message, waiting for one if need be. Spilled
+// messages are brought back once the queue has emptied, and until they all
+// have been new messages are spilled after them.
+func (q *postQueue) pop() *marketUUDIF {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 {
+		if q.spilled > 0 {
+			q.mu.Unlock()
+			err := q.spill.replay(q.unspill)
+			q.mu.Lock()
+			if err == nil {
+				// Messages may have been spilled during the replay,
+				// and some aged out or were trimmed.
+				if n, err := q.spill.pending(); err == nil {
+					q.spilled = n
+				}
+			}
+			if len(q.items) > 0 {
+				break
+			}
+		}
+		q.cond.Wait()
+	}
+
+	m := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.cond.Broadcast()
+	return m
+}
+
+// unspill puts a spilled message back on the queue while there is room.
+func (q *postQueue) unspill(msg []byte, gzipped bool) error {
+	m, err := decodeUUDIF(msg)
+	if err != nil {
+		logs.err(err).errorf("Post queue failed")
+		return nil // Skip it.
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) >= (q.max+1)/2 {
+		return errQueueFull
+	}
+	q.items = append(q.items, m)
+	q.spilled--
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPostQueueSpillKeepsRowTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(was string) { *spoolDir = was }(*spoolDir)
+	*spoolDir = dir
+
+	q, err := newPostQueue(1, overflowSpill)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := marketOrder{Issued: "2015-06-01T12:00:00", Price: 5, VolumeEntered: 10, Volume: 10, Range: "5", Duration: 90, ID: 4242, SolarSystemID: 30000142}
+	o.Location.ID = 1021354646733
+	first := newOrdersUUDIF(marketOrders{Items: []marketOrder{o}}, 10000002, 34)
+	second := newOrdersUUDIF(marketOrders{Items: []marketOrder{o}}, 10000002, 35)
+
+	q.push(&first)
+	q.push(&second) // Spilled, as the queue is full.
+	q.pop()
+	back := q.pop()
+
+	if back.Rowsets[0].TypeID != 35 {
+		t.Fatalf("popped type %d, want the spilled 35", back.Rowsets[0].TypeID)
+	}
+	want, got := second.Rowsets[0].Rows[0], back.Rowsets[0].Rows[0]
+	for i := range want {
+		if reflect.TypeOf(got[i]) != reflect.TypeOf(want[i]) || got[i] != want[i] {
+			t.Errorf("%s came back as %T %v, want %T %v", second.Columns[i], got[i], got[i], want[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Profiling
+// Serves net/http/pprof for looking into goroutine pileups and memory on a
+// live bridge, e.g. go tool pprof http://127.0.0.1:6060/debug/pprof/heap.
+// Only loopback addresses are allowed, as profiles give a lot away and
+// aren't authenticated.
+var pprofAddr = flag.String("pprof-addr", "", "loopback address to serve pprof on, e.g. 127.0.0.1:6060")
+
+// startPprofServer serves pprof in the background.
+func startPprofServer() {
+	if *pprofAddr == "" {
+		return
+	}
+	fatalCheck(checkLoopback(*pprofAddr))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		logs.infof("Serving pprof on %s", *pprofAddr)
+		fatalCheck(http.ListenAndServe(*pprofAddr, mux))
+	}()
+}
+
+// checkLoopback refuses addresses reachable from other machines.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("pprof address %s isn't loopback", addr)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiter allowing bursts of up to burst requests
+// and refilling at rate tokens per second.
+type tokenBucket struct {
+	clock  clock
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		clock:  clk,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clk.Now(),
+	}
+}
+
+// wait blocks until a token is available and takes it.
+func (b *tokenBucket) wait() {
+	b.take(1)
+}
+
+// take blocks until n tokens are available and takes them. n may be more
+// than the burst, in which case it waits for the debt to be paid off.
+func (b *tokenBucket) take(n float64) {
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.refill(now)
+
+	// Take the tokens now, even if it leaves us in debt, so that waiters
+	// are served in the order they arrived.
+	b.tokens -= n
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		b.clock.Sleep(delay)
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// setRate changes the refill rate, keeping tokens already earned.
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(b.clock.Now())
+	b.rate = rate
+}
+
+func (b *tokenBucket) currentRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// rateController adjusts a bucket's rate against how the upstream is
+// coping: halving it when errors or latency climb, then raising it back
+// towards the ceiling a step at a time while things look healthy.
+type rateController struct {
+	bucket  *tokenBucket
+	ceiling float64
+	floor   float64
+	target  time.Duration // latency above which the upstream is struggling
+
+	mu       sync.Mutex
+	requests int
+	errors   int
+	latency  time.Duration // total this interval
+}
+
+// newRateController controls bucket between floor and ceiling. A floor
+// above the ceiling is lowered to it, as throttling must never speed up.
+func newRateController(bucket *tokenBucket, ceiling, floor float64, target time.Duration) *rateController {
+	if floor > ceiling {
+		logs.warnf("Rate floor %g is above the ceiling %g, lowering it to match", floor, ceiling)
+		floor = ceiling
+	}
+	return &rateController{bucket: bucket, ceiling: ceiling, floor: floor, target: target}
+}
+
+// How often the rate is adjusted, and the most errors tolerated.
+var rateAdjustInterval = time.Second * 10
+var rateMaxErrorRatio = 0.05
+
+// observe records one request's outcome.
+func (c *rateController) observe(ok bool, took time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	if !ok {
+		c.errors++
+	}
+	c.latency += took
+}
+
+// adjust applies the last interval's observations and starts another.
+func (c *rateController) adjust() {
+	c.mu.Lock()
+	requests, errors, latency := c.requests, c.errors, c.latency
+	c.requests, c.errors, c.latency = 0, 0, 0
+	c.mu.Unlock()
+
+	if requests == 0 {
+		return
+	}
+
+	rate := c.bucket.currentRate()
+	if float64(errors)/float64(requests) > rateMaxErrorRatio || latency/time.Duration(requests) > c.target {
+		rate /= 2
+		if rate < c.floor {
+			rate = c.floor
+		}
+	} else {
+		rate += c.ceiling / 10
+		if rate > c.ceiling {
+			rate = c.ceiling
+		}
+	}
+	c.bucket.setRate(rate)
+}
+
+// start adjusts the rate in the background.
+func (c *rateController) start() {
+	go func() {
+		for {
+			c.bucket.clock.Sleep(rateAdjustInterval)
+			c.adjust()
+		}
+	}()
+}
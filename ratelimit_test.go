@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBucket(c clock, rate float64, burst int) *tokenBucket {
+	return &tokenBucket{clock: c, rate: rate, burst: float64(burst), tokens: float64(burst), last: c.Now()}
+}
+
+func TestTokenBucketBurstThenRate(t *testing.T) {
+	c := newSimClock(simStart)
+	b := newTestBucket(c, 2, 3)
+
+	// The burst goes straight through.
+	for i := 0; i < 3; i++ {
+		b.wait()
+	}
+	if !c.Now().Equal(simStart) {
+		t.Fatalf("burst took %s", c.Now().Sub(simStart))
+	}
+
+	// Then one token every half second, served in order.
+	done := make(chan time.Time)
+	go func() {
+		b.wait()
+		b.wait()
+		done <- c.Now()
+	}()
+	waitSleeping(t, c, 1)
+	c.AdvanceToNext()
+	waitSleeping(t, c, 1)
+	c.AdvanceToNext()
+	if at := <-done; at.Sub(simStart) != time.Second {
+		t.Errorf("two more tokens took %s, want 1s", at.Sub(simStart))
+	}
+}
+
+func TestTokenBucketDebt(t *testing.T) {
+	c := newSimClock(simStart)
+	b := newTestBucket(c, 100, 100)
+
+	// Taking more than the burst waits for the debt to be paid off.
+	done := make(chan bool)
+	go func() {
+		b.take(300)
+		done <- true
+	}()
+	waitSleeping(t, c, 1)
+	c.AdvanceToNext()
+	<-done
+	if took := c.Now().Sub(simStart); took != time.Second*2 {
+		t.Errorf("took %s paying off the debt, want 2s", took)
+	}
+}
+
+func TestTokenBucketRefillCapped(t *testing.T) {
+	c := newSimClock(simStart)
+	b := newTestBucket(c, 1, 2)
+	b.take(2)
+
+	// An idle hour still only earns a burst's worth.
+	c.Advance(time.Hour)
+	b.take(2)
+	done := make(chan bool)
+	go func() {
+		b.wait()
+		done <- true
+	}()
+	waitSleeping(t, c, 1)
+	c.AdvanceToNext()
+	<-done
+	if took := c.Now().Sub(simStart.Add(time.Hour)); took != time.Second {
+		t.Errorf("third token after idling took %s, want 1s", took)
+	}
+}
+
+func TestRateControllerAdjust(t *testing.T) {
+	c := newSimClock(simStart)
+	rc := &rateController{bucket: newTestBucket(c, 100, 1), ceiling: 100, floor: 20, target: time.Second}
+
+	// Errors halve the rate, but not below the floor.
+	for _, want := range []float64{50, 25, 20} {
+		for i := 0; i < 10; i++ {
+			rc.observe(i > 0, time.Millisecond)
+		}
+		rc.adjust()
+		if got := rc.bucket.currentRate(); got != want {
+			t.Fatalf("rate %g after errors, want %g", got, want)
+		}
+	}
+
+	// So does slowness.
+	rc.bucket.setRate(80)
+	rc.observe(true, time.Second*2)
+	rc.adjust()
+	if got := rc.bucket.currentRate(); got != 40 {
+		t.Fatalf("rate %g after slow requests, want 40", got)
+	}
+
+	// Health climbs back a tenth of the ceiling at a time, up to it.
+	for _, want := range []float64{50, 60, 70, 80, 90, 100, 100} {
+		rc.observe(true, time.Millisecond)
+		rc.adjust()
+		if got := rc.bucket.currentRate(); got != want {
+			t.Fatalf("rate %g while healthy, want %g", got, want)
+		}
+	}
+
+	// An idle interval changes nothing.
+	rc.bucket.setRate(30)
+	rc.adjust()
+	if got := rc.bucket.currentRate(); got != 30 {
+		t.Errorf("rate %g after an idle interval, want 30", got)
+	}
+}
+
+func TestRateControllerFloorAboveCeiling(t *testing.T) {
+	c := newSimClock(simStart)
+	rc := newRateController(newTestBucket(c, 10, 1), 10, 40, time.Second)
+
+	// Throttling must not raise the rate.
+	rc.observe(false, time.Millisecond)
+	rc.adjust()
+	if got := rc.bucket.currentRate(); got != 10 {
+		t.Errorf("rate %g after errors, want it held at the ceiling of 10", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Redis
+// Publishes every market on <prefix>:<resultType>:<regionID>, and keeps
+// each market's latest order book, both sides in one UUDIF message, under
+// <prefix>:book:<regionID>:<typeID> so web apps can read current prices
+// with a single GET.
+var redisURL = flag.String("redis-url", "", "Redis server to publish UUDIF messages to, e.g. redis://localhost:6379/0")
+var redisPrefix = flag.String("redis-prefix", "market", "prefix of the Redis channels and keys written")
+var redisBookTTL = flag.Duration("redis-book-ttl", time.Hour*24, "how long an order book is kept in Redis without being updated, or 0 to keep it")
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *redisURL == "" {
+			return nil, nil
+		}
+		s := newRedisSink()
+
+		// Fail at startup rather than on the first message.
+		c := s.pool.Get()
+		defer c.Close()
+		if _, err := c.Do("PING"); err != nil {
+			return nil, err
+		}
+
+		return newQueuedSink("redis", s.write), nil
+	})
+}
+
+// redisSink publishes messages and stores the latest order books.
+type redisSink struct {
+	pool  *redis.Pool
+	books *latestBooks
+}
+
+func newRedisSink() *redisSink {
+	return &redisSink{
+		pool: &redis.Pool{
+			MaxIdle:     2,
+			IdleTimeout: time.Minute * 5,
+			Dial:        func() (redis.Conn, error) { return redis.DialURL(*redisURL) },
+		},
+		books: newLatestBooks("redis books"),
+	}
+}
+
+// write sends every command for a message in one pipeline.
+func (s *redisSink) write(m *marketUUDIF) error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	sent := 0
+	for _, market := range splitMarkets(m) {
+		if len(market.Rowsets) == 0 {
+			continue
+		}
+		rs := market.Rowsets[0]
+
+		b, err := json.Marshal(market)
+		if err != nil {
+			return err
+		}
+		if err := c.Send("PUBLISH", fmt.Sprintf("%s:%s:%d", *redisPrefix, market.ResultType, rs.RegionID), b); err != nil {
+			return err
+		}
+		sent++
+
+		if market.ResultType != "orders" {
+			continue
+		}
+		book, ok := s.books.merge(market)
+		if !ok {
+			continue
+		}
+		if b, err = json.Marshal(book); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s:book:%d:%d", *redisPrefix, rs.RegionID, rs.TypeID)
+		if *redisBookTTL > 0 {
+			err = c.Send("SET", key, b, "PX", int64(*redisBookTTL/time.Millisecond))
+		} else {
+			err = c.Send("SET", key, b)
+		}
+		if err != nil {
+			return err
+		}
+		sent++
+	}
+
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	for ; sent > 0; sent-- {
+		if _, err := c.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
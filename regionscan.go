@@ -0,0 +1,160 @@
+package main
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Latest scan of each region by regionID: how long it took and what came
+// of the types in it.
+var regionStats = expvar.NewMap("regions")
+
+func init() {
+	registerPruner("region stats", pruneRegionStats)
+}
+
+// regionScan follows the fetches dispatched for one region in a pass,
+// summarizing them once the last finishes.
+type regionScan struct {
+	regionID int64
+	name     string
+	started  time.Time
+
+	mu          sync.Mutex
+	pending     int
+	closed      bool
+	markets     int
+	withData    map[int64]bool
+	notModified map[int64]bool
+	skipped     int
+	failed      int
+}
+
+func newRegionScan(r marketRegions) *regionScan {
+	return &regionScan{
+		regionID:    r.RegionID,
+		name:        r.RegionName,
+		started:     clk.Now(),
+		withData:    make(map[int64]bool),
+		notModified: make(map[int64]bool),
+	}
+}
+
+// dispatch counts a fetch started for the region; done must follow.
+func (s *regionScan) dispatch() {
+	s.mu.Lock()
+	s.pending++
+	s.markets++
+	s.mu.Unlock()
+}
+
+// skip counts a type not fetched after repeated failures.
+func (s *regionScan) skip() {
+	s.mu.Lock()
+	s.skipped++
+	s.mu.Unlock()
+}
+
+// fetched records a fetch's HTTP status for a type. Whole region fetches
+// record each type they had orders for instead.
+func (s *regionScan) fetched(typeID int64, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch code {
+	case 200:
+		s.withData[typeID] = true
+	case 304:
+		s.notModified[typeID] = true
+	}
+}
+
+// fail counts a fetch that gave up.
+func (s *regionScan) fail() {
+	s.mu.Lock()
+	s.failed++
+	s.mu.Unlock()
+}
+
+// done ends a dispatched fetch.
+func (s *regionScan) done() {
+	s.mu.Lock()
+	s.pending--
+	finished := s.closed && s.pending == 0
+	s.mu.Unlock()
+	if finished {
+		s.finish()
+	}
+}
+
+// close says every fetch for the region has been dispatched.
+func (s *regionScan) close() {
+	s.mu.Lock()
+	s.closed = true
+	finished := s.pending == 0
+	s.mu.Unlock()
+	if finished {
+		s.finish()
+	}
+}
+
+// finish logs and publishes the region's summary.
+func (s *regionScan) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	took := clk.Now().Sub(s.started)
+	logs.with(logFields{
+		"regionID":    s.regionID,
+		"seconds":     took.Seconds(),
+		"markets":     s.markets,
+		"withData":    len(s.withData),
+		"notModified": len(s.notModified),
+		"skipped":     s.skipped,
+		"failed":      s.failed,
+	}).infof("Scanned Region: %s in %s, %d of %d markets had new data", s.name, took.Truncate(time.Millisecond), len(s.withData), s.markets)
+
+	m := new(expvar.Map).Init()
+	m.Set("regionName", stringVar(s.name))
+	m.Set("seconds", floatVar(took.Seconds()))
+	m.Set("markets", intVar(int64(s.markets)))
+	m.Set("withData", intVar(int64(len(s.withData))))
+	m.Set("notModified", intVar(int64(len(s.notModified))))
+	m.Set("skipped", intVar(int64(s.skipped)))
+	m.Set("failed", intVar(int64(s.failed)))
+	regionStats.Set(strconv.FormatInt(s.regionID, 10), m)
+}
+
+// pruneRegionStats drops regions no longer scanned.
+func pruneRegionStats(now time.Time) int {
+	stale := []string{}
+	regionStats.Do(func(kv expvar.KeyValue) {
+		id, err := strconv.ParseInt(kv.Key, 10, 64)
+		if err == nil && !live.region(id) {
+			stale = append(stale, kv.Key)
+		}
+	})
+	for _, k := range stale {
+		regionStats.Delete(k)
+	}
+	return len(stale)
+}
+
+func stringVar(v string) *expvar.String {
+	s := new(expvar.String)
+	s.Set(v)
+	return s
+}
+
+func floatVar(v float64) *expvar.Float {
+	f := new(expvar.Float)
+	f.Set(v)
+	return f
+}
+
+func intVar(v int64) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(v)
+	return i
+}
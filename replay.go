@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Longest a replay waits for a gateway that stopped answering.
+var replayGatewayWait = time.Minute
+
+// replaySpool re-uploads spooled and dead-lettered messages from the given
+// files and directories with the current retry policy, removing each once
+// it is posted. Messages go to the destination they were kept for, or to
+// every destination if that isn't known.
+func replaySpool(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("replay-spool needs files or directories to replay")
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	uploaders := map[string]*uploader{}
+	for _, d := range config.Destinations {
+		u, err := newUploader(d)
+		if err != nil {
+			return err
+		}
+		// Failures stay where they are rather than being kept again.
+		u.spool, u.dead = nil, nil
+		if !u.probe() {
+			return fmt.Errorf("destination %s can't be reached", d.Name)
+		}
+		// Give up on messages if the gateway goes away part way through,
+		// rather than waiting for it.
+		u.upWait = replayGatewayWait
+		go u.reach()
+		uploaders[d.Name] = u
+	}
+
+	files := []string{}
+	for _, arg := range args {
+		err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && (strings.HasSuffix(path, spoolPlain) || strings.HasSuffix(path, spoolGzipped)) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	posted, failed := 0, 0
+	for _, path := range files {
+		msg, destination, err := readKept(path)
+		if err != nil {
+			logs.with(logFields{"file": path}).err(err).warnf("Replay failed")
+			failed++
+			continue
+		}
+
+		var probe struct {
+			ResultType string `json:"resultType"`
+		}
+		json.Unmarshal(msg, &probe)
+
+		to := uploaders
+		if u, ok := uploaders[destination]; ok {
+			to = map[string]*uploader{destination: u}
+		}
+
+		ok := true
+		for _, u := range to {
+			ok = u.sendOne(msg, probe.ResultType) && ok
+		}
+		if !ok {
+			failed++
+			continue
+		}
+		os.Remove(path)
+		posted++
+	}
+
+	logs.infof("Replayed %d messages, %d left", posted, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d messages could not be replayed", failed)
+	}
+	return nil
+}
+
+// readKept reads a spooled or dead-lettered message as plain JSON, with the
+// destination it was kept for if that can be told.
+func readKept(path string) ([]byte, string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	gzipped := strings.HasSuffix(path, spoolGzipped)
+	if !intact(b, gzipped) {
+		return nil, "", fmt.Errorf("corrupt")
+	}
+	if gzipped {
+		if b, err = decompress(b); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Dead letters wrap the message with why it was rejected.
+	dead := deadLetter{}
+	if json.Unmarshal(b, &dead) == nil && len(dead.Message) > 0 && dead.Destination != "" {
+		return dead.Message, dead.Destination, nil
+	}
+
+	// Spools are kept in a directory per destination.
+	return b, filepath.Base(filepath.Dir(path)), nil
+}
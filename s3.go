@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3 uploads
+// Finished days of -archive-dir and -csv-archive-dir are uploaded to an S3
+// compatible bucket, and with -s3-batch-interval the raw messages are too,
+// as gzipped newline delimited JSON. Keys start with what they hold and
+// the day, so lifecycle rules can expire each kind by prefix:
+//
+//	<prefix>/archive/2006/01/02/uudif-2006-01-02.ndjson
+//	<prefix>/csv/2006/01/02/orders-2006-01-02.csv.gz
+//	<prefix>/batches/orders/2006/01/02/<unix nanoseconds>.ndjson.gz
+//
+// Credentials come from the usual AWS environment variables and files.
+var s3Bucket = flag.String("s3-bucket", "", "S3 bucket archives and message batches are uploaded to")
+var s3Prefix = flag.String("s3-prefix", "", "prefix of every key uploaded to S3")
+var s3Region = flag.String("s3-region", "us-east-1", "S3 region")
+var s3Endpoint = flag.String("s3-endpoint", "", "endpoint of S3 compatible storage, or empty for AWS")
+var s3ArchiveInterval = flag.Duration("s3-archive-interval", time.Minute*10, "how often finished archive files are looked for to upload")
+var s3BatchInterval = flag.Duration("s3-batch-interval", 0, "how often batches of raw messages are uploaded to S3, or 0 not to")
+
+// Archive files are uploaded once the day in their name is over, and are
+// marked as uploaded with an empty file of the same name plus this.
+const s3UploadedSuffix = ".uploaded"
+
+var archiveDay = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *s3Bucket == "" {
+			return nil, nil
+		}
+		store, err := newS3Store()
+		if err != nil {
+			return nil, err
+		}
+
+		if *archiveDir != "" {
+			store.startArchive("archive", *archiveDir)
+		}
+		if *csvArchiveDir != "" {
+			store.startArchive("csv", *csvArchiveDir)
+		}
+
+		if *s3BatchInterval <= 0 {
+			return nil, nil
+		}
+		return newS3BatchSink(store), nil
+	})
+	registerPruner("s3 markers", pruneS3Markers)
+}
+
+// s3Store puts objects under the configured bucket and prefix.
+type s3Store struct {
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+func newS3Store() (*s3Store, error) {
+	config := &aws.Config{Region: aws.String(*s3Region)}
+	if *s3Endpoint != "" {
+		// Most S3 compatible stores don't do virtual hosted buckets.
+		config.Endpoint = aws.String(*s3Endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{uploader: s3manager.NewUploader(sess), bucket: *s3Bucket, prefix: *s3Prefix}, nil
+}
+
+// key is where something of a kind from a day goes.
+func (s *s3Store) key(kind string, day time.Time, name string) string {
+	return path.Join(s.prefix, kind, day.Format("2006/01/02"), name)
+}
+
+func (s *s3Store) put(key string, body []byte, contentType string) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+// startArchive uploads dir's finished archive files every so often.
+func (s *s3Store) startArchive(kind, dir string) {
+	go func() {
+		for {
+			if err := s.uploadArchive(kind, dir, clk.Now().UTC()); err != nil {
+				logs.with(logFields{"sink": "s3", "archive": kind}).err(err).errorf("Archive upload failed")
+			}
+			clk.Sleep(*s3ArchiveInterval)
+		}
+	}()
+}
+
+// uploadArchive uploads archive files for days before now not yet marked
+// as uploaded.
+func (s *s3Store) uploadArchive(kind, dir string, now time.Time) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	uploaded := make(map[string]bool)
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == s3UploadedSuffix {
+			uploaded[f.Name()[:len(f.Name())-len(s3UploadedSuffix)]] = true
+		}
+	}
+
+	today := now.Format("2006-01-02")
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || uploaded[name] || filepath.Ext(name) == s3UploadedSuffix {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", archiveDay.FindString(name))
+		if err != nil || day.Format("2006-01-02") >= today || now.Sub(f.ModTime()) < *s3ArchiveInterval {
+			continue // Not an archive, or still being written.
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		contentType := "application/x-ndjson"
+		if filepath.Ext(name) == ".gz" {
+			contentType = "application/gzip"
+		}
+		if err := s.put(s.key(kind, day, name), body, contentType); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+s3UploadedSuffix), nil, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Batch is the messages of one result type waiting to be uploaded.
+type s3Batch struct {
+	buf   bytes.Buffer
+	z     *gzip.Writer
+	count int
+}
+
+// s3BatchSink gathers messages into a gzipped batch per result type,
+// uploading them every -s3-batch-interval.
+type s3BatchSink struct {
+	store *s3Store
+
+	mu      sync.Mutex
+	batches map[string]*s3Batch
+}
+
+func newS3BatchSink(store *s3Store) sink {
+	s := &s3BatchSink{store: store, batches: make(map[string]*s3Batch)}
+
+	go func() {
+		for {
+			clk.Sleep(*s3BatchInterval)
+			if err := s.flush(); err != nil {
+				logs.with(logFields{"sink": "s3"}).err(err).errorf("Batch upload failed")
+			}
+		}
+	}()
+
+	return newQueuedSink("s3", s.write)
+}
+
+func (s *s3BatchSink) write(m *marketUUDIF) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch, ok := s.batches[m.ResultType]
+	if !ok {
+		batch = &s3Batch{}
+		batch.z = gzip.NewWriter(&batch.buf)
+		s.batches[m.ResultType] = batch
+	}
+	batch.count++
+	_, err = batch.z.Write(append(b, '\n'))
+	return err
+}
+
+// flush uploads every batch gathered so far. Batches failing to upload are
+// dropped, as the next will be along shortly.
+func (s *s3BatchSink) flush() error {
+	s.mu.Lock()
+	batches := s.batches
+	s.batches = make(map[string]*s3Batch)
+	s.mu.Unlock()
+
+	now := clk.Now().UTC()
+	var first error
+	for resultType, batch := range batches {
+		err := batch.z.Close()
+		if err == nil {
+			key := s.store.key(path.Join("batches", resultType), now, fmt.Sprintf("%d.ndjson.gz", now.UnixNano()))
+			err = s.store.put(key, batch.buf.Bytes(), "application/gzip")
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("%d %s messages: %s", batch.count, resultType, err)
+		}
+	}
+	return first
+}
+
+// pruneS3Markers drops markers whose archive file has been removed.
+func pruneS3Markers(now time.Time) int {
+	n := 0
+	for _, dir := range []string{*archiveDir, *csvArchiveDir} {
+		if dir == "" {
+			continue
+		}
+		markers, _ := filepath.Glob(filepath.Join(dir, "*"+s3UploadedSuffix))
+		for _, m := range markers {
+			if _, err := os.Stat(m[:len(m)-len(s3UploadedSuffix)]); os.IsNotExist(err) {
+				if os.Remove(m) == nil {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
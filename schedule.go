@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// schedulePolicy decides when each market should next be fetched.
+type schedulePolicy interface {
+	name() string
+
+	// next returns when key should be fetched again, given that it was
+	// just fetched at now and whether its data had changed since the
+	// previous fetch.
+	next(key regionKey, now time.Time, changed bool) time.Time
+}
+
+// fixedPolicy refetches every market after the same interval. With no
+// interval it is the plain round robin the bridge has always done.
+type fixedPolicy struct {
+	interval time.Duration
+}
+
+func (p *fixedPolicy) name() string {
+	if p.interval == 0 {
+		return "round-robin"
+	}
+	return "fixed-" + p.interval.String()
+}
+
+func (p *fixedPolicy) next(key regionKey, now time.Time, changed bool) time.Time {
+	return now.Add(p.interval)
+}
+
+// adaptivePolicy halves a market's interval each time it is found to have
+// changed and doubles it each time it hasn't, within min and max, so busy
+// markets are visited often and quiet ones rarely.
+type adaptivePolicy struct {
+	min time.Duration
+	max time.Duration
+
+	mu        sync.Mutex
+	intervals map[regionKey]time.Duration
+}
+
+func newAdaptivePolicy(min time.Duration, max time.Duration) *adaptivePolicy {
+	return &adaptivePolicy{min: min, max: max, intervals: make(map[regionKey]time.Duration)}
+}
+
+func (p *adaptivePolicy) name() string {
+	return "adaptive-" + p.min.String() + "-" + p.max.String()
+}
+
+func (p *adaptivePolicy) next(key regionKey, now time.Time, changed bool) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i, ok := p.intervals[key]
+	switch {
+	case !ok:
+		i = p.min
+	case changed:
+		i /= 2
+	default:
+		i *= 2
+	}
+
+	if i < p.min {
+		i = p.min
+	}
+	if i > p.max {
+		i = p.max
+	}
+	p.intervals[key] = i
+
+	return now.Add(i)
+}
+
+// prune forgets intervals of markets no longer scanned.
+func (p *adaptivePolicy) prune(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for key := range p.intervals {
+		// Region-wide entries have no type.
+		if key.TypeID == 0 && live.region(key.RegionID) {
+			continue
+		}
+		if !live.market(key) {
+			delete(p.intervals, key)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+// Scan cadences
+// History only changes once a day, so it is fetched far less often than
+// orders, and afresh after downtime when the new day's history appears.
+var ordersInterval = flag.Duration("orders-interval", time.Minute*30, "how often each market's orders are fetched")
+var historyInterval = flag.Duration("history-interval", time.Hour*24, "how often each market's history is fetched, besides after downtime")
+
+// pipelineSchedule tracks when each market is next due in one pipeline.
+type pipelineSchedule struct {
+	name     string
+	fixed    schedulePolicy
+	adaptive schedulePolicy // used while adaptive scheduling is on, if set
+
+	mu       sync.Mutex
+	due      map[regionKey]time.Time
+	inflight map[regionKey]bool
+}
+
+var historySchedule, ordersSchedule *pipelineSchedule
+
+// startSchedules sets up each pipeline's schedule from the flags.
+func startSchedules() {
+	historySchedule = newPipelineSchedule("history", &fixedPolicy{*historyInterval}, nil)
+
+	// Adaptive scheduling visits busy markets up to four times as often
+	// and quiet ones a quarter as often.
+	adaptive := newAdaptivePolicy(*ordersInterval/4, *ordersInterval*4)
+	registerPruner("orders intervals", adaptive.prune)
+	ordersSchedule = newPipelineSchedule("orders", &fixedPolicy{*ordersInterval}, adaptive)
+}
+
+func newPipelineSchedule(name string, fixed schedulePolicy, adaptive schedulePolicy) *pipelineSchedule {
+	s := &pipelineSchedule{
+		name:     name,
+		fixed:    fixed,
+		adaptive: adaptive,
+		due:      make(map[regionKey]time.Time),
+		inflight: make(map[regionKey]bool),
+	}
+	registerPruner(name+" schedule", s.prune)
+	return s
+}
+
+// take reports whether a market is due, marking it in flight if so.
+func (s *pipelineSchedule) take(k regionKey, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inflight[k] {
+		return false
+	}
+	if due, ok := s.due[k]; ok && now.Before(due) {
+		return false
+	}
+	s.inflight[k] = true
+	return true
+}
+
+// done schedules a market's next fetch after a successful one.
+func (s *pipelineSchedule) done(k regionKey, now time.Time, changed bool) {
+	policy := s.fixed
+	if s.adaptive != nil && features.enabled(featureAdaptiveScheduling) {
+		policy = s.adaptive
+	}
+	next := policy.next(k, now, changed)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inflight, k)
+	s.due[k] = next
+}
+
+// failed leaves a market due so it is tried again next pass.
+func (s *pipelineSchedule) failed(k regionKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inflight, k)
+}
+
+// reset makes every market due now.
+func (s *pipelineSchedule) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.due = make(map[regionKey]time.Time)
+}
+
+// nextDue is when the next market not in flight becomes due, or zero if
+// none is scheduled.
+func (s *pipelineSchedule) nextDue() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next time.Time
+	for k, due := range s.due {
+		if !s.inflight[k] && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	return next
+}
+
+// prune forgets markets no longer scanned.
+func (s *pipelineSchedule) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for k := range s.due {
+		// Region-wide entries have no type.
+		if k.TypeID == 0 && live.region(k.RegionID) {
+			continue
+		}
+		if !live.market(k) {
+			delete(s.due, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Longest a pass that found nothing due waits before trying again, so new
+// types and the end of downtime aren't missed for long.
+var scheduleMaxIdle = time.Minute * 5
+
+// idleUntil is when a pass that found nothing due should next be tried.
+func idleUntil(now time.Time) time.Time {
+	next := now.Add(scheduleMaxIdle)
+	for _, s := range []*pipelineSchedule{historySchedule, ordersSchedule} {
+		if due := s.nextDue(); !due.IsZero() && due.Before(next) {
+			next = due
+		}
+	}
+	if next.Before(now.Add(time.Second)) {
+		next = now.Add(time.Second)
+	}
+	return next
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelineScheduleFixed(t *testing.T) {
+	c := newSimClock(simStart)
+	s := newPipelineSchedule("test", &fixedPolicy{time.Minute * 30}, nil)
+	k := regionKey{RegionID: 10000002, TypeID: 34}
+
+	if !s.take(k, c.Now()) {
+		t.Fatal("new market not due")
+	}
+	if s.take(k, c.Now()) {
+		t.Fatal("market taken twice while in flight")
+	}
+
+	s.done(k, c.Now(), true)
+	if due := s.nextDue(); !due.Equal(simStart.Add(time.Minute * 30)) {
+		t.Errorf("next due at %s", due)
+	}
+
+	c.Advance(time.Minute * 29)
+	if s.take(k, c.Now()) {
+		t.Fatal("market taken before it was due")
+	}
+	c.Advance(time.Minute)
+	if !s.take(k, c.Now()) {
+		t.Fatal("market not taken once due")
+	}
+
+	// A failure leaves it due straight away.
+	s.failed(k)
+	if !s.take(k, c.Now()) {
+		t.Fatal("failed market not due again")
+	}
+	s.done(k, c.Now(), false)
+
+	s.reset()
+	if !s.take(k, c.Now()) {
+		t.Fatal("market not due after reset")
+	}
+}
+
+func TestPipelineScheduleAdaptive(t *testing.T) {
+	features.override(featureAdaptiveScheduling, true)
+	defer features.clear(featureAdaptiveScheduling)
+
+	c := newSimClock(simStart)
+	policy := newAdaptivePolicy(time.Minute*10, time.Minute*80)
+	s := newPipelineSchedule("test", &fixedPolicy{time.Minute * 30}, policy)
+	k := regionKey{RegionID: 10000002, TypeID: 34}
+
+	// Starts at the shortest interval, doubles while quiet up to the
+	// longest, and halves when busy again.
+	for i, want := range []time.Duration{10, 20, 40, 80, 80} {
+		if !s.take(k, c.Now()) {
+			t.Fatalf("fetch %d not due", i)
+		}
+		s.done(k, c.Now(), false)
+		if got := s.nextDue().Sub(c.Now()); got != want*time.Minute {
+			t.Errorf("fetch %d: next in %s, want %s", i, got, want*time.Minute)
+		}
+		c.Advance(want * time.Minute)
+	}
+
+	s.take(k, c.Now())
+	s.done(k, c.Now(), true)
+	if got := s.nextDue().Sub(c.Now()); got != time.Minute*40 {
+		t.Errorf("after a change next in %s, want 40m", got)
+	}
+}
+
+func TestAdaptivePolicyPruneKeepsRegionWide(t *testing.T) {
+	live.set([]marketRegions{{RegionID: 10000002}}, []marketTypes{{TypeID: 34}})
+	defer func() { live = &liveMarkets{} }()
+
+	p := newAdaptivePolicy(time.Minute*10, time.Minute*80)
+	for _, k := range []regionKey{{10000002, 0}, {10000002, 34}, {10000002, 35}, {10000043, 0}} {
+		p.next(k, simStart, false)
+	}
+
+	if n := p.prune(simStart); n != 2 {
+		t.Errorf("pruned %d, want the dead type and region", n)
+	}
+	for _, k := range []regionKey{{10000002, 0}, {10000002, 34}} {
+		if _, ok := p.intervals[k]; !ok {
+			t.Errorf("%v pruned", k)
+		}
+	}
+}
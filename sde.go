@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// SDE database
+// Regions and types can be read from a MySQL or PostgreSQL copy of the
+// static data export instead of crawled from the API at startup.
+var sdeDatabase = flag.String("sde-db", "", "SDE database to load regions and types from, as mysql:DSN or postgres:DSN")
+
+// Queries for each driver. PostgreSQL conversions of the SDE keep the
+// mixed case names, which must be quoted there.
+var sdeQueries = map[string]struct{ regions, types string }{
+	"mysql": {
+		"SELECT regionID, regionName FROM mapRegions WHERE regionID < 11000000",
+		"SELECT typeID, typeName FROM invTypes WHERE marketGroupID IS NOT NULL AND published = 1",
+	},
+	"postgres": {
+		`SELECT "regionID", "regionName" FROM "mapRegions" WHERE "regionID" < 11000000`,
+		`SELECT "typeID", "typeName" FROM "invTypes" WHERE "marketGroupID" IS NOT NULL AND "published" = 1`,
+	},
+}
+
+// sdeConnect opens the SDE database named by -sde-db.
+func sdeConnect() (*sqlx.DB, string, error) {
+	i := strings.Index(*sdeDatabase, ":")
+	if i < 0 {
+		return nil, "", fmt.Errorf("-sde-db should be mysql:DSN or postgres:DSN")
+	}
+	driver, dsn := (*sdeDatabase)[:i], (*sdeDatabase)[i+1:]
+	if _, ok := sdeQueries[driver]; !ok {
+		return nil, "", fmt.Errorf("unknown SDE database driver %q", driver)
+	}
+
+	db, err := sqlx.Connect(driver, dsn)
+	return db, driver, err
+}
+
+// sdeRegions reads the market regions from the SDE database.
+func sdeRegions() ([]marketRegions, error) {
+	db, driver, err := sdeConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	regions := []marketRegions{}
+	if err := db.Select(&regions, sdeQueries[driver].regions); err != nil {
+		return nil, err
+	}
+	logs.infof("Read %d Regions from the SDE database", len(regions))
+
+	return regions, nil
+}
+
+// sdeTypes reads the published market types from the SDE database.
+func sdeTypes() ([]marketTypes, error) {
+	db, driver, err := sdeConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	types := []marketTypes{}
+	if err := db.Select(&types, sdeQueries[driver].types); err != nil {
+		return nil, err
+	}
+	logs.infof("Read %d Types from the SDE database", len(types))
+
+	return types, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// EMDR upload keys
+// Read from -upload-key-file or EMDR_UPLOAD_KEY, falling back to the
+// bridge's own key. The file or variable holds "name:key", or just the key,
+// with several separated by newlines or commas. Several keys are taken in
+// turn, or all put on every message with -upload-key-mode all.
+var uploadKeyFile = flag.String("upload-key-file", "", "file holding the EMDR upload keys as name:key, one per line")
+var uploadKeyMode = flag.String("upload-key-mode", "rotate", "how several upload keys are used: rotate (one per message, in turn) or all")
+var uploadKeys = []uploadKeysUUDIF{{"EveData.Org", "TheCheeseIsBree"}}
+
+// Next key to use when rotating.
+var uploadKeyNext uint64
+
+// loadUploadKey replaces the default upload key with configured ones.
+func loadUploadKey() error {
+	switch *uploadKeyMode {
+	case "rotate", "all":
+	default:
+		return fmt.Errorf("unknown upload key mode %q", *uploadKeyMode)
+	}
+
+	secret, from := "", ""
+
+	if *uploadKeyFile != "" {
+		s, err := readSecretFile(*uploadKeyFile)
+		if err != nil {
+			return err
+		}
+		secret, from = s, *uploadKeyFile
+	} else if s := os.Getenv("EMDR_UPLOAD_KEY"); s != "" {
+		secret, from = s, "EMDR_UPLOAD_KEY"
+	} else {
+		return nil
+	}
+
+	keys := []uploadKeysUUDIF{}
+	for _, k := range strings.FieldsFunc(secret, func(r rune) bool { return r == '\n' || r == ',' }) {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		key := uploadKeysUUDIF{uploadKeys[0].Name, k}
+		if i := strings.Index(k, ":"); i >= 0 {
+			key = uploadKeysUUDIF{k[:i], k[i+1:]}
+		}
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("%s: upload key needs a name and a key", from)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no upload keys", from)
+	}
+	uploadKeys = keys
+
+	for _, k := range uploadKeys {
+		logs.infof("Using upload key %q from %s", k.Name, from)
+	}
+	return nil
+}
+
+// nextUploadKeys returns the keys for the next message.
+func nextUploadKeys() []uploadKeysUUDIF {
+	if *uploadKeyMode == "all" || len(uploadKeys) == 1 {
+		return uploadKeys
+	}
+	i := atomic.AddUint64(&uploadKeyNext, 1) - 1
+	return []uploadKeysUUDIF{uploadKeys[i%uint64(len(uploadKeys))]}
+}
+
+// readSecretFile reads a secret, refusing files that other users can read
+// or write.
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s: permissions %s are too open, use 0600", path, info.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeSecretFile replaces a secret, readable only by the owner.
+func writeSecretFile(path string, secret string) error {
+	if err := ioutil.WriteFile(path+".tmp", []byte(secret+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
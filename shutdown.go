@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long requests abandoned on shutdown get to unwind, letting failed
+// uploads reach the spool, before the bridge exits.
+var shutdownGrace = time.Second * 5
+
+// handleShutdown cancels every request in flight on SIGINT or SIGTERM and
+// exits once they have had time to unwind. A second signal exits at once.
+func handleShutdown() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logs.infof("Shutting down on %s", sig)
+		cancelRequests()
+
+		select {
+		case <-signals:
+		case <-time.After(shutdownGrace):
+		}
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Scheduler simulation
+// Replays recorded change frequencies through each candidate policy.
+var simulateHours = flag.Int("simulate-hours", 24, "hours of scheduling to simulate")
+var simulateSeed = flag.Int64("simulate-seed", 1, "random seed for simulated market changes")
+
+// simMarket is a market in the simulation and what has happened to it.
+type simMarket struct {
+	key         regionKey
+	changes     []time.Time // when the market changed, in order
+	lastFetched time.Time
+	due         time.Time
+	index       int // position in the due queue
+}
+
+// simQueue orders markets by when they are next due.
+type simQueue []*simMarket
+
+func (q simQueue) Len() int            { return len(q) }
+func (q simQueue) Less(i, j int) bool  { return q[i].due.Before(q[j].due) }
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i]; q[i].index = i; q[j].index = j }
+func (q *simQueue) Push(x interface{}) { m := x.(*simMarket); m.index = len(*q); *q = append(*q, m) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	m := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return m
+}
+
+// simResult is how a policy performed.
+type simResult struct {
+	policy    string
+	requests  int64
+	stale     time.Duration // total time markets were out of date
+	markets   int
+	simulated time.Duration
+}
+
+func (r simResult) freshness() float64 {
+	return 1 - r.stale.Seconds()/(r.simulated.Seconds()*float64(r.markets))
+}
+
+// loadChangeRates reads tab delimited regionID, typeID, changes per day.
+func loadChangeRates(path string) (map[regionKey]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comma = '\t' // Tab delimited.
+
+	rates := make(map[regionKey]float64)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s line %d: want 3 fields, got %d", path, line, len(record))
+		}
+		regionID, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		typeID, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		perDay, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, err
+		}
+		// Changes are drawn at this rate, which has to be a real one.
+		if math.IsNaN(perDay) || math.IsInf(perDay, 0) || perDay <= 0 {
+			return nil, fmt.Errorf("%s line %d: change rate %s isn't positive", path, line, record[2])
+		}
+		rates[regionKey{regionID, typeID}] = perDay
+	}
+
+	return rates, nil
+}
+
+// simulateChanges draws change times for each market as a Poisson process
+// at its recorded rate. The same seed always gives the same changes so
+// every policy faces the same market.
+func simulateChanges(rates map[regionKey]float64, start time.Time, length time.Duration, seed int64) []*simMarket {
+	rnd := rand.New(rand.NewSource(seed))
+	markets := []*simMarket{}
+
+	// Draw in a fixed order; map order would make the seed meaningless.
+	keys := []regionKey{}
+	for key := range rates {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].RegionID != keys[j].RegionID {
+			return keys[i].RegionID < keys[j].RegionID
+		}
+		return keys[i].TypeID < keys[j].TypeID
+	})
+
+	for _, key := range keys {
+		perDay := rates[key]
+		m := &simMarket{key: key}
+		if perDay > 0 {
+			mean := float64(24*time.Hour) / perDay
+			for t := start.Add(time.Duration(rnd.ExpFloat64() * mean)); t.Before(start.Add(length)); t = t.Add(time.Duration(rnd.ExpFloat64() * mean)) {
+				m.changes = append(m.changes, t)
+			}
+		}
+		markets = append(markets, m)
+	}
+
+	return markets
+}
+
+// simulatePolicy runs one policy over the markets on a simulated clock,
+// fetching no faster than rate requests per second.
+func simulatePolicy(policy schedulePolicy, markets []*simMarket, start time.Time, length time.Duration, rate float64) simResult {
+	c := newSimClock(start)
+	end := start.Add(length)
+	gap := time.Duration(float64(time.Second) / rate)
+
+	result := simResult{policy: policy.name(), markets: len(markets), simulated: length}
+
+	q := simQueue{}
+	for _, m := range markets {
+		m.lastFetched, m.due = start, start
+		heap.Push(&q, m)
+	}
+
+	next := start
+	for q.Len() > 0 {
+		m := heap.Pop(&q).(*simMarket)
+
+		// Wait until the market is due and the rate limit allows it.
+		at := m.due
+		if at.Before(next) {
+			at = next
+		}
+		if !at.Before(end) {
+			break
+		}
+		c.Advance(at.Sub(c.Now()))
+		now := c.Now()
+		next = now.Add(gap)
+		result.requests++
+
+		// The copy went stale at the first change since the last fetch.
+		changed := false
+		for _, t := range m.changes {
+			if t.After(m.lastFetched) && !t.After(now) {
+				result.stale += now.Sub(t)
+				changed = true
+				break
+			}
+		}
+
+		m.lastFetched = now
+		m.due = policy.next(m.key, now, changed)
+		heap.Push(&q, m)
+	}
+
+	// Charge staleness still outstanding when the simulation ends.
+	for _, m := range markets {
+		for _, t := range m.changes {
+			if t.After(m.lastFetched) {
+				result.stale += end.Sub(t)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// runSimulation evaluates every candidate policy and prints a comparison.
+func runSimulation(path string) error {
+	rates, err := loadChangeRates(path)
+	if err != nil {
+		return err
+	}
+
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	length := time.Duration(*simulateHours) * time.Hour
+
+	policies := []schedulePolicy{
+		&fixedPolicy{},
+		&fixedPolicy{interval: time.Hour},
+		newAdaptivePolicy(5*time.Minute, 24*time.Hour),
+		newAdaptivePolicy(15*time.Minute, 6*time.Hour),
+	}
+
+	fmt.Printf("Simulating %d markets for %s at %g req/s\n\n", len(rates), length, *crestRate)
+	fmt.Printf("%-28s %12s %10s %10s\n", "policy", "requests", "req/s", "freshness")
+	for _, p := range policies {
+		r := simulatePolicy(p, simulateChanges(rates, start, length, *simulateSeed), start, length, *crestRate)
+		fmt.Printf("%-28s %12d %10.2f %9.2f%%\n", r.policy, r.requests, float64(r.requests)/length.Seconds(), r.freshness()*100)
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadChangeRates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		rates string
+		ok    bool
+	}{
+		{"10000002\t34\t12.5\n10000043\t35\t0.5\n", true},
+		{"10000002\t34\n", false},
+		{"10000002\t34\t0\n", false},
+		{"10000002\t34\t-1\n", false},
+		{"10000002\t34\tNaN\n", false},
+		{"10000002\t34\t+Inf\n", false},
+	} {
+		path := filepath.Join(dir, "rates.tsv")
+		if err := ioutil.WriteFile(path, []byte(test.rates), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rates, err := loadChangeRates(path)
+		if test.ok {
+			if err != nil {
+				t.Errorf("%q: %v", test.rates, err)
+			} else if rates[regionKey{10000002, 34}] != 12.5 {
+				t.Errorf("%q: loaded %v", test.rates, rates)
+			}
+		} else if err == nil {
+			t.Errorf("%q: loaded without error", test.rates)
+		}
+	}
+}
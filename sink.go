@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sink health thresholds
+// A sink is unhealthy when too few recent deliveries succeed or its
+// circuit is open. Consecutive failures open the circuit for a cooldown.
+var sinkHealthWindow = 50
+var sinkHealthMinRatio = 0.5
+var sinkCircuitFailures = 5
+var sinkCircuitCooldown = time.Second * 30
+
+// Returned instead of delivering while a sink's circuit is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// Delivery statistics, keyed by sink name.
+var sinkStats = expvar.NewMap("sinks")
+
+// sink is somewhere generated messages are delivered. deliver must not
+// block for long; sinks doing slow work queue it.
+type sink interface {
+	deliver(m *marketUUDIF)
+}
+
+// fanOut hands every message to each sink.
+func fanOut(in chan *marketUUDIF, sinks []sink) {
+	for m := range in {
+		for _, s := range sinks {
+			s.deliver(m)
+		}
+	}
+}
+
+// Sinks that set themselves up from their own flags. Each returns nil if
+// it isn't configured.
+var sinkFactories = []func() (sink, error){}
+
+// registerSink adds a sink to be set up at startup.
+func registerSink(newSink func() (sink, error)) {
+	sinkFactories = append(sinkFactories, newSink)
+}
+
+// queuedSink hands messages to write from its own goroutine, dropping
+// them when it falls behind rather than holding up the other sinks. Each
+// has its own queue size, retries and stats, from the "sinks" section of
+// the configuration file.
+type queuedSink struct {
+	name     string
+	settings sinkConfig
+	queue    chan *marketUUDIF
+	health   *sinkHealth
+	stats    *expvar.Map
+	clock    clock
+}
+
+func newQueuedSink(name string, write func(m *marketUUDIF) error) *queuedSink {
+	c := sinkSettings(name)
+	s := &queuedSink{
+		name:     name,
+		settings: c,
+		queue:    make(chan *marketUUDIF, c.QueueSize),
+		health:   newSinkHealth(name, *c.Critical),
+		stats:    new(expvar.Map).Init(),
+		clock:    clk,
+	}
+	s.stats.Set("queued", expvar.Func(func() interface{} { return len(s.queue) }))
+	sinkStats.Set(name, s.stats)
+
+	go func() {
+		for m := range s.queue {
+			// Give a sink that keeps failing a rest, letting the queue
+			// drop messages meanwhile.
+			if wait := s.health.wait(); wait > 0 {
+				s.clock.Sleep(wait)
+			}
+
+			err := s.write(m, write)
+			s.health.record(err == nil)
+			if err != nil {
+				s.stats.Add("failed", 1)
+				logs.with(logFields{"sink": name}).err(err).errorf("Write failed")
+			} else {
+				s.stats.Add("written", 1)
+			}
+		}
+	}()
+
+	return s
+}
+
+// write tries a message up to the sink's retries, doubling the backoff
+// between attempts.
+func (s *queuedSink) write(m *marketUUDIF, write func(m *marketUUDIF) error) error {
+	backoff := s.settings.RetryBackoff.Duration
+	for try := 0; ; try++ {
+		err := write(m)
+		if err == nil || try >= s.settings.Retries {
+			return err
+		}
+		s.stats.Add("retried", 1)
+		s.clock.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *queuedSink) deliver(m *marketUUDIF) {
+	select {
+	case s.queue <- m:
+	default:
+		s.stats.Add("dropped", 1)
+	}
+}
+
+// Settings for each queued sink by name, from the configuration file.
+var sinkConfigs = map[string]sinkConfig{}
+
+// sinkSettings returns a sink's settings with defaults filled in.
+func sinkSettings(name string) sinkConfig {
+	c := sinkConfigs[name]
+	if c.QueueSize <= 0 {
+		c.QueueSize = sinkQueueSize
+	}
+	if c.RetryBackoff.Duration <= 0 {
+		c.RetryBackoff.Duration = time.Second
+	}
+	if c.Critical == nil {
+		critical := false
+		c.Critical = &critical
+	}
+	return c
+}
+
+// Messages waiting for a queued sink beyond this are dropped.
+var sinkQueueSize = 1000
+
+// Circuit states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// sinkHealth tracks how deliveries to one sink have been going.
+type sinkHealth struct {
+	name     string
+	critical bool
+	clock    clock
+
+	mu       sync.Mutex
+	results  []bool // ring of recent outcomes
+	next     int
+	failures int // consecutive
+	openedAt time.Time
+}
+
+// Every sink's health, for readiness.
+var sinkHealths = struct {
+	sync.Mutex
+	list []*sinkHealth
+}{}
+
+func newSinkHealth(name string, critical bool) *sinkHealth {
+	h := &sinkHealth{name: name, critical: critical, clock: clk}
+
+	sinkHealths.Lock()
+	sinkHealths.list = append(sinkHealths.list, h)
+	sinkHealths.Unlock()
+
+	return h
+}
+
+// record notes the outcome of a delivery.
+func (h *sinkHealth) record(ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.results) < sinkHealthWindow {
+		h.results = append(h.results, ok)
+	} else {
+		h.results[h.next] = ok
+		h.next = (h.next + 1) % sinkHealthWindow
+	}
+
+	if ok {
+		h.failures = 0
+		h.openedAt = time.Time{}
+		return
+	}
+
+	h.failures++
+	if h.failures >= sinkCircuitFailures {
+		// Opens, or re-opens after a failed half-open attempt.
+		h.openedAt = h.clock.Now()
+	}
+}
+
+// wait returns how long to hold off before the next delivery attempt.
+func (h *sinkHealth) wait() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.openedAt.IsZero() {
+		return 0
+	}
+	if left := sinkCircuitCooldown - h.clock.Now().Sub(h.openedAt); left > 0 {
+		return left
+	}
+	return 0
+}
+
+func (h *sinkHealth) circuit() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.circuitLocked()
+}
+
+func (h *sinkHealth) circuitLocked() string {
+	switch {
+	case h.openedAt.IsZero():
+		return circuitClosed
+	case h.clock.Now().Sub(h.openedAt) < sinkCircuitCooldown:
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+// successRatio is the fraction of recent deliveries that worked, or 1 if
+// there haven't been any.
+func (h *sinkHealth) successRatio() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.successRatioLocked()
+}
+
+func (h *sinkHealth) successRatioLocked() float64 {
+	if len(h.results) == 0 {
+		return 1
+	}
+	ok := 0
+	for _, r := range h.results {
+		if r {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(h.results))
+}
+
+type sinkHealthReport struct {
+	Name         string  `json:"name"`
+	Critical     bool    `json:"critical"`
+	Healthy      bool    `json:"healthy"`
+	SuccessRatio float64 `json:"successRatio"`
+	Circuit      string  `json:"circuit"`
+}
+
+func (h *sinkHealth) report() sinkHealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := sinkHealthReport{
+		Name:         h.name,
+		Critical:     h.critical,
+		SuccessRatio: h.successRatioLocked(),
+		Circuit:      h.circuitLocked(),
+	}
+	r.Healthy = r.SuccessRatio >= sinkHealthMinRatio && r.Circuit != circuitOpen
+
+	return r
+}
+
+type readinessReport struct {
+	Ready  bool               `json:"ready"`
+	Loaded bool               `json:"loaded"`
+	Sinks  []sinkHealthReport `json:"sinks"`
+}
+
+// readiness is ready once the startup data has loaded, unless a critical
+// sink is unhealthy. Best-effort sinks are reported but never fail it,
+// since restarting won't fix them.
+func readiness() readinessReport {
+	loaded := progress.startupLoaded()
+
+	sinkHealths.Lock()
+	defer sinkHealths.Unlock()
+
+	r := readinessReport{Ready: loaded, Loaded: loaded}
+	for _, h := range sinkHealths.list {
+		s := h.report()
+		if s.Critical && !s.Healthy {
+			r.Ready = false
+		}
+		r.Sinks = append(r.Sinks, s)
+	}
+
+	return r
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	report := readiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func init() {
+	statusMux.HandleFunc("/readyz", readyHandler)
+}
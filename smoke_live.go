@@ -0,0 +1,151 @@
+//go:build live
+// +build live
+
+package main
+
+// Pre-release smoke test against the live APIs. Build with -tags=live and
+// run the smoke command; it scans a few markets in one region end to end
+// and posts them to a local fake EMDR, checking what arrives.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Tritanium, Pyerite and Mexallon in The Forge always have a market.
+var smokeRegion int64 = 10000002
+var smokeTypes = []int64{34, 35, 36}
+
+// How long to wait for the fake EMDR to receive everything.
+var smokeTimeout = time.Minute
+
+func init() {
+	extraCommands["smoke"] = smoke
+}
+
+// smokeCheck checks a received message is well formed UUDIF for the
+// market it was generated from.
+func smokeCheck(m marketUUDIF) error {
+	if m.ResultType != "history" && m.ResultType != "orders" {
+		return fmt.Errorf("unexpected resultType %q", m.ResultType)
+	}
+	if len(m.UploadKeys) == 0 || m.Generator.Name != generatorName {
+		return fmt.Errorf("%s: missing upload key or generator", m.ResultType)
+	}
+	if len(m.Rowsets) != 1 {
+		return fmt.Errorf("%s: %d rowsets, want 1", m.ResultType, len(m.Rowsets))
+	}
+
+	rs := m.Rowsets[0]
+	if rs.RegionID != smokeRegion {
+		return fmt.Errorf("%s: region %d, want %d", m.ResultType, rs.RegionID, smokeRegion)
+	}
+	if len(rs.Rows) == 0 {
+		return fmt.Errorf("%s %d: no rows", m.ResultType, rs.TypeID)
+	}
+	for _, row := range rs.Rows {
+		if len(row) != len(m.Columns) {
+			return fmt.Errorf("%s %d: row has %d fields for %d columns", m.ResultType, rs.TypeID, len(row), len(m.Columns))
+		}
+	}
+
+	return nil
+}
+
+func smoke(args []string) error {
+	selectServer()
+	if err := loadStations(); err != nil {
+		return err
+	}
+
+	// Fake EMDR, keeping everything posted to it.
+	var mu sync.Mutex
+	received := []marketUUDIF{}
+	emdr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		m := marketUUDIF{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, m)
+		mu.Unlock()
+	}))
+	defer emdr.Close()
+
+	critical, uncompressed, retries := true, 0, 0
+	u, err := newUploader(destinationConfig{
+		Name:               "smoke",
+		Endpoints:          []endpointConfig{{URL: emdr.URL, Weight: 1}},
+		QueueSize:          len(smokeTypes) * 3,
+		Uploaders:          1,
+		MaxUploaders:       1,
+		Retries:            &retries,
+		RetryBackoff:       duration{time.Second},
+		Critical:           &critical,
+		StructureLocations: structuresAsStation,
+		GzipLevel:          &uncompressed,
+	})
+	if err != nil {
+		return err
+	}
+	u.start()
+
+	sent := 0
+	for _, typeID := range smokeTypes {
+		h, code, err := fetchHistory(smokeRegion, typeID)
+		if err != nil {
+			return err
+		}
+		if code != 200 {
+			return fmt.Errorf("history %d returned status %d", typeID, code)
+		}
+		m := newHistoryUUDIF(h, smokeRegion, typeID)
+		u.deliver(&m)
+		sent++
+
+		for _, side := range []string{"buy", "sell"} {
+			o, code, err := fetchOrders(smokeRegion, typeID, side)
+			if err != nil {
+				return err
+			}
+			if code != 200 {
+				return fmt.Errorf("%s orders %d returned status %d", side, typeID, code)
+			}
+			m := newOrdersUUDIF(o, smokeRegion, typeID)
+			u.deliver(&m)
+			sent++
+		}
+	}
+
+	deadline := time.Now().Add(smokeTimeout)
+	for {
+		mu.Lock()
+		got := len(received)
+		mu.Unlock()
+		if got >= sent {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("fake EMDR received %d of %d messages", got, sent)
+		}
+		time.Sleep(time.Second / 10)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range received {
+		if err := smokeCheck(m); err != nil {
+			return err
+		}
+	}
+
+	logs.infof("Smoke test passed: %d messages for %d types in region %d", len(received), len(smokeTypes), smokeRegion)
+	return nil
+}
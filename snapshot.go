@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+)
+
+// Unchanged order books
+// Quiet markets often come back exactly as they were last time. Sending
+// the same rows again tells consumers nothing, so they can be skipped.
+var skipUnchanged = flag.Bool("skip-unchanged", false, "do not upload order books identical to the last ones sent")
+
+// Messages not generated, keyed by why.
+var skippedStats = expvar.NewMap("skipped")
+
+// snapshotKey is one side of one market's order book.
+type snapshotKey struct {
+	regionKey
+	Buy int
+}
+
+// snapshotSums holds a hash of the last rows sent for each order book.
+type snapshotSums struct {
+	mu   sync.Mutex
+	sums map[snapshotKey][sha1.Size]byte
+}
+
+var snapshots = &snapshotSums{sums: make(map[snapshotKey][sha1.Size]byte)}
+
+// changed records rows as the latest for k, saying whether they differ from
+// the ones before.
+func (s *snapshotSums) changed(k snapshotKey, rows [][]interface{}) bool {
+	b, err := json.Marshal(rows)
+	if err != nil {
+		return true
+	}
+	sum := sha1.Sum(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.sums[k]; ok && last == sum {
+		return false
+	}
+	s.sums[k] = sum
+	return true
+}
+
+// forget drops the rows recorded for both sides of a market, so the next
+// ones are sent whatever they are.
+func (s *snapshotSums) forget(k regionKey) {
+	s.mu.Lock()
+	delete(s.sums, snapshotKey{k, 0})
+	delete(s.sums, snapshotKey{k, 1})
+	s.mu.Unlock()
+}
+
+// forgetSent is called for a message that didn't get where it was going.
+// Its markets were recorded as sent when it was generated, so they are
+// forgotten for the next pass to send them again.
+func forgetSent(m *marketUUDIF) {
+	for _, rs := range m.Rowsets {
+		k := regionKey{rs.RegionID, rs.TypeID}
+		if m.ResultType == "history" {
+			historySent.forget(k)
+		} else {
+			snapshots.forget(k)
+			books.forget(k)
+		}
+	}
+}
+
+// prune drops order books no longer being scanned.
+func (s *snapshotSums) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for k := range s.sums {
+		if !live.market(k.regionKey) {
+			delete(s.sums, k)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerPruner("snapshots", snapshots.prune)
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestLostDeltaUploadRepublished(t *testing.T) {
+	features.override(featureDeltaPublishing, true)
+	defer features.clear(featureDeltaPublishing)
+
+	o := marketOrder{Issued: "2015-06-01T12:00:00", Price: 5.5, VolumeEntered: 10, Volume: 10, Range: "station", Duration: 90, ID: 4242, SolarSystemID: 30000142}
+	o.Location.ID = 60003760
+	book := marketOrders{Items: []marketOrder{o}}
+	books.forget(regionKey{10000002, 34})
+
+	// pass generates the book, returning the message posted if any.
+	pass := func() *marketUUDIF {
+		sem, postChan := make(chan bool, 1), make(chan *marketUUDIF, 1)
+		sem <- true
+		postOrders(sem, postChan, book, 0, 10000002, 34)
+		select {
+		case m := <-postChan:
+			return m
+		default:
+			return nil
+		}
+	}
+
+	m := pass()
+	if m == nil {
+		t.Fatal("new book not published")
+	}
+	if pass() != nil {
+		t.Fatal("unchanged book published again")
+	}
+
+	// The upload is lost, so the same book has to go out again.
+	forgetSent(m)
+	if pass() == nil {
+		t.Fatal("book whose upload was lost not republished")
+	}
+}
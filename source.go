@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Market data source
+// CREST has been retired in favour of ESI; it is kept as a legacy option.
+var sourceName = flag.String("source", "esi", "market data source: esi or crest (legacy)")
+
+// marketSource is somewhere market data can be fetched from.
+type marketSource interface {
+	regions() ([]marketRegions, error)
+	types() ([]marketTypes, error)
+
+	// history and orders return the HTTP status alongside the data, which
+	// is only usable when that is 200.
+	history(regionID int64, typeID int64) (marketHistory, int, error)
+	orders(regionID int64, typeID int64, side string) (marketOrders, int, error)
+}
+
+var source marketSource
+
+// regionOrderSource is a source that can fetch a whole region's orders in
+// one go, rather than two requests for every type. The orders come back
+// already split into each type's books.
+type regionOrderSource interface {
+	regionOrders(regionID int64) (*regionBooks, int, error)
+}
+
+// selectSource picks the market data source from the command line.
+func selectSource() {
+	switch *sourceName {
+	case "esi":
+		source = &esiSource{}
+		logs.infof("Using ESI %s (%s)", esiUrl, esiDatasource)
+	case "crest":
+		source = &crestSource{}
+		logs.infof("Using CREST %s and API %s", crestUrl, apiUrl)
+	default:
+		logs.fatalf("Unknown source %q", *sourceName)
+	}
+}
+
+// loadRegions collects the regions to scan, from the SDE database if one
+// was given or else from the source.
+func loadRegions() ([]marketRegions, error) {
+	if *sdeDatabase != "" {
+		return sdeRegions()
+	}
+
+	regions, err := source.regions()
+	if err != nil {
+		if *catalogCache == "" {
+			return nil, err
+		}
+		// Carry on with the last regions that loaded.
+		cached, cacheErr := loadCatalog(*catalogCache)
+		if cacheErr != nil || len(cached.Regions) == 0 {
+			return nil, err
+		}
+		logs.err(err).warnf("Using the regions cached %s", cached.Saved.Format(time.RFC3339))
+		regions = cached.Regions
+	} else if *catalogCache != "" {
+		warnCheck(saveCatalog(*catalogCache, func(c *cachedCatalog) { c.Regions = regions }))
+	}
+	logs.infof("Loaded %d Regions", len(regions))
+
+	return regions, nil
+}
+
+// loadTypes collects the types to scan, from -types-file or the SDE
+// database if either was given, or else from the source.
+func loadTypes() ([]marketTypes, error) {
+	if err := loadMarketable(); err != nil {
+		return nil, err
+	}
+
+	if *typesFile != "" {
+		// Scan a curated basket instead of the whole market.
+		types, err := loadTypesFile(*typesFile)
+		if err != nil {
+			return nil, err
+		}
+		logs.infof("Loaded %d Types from %s", len(types), *typesFile)
+		return filterMarketable(types), nil
+	}
+
+	if *sdeDatabase != "" {
+		types, err := sdeTypes()
+		if err != nil {
+			return nil, err
+		}
+		return filterMarketable(types), nil
+	}
+
+	types, err := source.types()
+	if err != nil {
+		if *catalogCache == "" {
+			return nil, err
+		}
+		// Carry on with the last catalog that loaded.
+		cached, cacheErr := loadCatalog(*catalogCache)
+		if cacheErr != nil || len(cached.Types) == 0 {
+			return nil, err
+		}
+		logs.err(err).warnf("Using the types cached %s", cached.Saved.Format(time.RFC3339))
+		types = cached.Types
+	} else if *catalogCache != "" {
+		warnCheck(saveCatalog(*catalogCache, func(c *cachedCatalog) { c.Types = types }))
+	}
+	logs.infof("Loaded %d Types", len(types))
+
+	return filterMarketable(types), nil
+}
+
+// fetchHistory gets the market history of a type in a region, waiting
+// while the history circuit is open.
+func fetchHistory(regionID int64, typeID int64) (marketHistory, int, error) {
+	historyBreaker.wait()
+	h, code, err := source.history(regionID, typeID)
+	historyBreaker.record(err == nil && code < 500)
+	return h, code, err
+}
+
+// fetchOrders gets one side, "buy" or "sell", of a type's order book in a
+// region.
+func fetchOrders(regionID int64, typeID int64, side string) (marketOrders, int, error) {
+	ordersBreaker.wait()
+	o, code, err := source.orders(regionID, typeID, side)
+	ordersBreaker.record(err == nil && code < 500)
+	return o, code, err
+}
+
+// fetchRegionOrders gets every order in a region from a source able to.
+func fetchRegionOrders(ro regionOrderSource, regionID int64) (*regionBooks, int, error) {
+	ordersBreaker.wait()
+	books, code, err := ro.regionOrders(regionID)
+	ordersBreaker.record(err == nil && code < 500)
+	return books, code, err
+}
+
+// regionBooks is each type's buy and sell books, filled an order at a time
+// so a region's orders are never held twice.
+type regionBooks struct {
+	buy, sell map[int64]marketOrders
+}
+
+func newRegionBooks() *regionBooks {
+	return &regionBooks{buy: make(map[int64]marketOrders), sell: make(map[int64]marketOrders)}
+}
+
+// add puts an order in its type's book.
+func (b *regionBooks) add(o marketOrder) {
+	books := b.sell
+	if o.Buy {
+		books = b.buy
+	}
+	book := books[o.Type.ID]
+	book.Items = append(book.Items, o)
+	book.TotalCount++
+	books[o.Type.ID] = book
+}
+
+// loadTypesFile reads typeIDs to scan from a file, one per line.
+// Blank lines and lines starting with # are skipped.
+func loadTypesFile(path string) ([]marketTypes, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	types := []marketTypes{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		typeID, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad typeID %q", path, line)
+		}
+		types = append(types, marketTypes{TypeID: typeID})
+	}
+
+	return types, scanner.Err()
+}
@@ -0,0 +1,68 @@
+package main
+
+import "encoding/json"
+
+// splitUUDIF breaks a message into ones encoding to at most maxBytes of
+// JSON, halving first its rowsets and then any single rowset's rows. A
+// single row bigger than the limit is sent as it is.
+func splitUUDIF(m *marketUUDIF, maxBytes int) []*marketUUDIF {
+	if b, err := json.Marshal(m); err != nil || len(b) <= maxBytes {
+		return []*marketUUDIF{m}
+	}
+
+	if len(m.Rowsets) > 1 {
+		half := len(m.Rowsets) / 2
+		a, b := *m, *m
+		a.Rowsets, b.Rowsets = m.Rowsets[:half], m.Rowsets[half:]
+		return append(splitUUDIF(&a, maxBytes), splitUUDIF(&b, maxBytes)...)
+	}
+
+	if len(m.Rowsets) == 0 || len(m.Rowsets[0].Rows) < 2 {
+		return []*marketUUDIF{m}
+	}
+
+	rs := m.Rowsets[0]
+	half := len(rs.Rows) / 2
+	a, b := *m, *m
+	ra, rb := rs, rs
+	ra.Rows, rb.Rows = rs.Rows[:half], rs.Rows[half:]
+	a.Rowsets, b.Rowsets = []rowsetsUUDIF{ra}, []rowsetsUUDIF{rb}
+	return append(splitUUDIF(&a, maxBytes), splitUUDIF(&b, maxBytes)...)
+}
+
+// splitMarkets breaks a message into one per market, for sinks keying or
+// routing by region and type.
+func splitMarkets(m *marketUUDIF) []*marketUUDIF {
+	if len(m.Rowsets) < 2 {
+		return []*marketUUDIF{m}
+	}
+	markets := make([]*marketUUDIF, len(m.Rowsets))
+	for i, rs := range m.Rowsets {
+		one := *m
+		one.Rowsets = []rowsetsUUDIF{rs}
+		markets[i] = &one
+	}
+	return markets
+}
+
+// flattenRows turns a message into one record per row, keyed by column
+// name, with the market and result type each came from.
+func flattenRows(m *marketUUDIF) []map[string]interface{} {
+	records := []map[string]interface{}{}
+	for _, rs := range m.Rowsets {
+		for _, row := range rs.Rows {
+			r := make(map[string]interface{}, len(row)+4)
+			for i, c := range m.Columns {
+				if i < len(row) {
+					r[c] = row[i]
+				}
+			}
+			r["resultType"] = m.ResultType
+			r["regionID"] = rs.RegionID
+			r["typeID"] = rs.TypeID
+			r["generatedAt"] = rs.GeneratedAt
+			records = append(records, r)
+		}
+	}
+	return records
+}
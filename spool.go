@@ -0,0 +1,225 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload spool
+// Messages that still fail after every retry are kept on disk, one
+// directory per destination, and replayed once the destination recovers.
+// The oldest are dropped to stay under the size limit.
+var spoolDir = flag.String("spool-dir", "", "directory failed uploads are kept in until they can be replayed, or empty to drop them")
+var spoolMaxBytes = flag.Int64("spool-max-bytes", 256<<20, "most bytes of failed uploads kept per destination")
+var spoolMaxAge = flag.Duration("spool-max-age", time.Hour*24, "how long failed uploads are kept before being dropped")
+
+// How often spools are retried when nothing has succeeded to prompt it.
+var spoolReplayInterval = time.Minute
+
+// Spooled payloads already gzip encoded are marked by their extension.
+const (
+	spoolPlain   = ".json"
+	spoolGzipped = ".json.gz"
+)
+
+// spool holds failed uploads for one destination as files named so they
+// sort oldest first.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	stats    *expvar.Map
+	clock    clock
+	wake     chan bool
+
+	mu  sync.Mutex
+	seq int64
+}
+
+func newSpool(name, dir string, stats *expvar.Map) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:      dir,
+		maxBytes: *spoolMaxBytes,
+		maxAge:   *spoolMaxAge,
+		stats:    stats,
+		clock:    clk,
+		wake:     make(chan bool, 1),
+	}
+	registerPruner(name+" spool", s.prune)
+	return s, nil
+}
+
+// put stores a payload, dropping the oldest if the spool is now too big.
+func (s *spool) put(msg []byte, gzipped bool) error {
+	ext := spoolPlain
+	if gzipped {
+		ext = spoolGzipped
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%06d%s", s.clock.Now().UnixNano(), s.seq%1000000, ext))
+
+	// Written aside and renamed so replay never sees half a file.
+	if err := ioutil.WriteFile(name+".tmp", msg, 0600); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	s.stats.Add("spooled", 1)
+
+	s.trimLocked()
+	return nil
+}
+
+// files lists the spooled payloads, oldest first.
+func (s *spool) files() ([]os.FileInfo, error) {
+	all, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := all[:0]
+	for _, f := range all {
+		if strings.HasSuffix(f.Name(), spoolPlain) || strings.HasSuffix(f.Name(), spoolGzipped) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// pending counts the payloads replay would still send.
+func (s *spool) pending() (int, error) {
+	files, err := s.files()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		if s.clock.Now().Sub(f.ModTime()) <= s.maxAge {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *spool) trimLocked() {
+	files, err := s.files()
+	if err != nil {
+		return
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	for _, f := range files {
+		if total <= s.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err == nil || os.IsNotExist(err) {
+			total -= f.Size()
+			s.stats.Add("spoolDropped", 1)
+		}
+	}
+}
+
+// prune drops payloads older than the age limit.
+func (s *spool) prune(now time.Time) int {
+	files, err := s.files()
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	for _, f := range files {
+		if now.Sub(f.ModTime()) > s.maxAge {
+			if os.Remove(filepath.Join(s.dir, f.Name())) == nil {
+				n++
+			}
+		}
+	}
+	s.stats.Add("spoolDropped", int64(n))
+	return n
+}
+
+// kick asks for a replay, as the destination looks to be working.
+func (s *spool) kick() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// replay sends spooled payloads oldest first, removing each once sent.
+// It stops at the first failure to leave the rest for next time.
+func (s *spool) replay(send func(msg []byte, gzipped bool) error) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := filepath.Join(s.dir, f.Name())
+		if s.clock.Now().Sub(f.ModTime()) > s.maxAge {
+			continue // Left for prune.
+		}
+
+		msg, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue // Trimmed meanwhile.
+		}
+		if err != nil {
+			return err
+		}
+
+		gzipped := strings.HasSuffix(name, spoolGzipped)
+		if !intact(msg, gzipped) {
+			os.Remove(name)
+			s.stats.Add("spoolCorrupt", 1)
+			continue
+		}
+
+		err = send(msg, gzipped)
+		if rejected(err) {
+			// It will never be accepted, so stop trying.
+			os.Remove(name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		os.Remove(name)
+		s.stats.Add("replayed", 1)
+	}
+
+	return nil
+}
+
+// start replays whenever kicked, or every so often in case nothing is
+// being sent to kick it.
+func (s *spool) start(send func(msg []byte, gzipped bool) error) {
+	go func() {
+		for {
+			select {
+			case <-s.wake:
+			case <-s.clock.After(spoolReplayInterval):
+			}
+			s.replay(send)
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+//go:build sqlite
+
+package main
+
+import (
+	"flag"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite
+// Keeps the latest orders and history of every market in a local file,
+// with the same tables as the other database sinks, so a single binary can
+// answer queries without a database server. The file is checkpointed and
+// vacuumed every so often to give back space from replaced books. The
+// driver needs cgo, so is only built with -tags=sqlite.
+var sqlitePath = flag.String("sqlite-path", "", "SQLite file to keep the latest orders and history in")
+var sqliteCompactInterval = flag.Duration("sqlite-compact-interval", time.Hour*6, "how often the SQLite file is compacted")
+
+// Longest a write waits on compaction before failing.
+var sqliteBusyTimeout = time.Second * 30
+
+var sqliteDialect = sqlDialect{
+	name:        "sqlite",
+	driver:      "sqlite3",
+	placeholder: mysqlDialect.placeholder,
+	migrations: []string{
+		`CREATE TABLE market_orders (
+			order_id INTEGER PRIMARY KEY,
+			region_id INTEGER NOT NULL,
+			type_id INTEGER NOT NULL,
+			is_buy BOOLEAN NOT NULL,
+			price REAL NOT NULL,
+			volume_remaining INTEGER NOT NULL,
+			volume_entered INTEGER NOT NULL,
+			min_volume INTEGER NOT NULL,
+			order_range INTEGER NOT NULL,
+			issued TIMESTAMP NOT NULL,
+			duration INTEGER NOT NULL,
+			station_id INTEGER NOT NULL,
+			solar_system_id INTEGER NOT NULL,
+			generated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX market_orders_market ON market_orders (region_id, type_id, is_buy)`,
+		`CREATE TABLE market_history (
+			region_id INTEGER NOT NULL,
+			type_id INTEGER NOT NULL,
+			date DATE NOT NULL,
+			orders INTEGER NOT NULL,
+			quantity INTEGER NOT NULL,
+			low REAL NOT NULL,
+			high REAL NOT NULL,
+			average REAL NOT NULL,
+			PRIMARY KEY (region_id, type_id, date)
+		)`,
+	},
+	// SQLite takes PostgreSQL's upserts.
+	upsertOrders:  postgresDialect.upsertOrders,
+	upsertHistory: postgresDialect.upsertHistory,
+	setup:         sqliteSetup,
+}
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *sqlitePath == "" {
+			return nil, nil
+		}
+		dsn := *sqlitePath + "?_journal_mode=WAL&_busy_timeout=" + strconv.FormatInt(int64(sqliteBusyTimeout/time.Millisecond), 10)
+		return newSQLSink(sqliteDialect, dsn)
+	})
+}
+
+// sqliteSetup serializes use of the file and starts compacting it.
+func sqliteSetup(db *sqlx.DB) error {
+	// Writers would only wait on each other's locks.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			clk.Sleep(*sqliteCompactInterval)
+			if err := sqliteCompact(db); err != nil {
+				logs.with(logFields{"sink": "sqlite"}).err(err).errorf("Compaction failed")
+			}
+		}
+	}()
+	return nil
+}
+
+// sqliteCompact folds the WAL back into the file and then rebuilds it.
+func sqliteCompact(db *sqlx.DB) error {
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return err
+	}
+	_, err := db.Exec("VACUUM")
+	return err
+}
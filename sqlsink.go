@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Database sinks
+// Orders and history are loaded into market_orders and market_history,
+// creating and migrating the tables as needed, so the bridge can double as
+// a market database loader.
+var postgresSink = flag.String("postgres-dsn", "", "PostgreSQL database to load orders and history into")
+var mysqlSink = flag.String("mysql-dsn", "", "MySQL or MariaDB database to load orders and history into")
+
+// Rows sent in a single INSERT.
+var sqlBatchRows = 500
+
+// sqlDialect is what differs between databases.
+type sqlDialect struct {
+	name   string
+	driver string
+
+	// placeholder returns the nth (from 1) bind parameter.
+	placeholder func(n int) string
+
+	// Schema changes, applied in order. Their index is the schema version.
+	migrations []string
+
+	// Appended to the INSERTs to replace rows already there.
+	upsertOrders  string
+	upsertHistory string
+
+	// Keep every pass's orders rather than only the current book.
+	keepOrders bool
+
+	// Run once the schema is up to date, if set.
+	setup func(db *sqlx.DB) error
+}
+
+var postgresDialect = sqlDialect{
+	name:        "postgres",
+	driver:      "postgres",
+	placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	migrations: []string{
+		`CREATE TABLE market_orders (
+			order_id BIGINT PRIMARY KEY,
+			region_id BIGINT NOT NULL,
+			type_id BIGINT NOT NULL,
+			is_buy BOOLEAN NOT NULL,
+			price DOUBLE PRECISION NOT NULL,
+			volume_remaining BIGINT NOT NULL,
+			volume_entered BIGINT NOT NULL,
+			min_volume BIGINT NOT NULL,
+			order_range INTEGER NOT NULL,
+			issued TIMESTAMPTZ NOT NULL,
+			duration INTEGER NOT NULL,
+			station_id BIGINT NOT NULL,
+			solar_system_id BIGINT NOT NULL,
+			generated_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX market_orders_market ON market_orders (region_id, type_id, is_buy)`,
+		`CREATE TABLE market_history (
+			region_id BIGINT NOT NULL,
+			type_id BIGINT NOT NULL,
+			date DATE NOT NULL,
+			orders BIGINT NOT NULL,
+			quantity BIGINT NOT NULL,
+			low DOUBLE PRECISION NOT NULL,
+			high DOUBLE PRECISION NOT NULL,
+			average DOUBLE PRECISION NOT NULL,
+			PRIMARY KEY (region_id, type_id, date)
+		)`,
+	},
+	upsertOrders: `ON CONFLICT (order_id) DO UPDATE SET
+		price = EXCLUDED.price,
+		volume_remaining = EXCLUDED.volume_remaining,
+		issued = EXCLUDED.issued,
+		generated_at = EXCLUDED.generated_at`,
+	upsertHistory: `ON CONFLICT (region_id, type_id, date) DO UPDATE SET
+		orders = EXCLUDED.orders,
+		quantity = EXCLUDED.quantity,
+		low = EXCLUDED.low,
+		high = EXCLUDED.high,
+		average = EXCLUDED.average`,
+}
+
+var mysqlDialect = sqlDialect{
+	name:        "mysql",
+	driver:      "mysql",
+	placeholder: func(n int) string { return "?" },
+	migrations: []string{
+		`CREATE TABLE market_orders (
+			order_id BIGINT PRIMARY KEY,
+			region_id BIGINT NOT NULL,
+			type_id BIGINT NOT NULL,
+			is_buy BOOLEAN NOT NULL,
+			price DOUBLE NOT NULL,
+			volume_remaining BIGINT NOT NULL,
+			volume_entered BIGINT NOT NULL,
+			min_volume BIGINT NOT NULL,
+			order_range INTEGER NOT NULL,
+			issued DATETIME NOT NULL,
+			duration INTEGER NOT NULL,
+			station_id BIGINT NOT NULL,
+			solar_system_id BIGINT NOT NULL,
+			generated_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX market_orders_market ON market_orders (region_id, type_id, is_buy)`,
+		`CREATE TABLE market_history (
+			region_id BIGINT NOT NULL,
+			type_id BIGINT NOT NULL,
+			date DATE NOT NULL,
+			orders BIGINT NOT NULL,
+			quantity BIGINT NOT NULL,
+			low DOUBLE NOT NULL,
+			high DOUBLE NOT NULL,
+			average DOUBLE NOT NULL,
+			PRIMARY KEY (region_id, type_id, date)
+		)`,
+	},
+	upsertOrders: `ON DUPLICATE KEY UPDATE
+		price = VALUES(price),
+		volume_remaining = VALUES(volume_remaining),
+		issued = VALUES(issued),
+		generated_at = VALUES(generated_at)`,
+	upsertHistory: `ON DUPLICATE KEY UPDATE
+		orders = VALUES(orders),
+		quantity = VALUES(quantity),
+		low = VALUES(low),
+		high = VALUES(high),
+		average = VALUES(average)`,
+}
+
+// Table columns, and the UUDIF columns they are filled from.
+var sqlOrderColumns = []string{"order_id", "region_id", "type_id", "is_buy", "price", "volume_remaining", "volume_entered", "min_volume", "order_range", "issued", "duration", "station_id", "solar_system_id", "generated_at"}
+var sqlOrderFields = []string{"orderID", "", "", "bid", "price", "volRemaining", "volEntered", "minVolume", "range", "issueDate", "duration", "stationID", "solarSystemID", ""}
+var sqlHistoryColumns = []string{"region_id", "type_id", "date", "orders", "quantity", "low", "high", "average"}
+var sqlHistoryFields = []string{"", "", "date", "orders", "quantity", "low", "high", "average"}
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *postgresSink == "" {
+			return nil, nil
+		}
+		return newSQLSink(postgresDialect, *postgresSink)
+	})
+	registerSink(func() (sink, error) {
+		if *mysqlSink == "" {
+			return nil, nil
+		}
+		return newSQLSink(mysqlDialect, *mysqlSink)
+	})
+}
+
+// sqlSink loads messages into a database.
+type sqlSink struct {
+	db      *sqlx.DB
+	dialect sqlDialect
+}
+
+func newSQLSink(dialect sqlDialect, dsn string) (sink, error) {
+	db, err := sqlx.Connect(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sqlSink{db: db, dialect: dialect}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if dialect.setup != nil {
+		if err := dialect.setup(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return newQueuedSink(dialect.name, s.write), nil
+}
+
+// migrate brings the schema up to date, recording the version reached.
+func (s *sqlSink) migrate() error {
+	if _, err := s.db.Exec("CREATE TABLE IF NOT EXISTS bridge_schema (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+
+	version := 0
+	err := s.db.Get(&version, "SELECT version FROM bridge_schema")
+	if err == sql.ErrNoRows {
+		if _, err := s.db.Exec("INSERT INTO bridge_schema (version) VALUES (0)"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for ; version < len(s.dialect.migrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(s.dialect.migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s schema version %d: %s", s.dialect.name, version+1, err)
+		}
+		if _, err := tx.Exec("UPDATE bridge_schema SET version = "+s.dialect.placeholder(1), version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		logs.with(logFields{"sink": s.dialect.name}).infof("Schema migrated to version %d", version+1)
+	}
+
+	return nil
+}
+
+// write loads every rowset of a message in one transaction.
+func (s *sqlSink) write(m *marketUUDIF) error {
+	table, columns, fields, upsert := "market_orders", sqlOrderColumns, sqlOrderFields, s.dialect.upsertOrders
+	if m.ResultType == "history" {
+		table, columns, fields, upsert = "market_history", sqlHistoryColumns, sqlHistoryFields, s.dialect.upsertHistory
+	}
+
+	// Where each field is in the message's rows.
+	index := make(map[string]int)
+	for i, c := range m.Columns {
+		index[c] = i
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, rs := range m.Rowsets {
+		rows := make([][]interface{}, 0, len(rs.Rows))
+		for _, row := range rs.Rows {
+			values := make([]interface{}, len(columns))
+			for i, c := range columns {
+				switch c {
+				case "region_id":
+					values[i] = rs.RegionID
+				case "type_id":
+					values[i] = rs.TypeID
+				case "generated_at":
+					values[i] = rs.GeneratedAt
+				default:
+					j, ok := index[fields[i]]
+					if !ok || j >= len(row) {
+						tx.Rollback()
+						return fmt.Errorf("%s message has no %s column", m.ResultType, fields[i])
+					}
+					values[i] = sqlValue(row[j])
+				}
+			}
+			rows = append(rows, values)
+		}
+
+		for len(rows) > 0 {
+			n := len(rows)
+			if n > sqlBatchRows {
+				n = sqlBatchRows
+			}
+			if err := s.insert(tx, table, columns, rows[:n], upsert); err != nil {
+				tx.Rollback()
+				return err
+			}
+			rows = rows[n:]
+		}
+
+		// Orders not in a full book any more have gone, including every
+		// order of a side that has emptied.
+		if m.ResultType == "orders" && !s.dialect.keepOrders {
+			bid, ok := bookSide(rs, index)
+			if !ok {
+				continue
+			}
+			p := s.dialect.placeholder
+			_, err := tx.Exec("DELETE FROM market_orders WHERE region_id = "+p(1)+" AND type_id = "+p(2)+" AND is_buy = "+p(3)+" AND generated_at < "+p(4), rs.RegionID, rs.TypeID, bid, rs.GeneratedAt)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// bookSide says whether an orders rowset is the buy side, from the side
+// it was fetched as or else from its rows.
+func bookSide(rs rowsetsUUDIF, index map[string]int) (bool, bool) {
+	switch rs.Side {
+	case "buy":
+		return true, true
+	case "sell":
+		return false, true
+	}
+	if len(rs.Rows) == 0 {
+		return false, false
+	}
+	i, ok := index["bid"]
+	if !ok || i >= len(rs.Rows[0]) {
+		return false, false
+	}
+	switch v := rs.Rows[0][i].(type) {
+	case bool:
+		return v, true
+	case float64:
+		return v == 1, true
+	}
+	return false, false
+}
+
+// insert writes rows with a single multi-row INSERT.
+func (s *sqlSink) insert(tx *sql.Tx, table string, columns []string, rows [][]interface{}, upsert string) error {
+	var q strings.Builder
+	q.WriteString("INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES ")
+
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	for i, row := range rows {
+		if i > 0 {
+			q.WriteString(", ")
+		}
+		q.WriteString("(")
+		for j, v := range row {
+			if j > 0 {
+				q.WriteString(", ")
+			}
+			args = append(args, v)
+			q.WriteString(s.dialect.placeholder(len(args)))
+		}
+		q.WriteString(")")
+	}
+	q.WriteString(" " + upsert)
+
+	_, err := tx.Exec(q.String(), args...)
+	return err
+}
+
+// sqlValue converts UUDIF timestamps to times, which every driver takes.
+func sqlValue(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t
+		}
+	}
+	return v
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Server-Sent Events
+// The stream is also served at /events for browsers and curl, taking the
+// same filters as /stream. Each message is an event named after its result
+// type, with the UUDIF message as its data.
+func init() {
+	streamMux.HandleFunc("/events", eventsHandler)
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseStreamFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := streams.subscribe(f)
+	defer streams.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Stops nginx and friends holding events back.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep proxies from timing out idle connections.
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case m := <-sub.ch:
+			b, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.ResultType, b); err != nil {
+				return
+			}
+
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
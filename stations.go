@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Where stations missing from the bundled NPC station list are found.
+// ESI looks each one up as orders turn up in it. The XML API has been shut
+// down and is kept only for mirrors of it.
+var stationSource = flag.String("station-source", "esi", "source for stations missing from the bundled list: esi, xml (legacy) or none")
+
+// How often the station map is reloaded, picking up new player stations.
+var stationsRefresh = flag.Duration("stations-refresh", time.Hour*6, "how often to reload the station list, or 0 never to")
+
+// Stations whose system couldn't be looked up are tried again after this
+// long.
+var stationRetryAfter = time.Hour
+
+// stationStore maps stations to their solar systems. It is read from every
+// order goroutine while being refreshed, so the map is only ever replaced.
+// Stations looked up through ESI are kept apart so reloads don't lose them.
+type stationStore struct {
+	mu     sync.RWMutex
+	m      map[int64]int64
+	looked map[int64]int64
+	failed map[int64]time.Time
+
+	lookups lookupGroup
+}
+
+var stations = &stationStore{
+	m:      make(map[int64]int64),
+	looked: make(map[int64]int64),
+	failed: make(map[int64]time.Time),
+}
+
+// system returns a station's solar system, or 0 if it isn't known.
+func (s *stationStore) system(stationID int64) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if system, ok := s.m[stationID]; ok {
+		return system
+	}
+	return s.looked[stationID]
+}
+
+func (s *stationStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.m) + len(s.looked)
+}
+
+// lookup finds a station missing from the list through ESI, remembering
+// the answer, and returns its solar system or 0 if it can't be found.
+func (s *stationStore) lookup(stationID int64) int64 {
+	if *stationSource != "esi" {
+		return 0
+	}
+
+	s.mu.RLock()
+	at, failed := s.failed[stationID]
+	s.mu.RUnlock()
+	if failed && clk.Now().Sub(at) < stationRetryAfter {
+		return 0
+	}
+
+	return s.lookups.do(stationID, func() int64 {
+		st := struct {
+			SystemID int64 `json:"system_id"`
+		}{}
+		code, _, err := esiGet(fmt.Sprintf("universe/stations/%d/", stationID), nil, &st, false)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil || code != 200 || st.SystemID == 0 {
+			if err != nil {
+				logs.with(logFields{"stationID": stationID}).err(err).warnf("Station lookup failed")
+			}
+			s.failed[stationID] = clk.Now()
+			return 0
+		}
+		s.looked[stationID] = st.SystemID
+		delete(s.failed, stationID)
+
+		return st.SystemID
+	})
+}
+
+// prune forgets failures old enough to be tried again.
+func (s *stationStore) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, at := range s.failed {
+		if now.Sub(at) >= stationRetryAfter {
+			delete(s.failed, id)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerPruner("stations", stations.prune)
+}
+
+func (s *stationStore) replace(m map[int64]int64) {
+	s.mu.Lock()
+	s.m = m
+	s.mu.Unlock()
+}
+
+// loadStations fills the station to solar system map from the bundled NPC
+// station list, and the legacy XML API's if that is the -station-source.
+func loadStations() error {
+	m := make(map[int64]int64)
+
+	// Load NPC stations from file.
+	file, err := os.Open("stations")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comma = '\t' // Tab delimited.
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		stationID, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		systemID, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		m[stationID] = systemID
+	}
+	logs.infof("Loaded %d NPC Stations", len(m))
+
+	// Load player stations
+	switch *stationSource {
+	case "esi", "none":
+	case "xml":
+		getStationsFromAPI(m)
+		logs.infof("Added Player Stations: %d Total Stations", len(m))
+	default:
+		return fmt.Errorf("unknown station source %q", *stationSource)
+	}
+
+	stations.replace(m)
+	return nil
+}
+
+// startStationRefresh reloads the stations in the background.
+func startStationRefresh() {
+	if *stationsRefresh <= 0 {
+		return
+	}
+	go func() {
+		for {
+			clk.Sleep(*stationsRefresh)
+			warnCheck(loadStations())
+		}
+	}()
+}
+
+func getStationsFromAPI(m map[int64]int64) {
+	type stationList struct {
+		Stations []struct {
+			StationID     int64 `xml:"stationID,attr"`
+			SolarSystemID int64 `xml:"solarSystemID,attr"`
+		} `xml:"result>rowset>row"`
+	}
+
+	// Grab the station list from CCP API
+	req, err := newRequest("GET", apiUrl+"eve/ConquerableStationList.xml.aspx", nil)
+	if err != nil {
+		logs.err(err).warnf("Loading stations failed")
+		return
+	}
+	response, err := fetchClient.Do(req)
+	if err != nil {
+		logs.err(err).warnf("Loading stations failed")
+		return
+	}
+	defer response.Body.Close()
+
+	// Decode XML to an array of stations.
+	sL := stationList{}
+	err = xml.NewDecoder(response.Body).Decode(&sL)
+	warnCheck(err)
+
+	// Merge with the NPC station list
+	for _, s := range sL.Stations {
+		m[s.StationID] = s.SolarSystemID
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsD
+// Every number the admin API serves at /debug/vars is also sent to a
+// StatsD agent, such as Telegraf or the Datadog agent, as a gauge named
+// after its path, e.g. emdr_bridge.sinks.postgres.written. Counts are sent
+// as their running totals, so graph them as rates. Datadog tags may be
+// added to each metric.
+var statsdAddr = flag.String("statsd-addr", "", "StatsD agent metrics are sent to, e.g. 127.0.0.1:8125")
+var statsdPrefix = flag.String("statsd-prefix", "emdr_bridge", "prefix of every StatsD metric name")
+var statsdInterval = flag.Duration("statsd-interval", time.Second*10, "how often metrics are sent to StatsD")
+var statsdTags = flag.String("statsd-tags", "", "comma separated Datadog tags added to every metric, e.g. env:prod,region:eu")
+
+// Largest datagram sent, small enough not to be fragmented.
+const statsdPacketSize = 1432
+
+// Variables expvar publishes itself, which aren't the bridge's metrics.
+var statsdSkipped = map[string]bool{"cmdline": true, "memstats": true}
+
+// startStatsd sends metrics to -statsd-addr in the background.
+func startStatsd() {
+	if *statsdAddr == "" {
+		return
+	}
+	conn, err := net.Dial("udp", *statsdAddr)
+	fatalCheck(err)
+
+	suffix := "|g"
+	if *statsdTags != "" {
+		suffix += "|#" + *statsdTags
+	}
+
+	go func() {
+		for {
+			clk.Sleep(*statsdInterval)
+			if err := sendStatsd(conn, statsdLines(suffix)); err != nil {
+				logs.err(err).warnf("Sending metrics to StatsD failed")
+			}
+		}
+	}()
+}
+
+// statsdLines returns a line for every number in the published variables.
+func statsdLines(suffix string) []string {
+	lines := []string{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if statsdSkipped[kv.Key] {
+			return
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(kv.Value.String()), &v); err != nil {
+			return
+		}
+		lines = appendStatsd(lines, *statsdPrefix+"."+statsdName(kv.Key), v, suffix)
+	})
+	sort.Strings(lines)
+	return lines
+}
+
+// appendStatsd appends lines for a value, descending into maps.
+func appendStatsd(lines []string, name string, v interface{}, suffix string) []string {
+	switch v := v.(type) {
+	case float64:
+		lines = append(lines, name+":"+strconv.FormatFloat(v, 'f', -1, 64)+suffix)
+	case bool:
+		n := "0"
+		if v {
+			n = "1"
+		}
+		lines = append(lines, name+":"+n+suffix)
+	case map[string]interface{}:
+		for k, sub := range v {
+			lines = appendStatsd(lines, name+"."+statsdName(k), sub, suffix)
+		}
+	}
+	return lines
+}
+
+// statsdName makes a key safe to use in a metric name.
+func statsdName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// sendStatsd sends lines in as few datagrams as fit them.
+func sendStatsd(conn net.Conn, lines []string) error {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err := conn.Write(packet.Bytes())
+		return err
+	}
+	return nil
+}
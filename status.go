@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Address to serve status on
+// Left empty the status server is not started.
+var statusAddr = flag.String("status-addr", "", "address to serve the status API on, e.g. :8080")
+
+// How long public status responses may be cached by scrapers.
+var publicStatusMaxAge = time.Minute
+
+// statusTracker follows scan progress for the status API.
+type statusTracker struct {
+	mu       sync.Mutex
+	started  time.Time
+	regions  map[int64]regionStatus
+	lastPass time.Time
+	passTook time.Duration
+	passFrom time.Time
+
+	// Messages generated per minute over the last hour.
+	minutes [60]int64
+	minute  int64
+
+	// Cached public response.
+	public     []byte
+	publicTime time.Time
+}
+
+type regionStatus struct {
+	RegionID    int64     `json:"regionID"`
+	RegionName  string    `json:"regionName"`
+	LastScanned time.Time `json:"lastScanned"`
+}
+
+var status = &statusTracker{
+	started:  clk.Now(),
+	passFrom: clk.Now(),
+	regions:  make(map[int64]regionStatus),
+}
+
+// regionScanned records that a region scan started.
+func (s *statusTracker) regionScanned(regionID int64, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.regions[regionID] = regionStatus{regionID, name, clk.Now().UTC()}
+}
+
+// passCompleted records the end of a full pass over every region.
+func (s *statusTracker) passCompleted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clk.Now()
+	s.lastPass = now.UTC()
+	s.passTook = now.Sub(s.passFrom)
+	s.passFrom = now
+}
+
+// lastPassDuration is how long the last full pass took, or zero before
+// the first completes.
+func (s *statusTracker) lastPassDuration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.passTook
+}
+
+// itemGenerated counts a message handed to the uploaders.
+func (s *statusTracker) itemGenerated() {
+	progress.generate()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(clk.Now())
+	s.minutes[s.minute%60]++
+}
+
+// advance clears minute buckets that have gone by since the last count.
+func (s *statusTracker) advance(now time.Time) {
+	m := now.Unix() / 60
+	if m-s.minute >= 60 {
+		s.minutes = [60]int64{}
+	} else {
+		for i := s.minute + 1; i <= m; i++ {
+			s.minutes[i%60] = 0
+		}
+	}
+	s.minute = m
+}
+
+func (s *statusTracker) itemsPerHour() int64 {
+	s.advance(clk.Now())
+	var n int64
+	for _, c := range s.minutes {
+		n += c
+	}
+	return n
+}
+
+// publicStatus is the unauthenticated view intended for coverage
+// dashboards. Nothing in here should identify the operator.
+type publicStatus struct {
+	RegionsCovered    int            `json:"regionsCovered"`
+	Regions           []regionStatus `json:"regions"`
+	LastPassCompleted *time.Time     `json:"lastPassCompleted"`
+	LastPassDuration  string         `json:"lastPassDuration"`
+	ItemsPerHour      int64          `json:"itemsPerHour"`
+	Uptime            string         `json:"uptime"`
+}
+
+func (s *statusTracker) publicJSON() ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Serve the same bytes for the cache period so scrapers can cache them.
+	if s.public != nil && clk.Now().Sub(s.publicTime) < publicStatusMaxAge {
+		return s.public, s.publicTime, nil
+	}
+
+	p := publicStatus{
+		RegionsCovered: len(s.regions),
+		ItemsPerHour:   s.itemsPerHour(),
+		Uptime:         clk.Now().Sub(s.started).Truncate(time.Second).String(),
+	}
+	if !s.lastPass.IsZero() {
+		last := s.lastPass
+		p.LastPassCompleted = &last
+		p.LastPassDuration = s.passTook.Truncate(time.Second).String()
+	}
+	for _, r := range s.regions {
+		p.Regions = append(p.Regions, r)
+	}
+	sort.Slice(p.Regions, func(i, j int) bool { return p.Regions[i].RegionID < p.Regions[j].RegionID })
+
+	enc, err := json.Marshal(p)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	s.public, s.publicTime = enc, clk.Now().UTC()
+
+	return s.public, s.publicTime, nil
+}
+
+func publicStatusHandler(w http.ResponseWriter, r *http.Request) {
+	enc, generated, err := status.publicJSON()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(publicStatusMaxAge.Seconds())))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeContent(w, r, "", generated, bytes.NewReader(enc))
+}
+
+// statusMux holds every handler served on the status address.
+var statusMux = http.NewServeMux()
+
+// prune forgets regions no longer scanned.
+func (s *statusTracker) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id := range s.regions {
+		if !live.region(id) {
+			delete(s.regions, id)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerPruner("status", status.prune)
+	statusMux.HandleFunc("/public/status", publicStatusHandler)
+}
+
+// startStatusServer serves the status API in the background.
+func startStatusServer() {
+	if *statusAddr == "" {
+		return
+	}
+	go func() {
+		logs.infof("Serving status on %s", *statusAddr)
+		fatalCheck(http.ListenAndServe(*statusAddr, statusMux))
+	}()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+)
+
+// Write every generated message to stdout as a line of JSON, for piping
+// into jq or another consumer. Logging goes to stderr so doesn't mix in.
+var stdoutSinkEnabled = flag.Bool("stdout", false, "write generated UUDIF messages to stdout, one per line")
+
+// newNDJSONSink writes messages to w as newline delimited JSON.
+func newNDJSONSink(name string, w io.Writer) sink {
+	enc := json.NewEncoder(w)
+	return newQueuedSink(name, func(m *marketUUDIF) error {
+		// Encode writes the message and its newline in one go.
+		return enc.Encode(m)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Streaming server
+// Local consumers can follow every generated message on their own address
+// without going through EMDR. Each connection may ask for only some result
+// types, regions and types, e.g. /stream?resultType=orders&regionID=10000002.
+var streamAddr = flag.String("stream-addr", "", "address to stream generated messages to local consumers on, e.g. 127.0.0.1:8090")
+
+// streamMux holds every handler served on the stream address.
+var streamMux = http.NewServeMux()
+
+// Messages held for a slow subscriber before it misses them.
+var streamBuffer = 100
+
+// How long a write to a subscriber may take, and how often idle
+// connections are pinged.
+var streamWriteTimeout = time.Second * 10
+var streamPingInterval = time.Second * 30
+
+// Subscribers, and messages sent to and dropped for them.
+var streamStats = expvar.NewMap("stream")
+
+// Every subscriber to the stream.
+var streams = &streamHub{subs: make(map[*streamSub]bool)}
+
+func init() {
+	streamMux.HandleFunc("/stream", websocketHandler)
+	streamStats.Set("subscribers", expvar.Func(func() interface{} { return streams.count() }))
+
+	registerSink(func() (sink, error) {
+		if *streamAddr == "" && *grpcAddr == "" {
+			return nil, nil
+		}
+		if *streamAddr != "" {
+			go func() {
+				logs.infof("Serving streams on %s", *streamAddr)
+				fatalCheck(http.ListenAndServe(*streamAddr, streamMux))
+			}()
+		}
+		return streams, nil
+	})
+}
+
+// parseStreamFilter reads a filter from comma separated resultType,
+// regionID and typeID query parameters.
+func parseStreamFilter(q url.Values) (marketFilter, error) {
+	f := marketFilter{resultTypes: map[string]bool{}, regions: map[int64]bool{}, types: map[int64]bool{}}
+	for _, v := range strings.Split(q.Get("resultType"), ",") {
+		if v != "" {
+			f.resultTypes[v] = true
+		}
+	}
+	for param, ids := range map[string]map[int64]bool{"regionID": f.regions, "typeID": f.types} {
+		for _, v := range strings.Split(q.Get(param), ",") {
+			if v == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return f, fmt.Errorf("bad %s %q", param, v)
+			}
+			ids[id] = true
+		}
+	}
+	return f, nil
+}
+
+// streamSub is one subscriber's filter and waiting messages.
+type streamSub struct {
+	filter marketFilter
+	ch     chan *marketUUDIF
+}
+
+// streamHub hands every message to each subscriber wanting it, dropping
+// messages for those falling behind rather than holding up the sinks.
+type streamHub struct {
+	mu   sync.Mutex
+	subs map[*streamSub]bool
+}
+
+func (h *streamHub) subscribe(f marketFilter) *streamSub {
+	s := &streamSub{filter: f, ch: make(chan *marketUUDIF, streamBuffer)}
+	h.mu.Lock()
+	h.subs[s] = true
+	h.mu.Unlock()
+	return s
+}
+
+func (h *streamHub) unsubscribe(s *streamSub) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+func (h *streamHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func (h *streamHub) deliver(m *marketUUDIF) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs {
+		filtered := s.filter.apply(m)
+		if filtered == nil {
+			continue
+		}
+		select {
+		case s.ch <- filtered:
+			streamStats.Add("sent", 1)
+		default:
+			streamStats.Add("dropped", 1)
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 64 * 1024,
+	// Consumers are local apps rather than other sites' pages.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// websocketHandler streams messages to a WebSocket as JSON text frames.
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseStreamFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already replied.
+	}
+	defer conn.Close()
+
+	sub := streams.subscribe(f)
+	defer streams.unsubscribe(sub)
+
+	// Nothing is expected from the client, but reading notices it going.
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(1024)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case m := <-sub.ch:
+			b, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
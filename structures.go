@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Location IDs from here up are player-owned structures, which EMDR's
+// schema predates, rather than NPC stations.
+const firstStructureID = 1000000000000
+
+// Structures whose system couldn't be looked up, usually for want of
+// docking access, are tried again after this long.
+var structureRetryAfter = time.Hour * 24
+
+// structureResolver looks up which solar system player structures are in
+// through authenticated ESI, remembering the answers.
+type structureResolver struct {
+	mu      sync.Mutex
+	systems map[int64]int64
+	failed  map[int64]time.Time
+	lookups lookupGroup
+}
+
+var structures = &structureResolver{
+	systems: make(map[int64]int64),
+	failed:  make(map[int64]time.Time),
+}
+
+// system returns the solar system a structure is in, or 0 if it can't be
+// found out.
+func (r *structureResolver) system(structureID int64) int64 {
+	if sso == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	if system, ok := r.systems[structureID]; ok {
+		r.mu.Unlock()
+		return system
+	}
+	if at, ok := r.failed[structureID]; ok && clk.Now().Sub(at) < structureRetryAfter {
+		r.mu.Unlock()
+		return 0
+	}
+	r.mu.Unlock()
+
+	return r.lookups.do(structureID, func() int64 {
+		s := struct {
+			SolarSystemID int64 `json:"solar_system_id"`
+		}{}
+		code, _, err := esiGetAuthed(fmt.Sprintf("universe/structures/%d/", structureID), nil, &s, false)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err != nil || code != 200 || s.SolarSystemID == 0 {
+			if err != nil {
+				logs.with(logFields{"structureID": structureID}).err(err).warnf("Structure lookup failed")
+			}
+			r.failed[structureID] = clk.Now()
+			return 0
+		}
+		r.systems[structureID] = s.SolarSystemID
+		delete(r.failed, structureID)
+
+		return s.SolarSystemID
+	})
+}
+
+// prune forgets failures old enough to be tried again.
+func (r *structureResolver) prune(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for id, at := range r.failed {
+		if now.Sub(at) >= structureRetryAfter {
+			delete(r.failed, id)
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerPruner("structures", structures.prune)
+}
+
+// lookupGroup makes concurrent lookups of the same location share one
+// request, so books fetched side by side don't each ask.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[int64]*lookupCall
+}
+
+type lookupCall struct {
+	done   chan bool
+	system int64
+}
+
+// do runs lookup for id unless one is already running, in which case it
+// waits for that one's answer.
+func (g *lookupGroup) do(id int64, lookup func() int64) int64 {
+	g.mu.Lock()
+	if c, ok := g.calls[id]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.system
+	}
+	if g.calls == nil {
+		g.calls = make(map[int64]*lookupCall)
+	}
+	c := &lookupCall{done: make(chan bool)}
+	g.calls[id] = c
+	g.mu.Unlock()
+
+	c.system = lookup()
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.calls, id)
+	g.mu.Unlock()
+
+	return c.system
+}
+
+// orderSystems finds the solar system of every location in a book that
+// ESI didn't give one for, looking each up once before rows are built.
+func orderSystems(orders []marketOrder) map[int64]int64 {
+	systems := make(map[int64]int64)
+	for _, e := range orders {
+		id := e.Location.ID
+		if e.SolarSystemID != 0 {
+			continue
+		}
+		if _, ok := systems[id]; ok {
+			continue
+		}
+
+		system := stations.system(id)
+		if system == 0 && id >= firstStructureID {
+			system = structures.system(id)
+		} else if system == 0 {
+			system = stations.lookup(id)
+		}
+		systems[id] = system
+	}
+	return systems
+}
+
+// Structure location policies
+// How a destination is sent orders in structures.
+const (
+	structuresAsStation   = "station"     // the structure ID as the stationID
+	structuresPlaceholder = "placeholder" // a fixed stationID instead
+	structuresExclude     = "exclude"     // leave the orders out
+)
+
+func checkStructurePolicy(policy string) error {
+	switch policy {
+	case structuresAsStation, structuresPlaceholder, structuresExclude:
+		return nil
+	}
+	return fmt.Errorf("unknown structure location policy %q", policy)
+}
+
+// applyStructurePolicy returns a message with orders in structures
+// rewritten or removed. Messages without any come back untouched.
+func applyStructurePolicy(m *marketUUDIF, policy string, placeholder int64) *marketUUDIF {
+	if m.ResultType != "orders" || policy == structuresAsStation {
+		return m
+	}
+
+	station := -1
+	for i, c := range m.Columns {
+		if c == "stationID" {
+			station = i
+		}
+	}
+	if station < 0 {
+		return m
+	}
+
+	p := *m
+	p.Rowsets = make([]rowsetsUUDIF, len(m.Rowsets))
+	for i, rs := range m.Rowsets {
+		p.Rowsets[i] = rs
+		p.Rowsets[i].Rows = [][]interface{}{}
+
+		for _, row := range rs.Rows {
+			if id, ok := wholeNumber(row[station]); ok && id >= firstStructureID {
+				if policy == structuresExclude {
+					continue
+				}
+				row = append([]interface{}{}, row...)
+				row[station] = placeholder
+			}
+			p.Rowsets[i].Rows = append(p.Rowsets[i].Rows, row)
+		}
+	}
+
+	return &p
+}
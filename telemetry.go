@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Anonymous usage telemetry
+// Strictly opt-in. Only counts and durations are sent: nothing naming the
+// operator, their keys, or where they upload to.
+var telemetryEnabled = flag.Bool("telemetry", false, "send anonymous usage telemetry to -telemetry-url")
+var telemetryURL = flag.String("telemetry-url", "", "where usage telemetry is sent")
+var telemetryInterval = time.Hour
+
+// telemetrySink counts the messages generated and periodically reports
+// them with the bridge's error rates.
+type telemetrySink struct {
+	started time.Time
+	client  *http.Client
+
+	mu       sync.Mutex
+	messages map[string]int64 // by result type, since the last report
+}
+
+type telemetryReport struct {
+	Version        string           `json:"version"`
+	OS             string           `json:"os"`
+	Arch           string           `json:"arch"`
+	Source         string           `json:"source"`
+	UptimeHours    float64          `json:"uptimeHours"`
+	PassSeconds    float64          `json:"passSeconds"`
+	Messages       map[string]int64 `json:"messages"`
+	FetchOK        int64            `json:"fetchOK"`
+	FetchErrors    int64            `json:"fetchErrors"`
+	UploadsPosted  int64            `json:"uploadsPosted"`
+	UploadsFailed  int64            `json:"uploadsFailed"`
+	UploadsDropped int64            `json:"uploadsDropped"`
+}
+
+func newTelemetrySink() *telemetrySink {
+	t := &telemetrySink{
+		started:  clk.Now(),
+		client:   newClient(newTransport(1)),
+		messages: make(map[string]int64),
+	}
+
+	if *telemetryURL == "" {
+		logs.warnf("Telemetry enabled without -telemetry-url, nothing will be sent")
+		return t
+	}
+
+	go func() {
+		for {
+			clk.Sleep(telemetryInterval)
+			if err := t.send(); err != nil {
+				logs.err(err).warnf("Sending telemetry failed")
+			}
+		}
+	}()
+
+	return t
+}
+
+func (t *telemetrySink) deliver(m *marketUUDIF) {
+	t.mu.Lock()
+	t.messages[m.ResultType]++
+	t.mu.Unlock()
+}
+
+func (t *telemetrySink) send() error {
+	t.mu.Lock()
+	messages := t.messages
+	t.messages = make(map[string]int64)
+	t.mu.Unlock()
+
+	r := telemetryReport{
+		Version:     generatorVersion,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Source:      *sourceName,
+		UptimeHours: clk.Now().Sub(t.started).Hours(),
+		PassSeconds: status.lastPassDuration().Seconds(),
+		Messages:    messages,
+		FetchOK:     expvarInt(fetchStats, "ok"),
+		FetchErrors: expvarInt(fetchStats, "errors"),
+	}
+	sinkStats.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(*expvar.Map); ok {
+			r.UploadsPosted += expvarInt(m, "posted")
+			r.UploadsFailed += expvarInt(m, "failed")
+			r.UploadsDropped += expvarInt(m, "dropped")
+		}
+	})
+
+	enc, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := newRequest("POST", *telemetryURL, bytes.NewReader(enc))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	response, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// expvarInt reads an integer statistic, or zero if it hasn't been set.
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
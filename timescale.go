@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TimescaleDB
+// Loads into hypertables like the PostgreSQL sink, but keeps every pass's
+// orders so full order books can be stored long-term. Chunks older than
+// the retention are dropped by TimescaleDB itself.
+var timescaleSink = flag.String("timescale-dsn", "", "TimescaleDB database to store every pass's orders and history in")
+var timescaleRetention = flag.Duration("timescale-retention", 0, "how long TimescaleDB keeps orders, or 0 to keep them forever")
+
+// Hypertable chunks, fixed once the tables exist.
+const timescaleOrdersChunk = "1 day"
+const timescaleHistoryChunk = "30 days"
+
+var timescaleDialect = sqlDialect{
+	name:        "timescale",
+	driver:      postgresDialect.driver,
+	placeholder: postgresDialect.placeholder,
+	migrations: []string{
+		`CREATE EXTENSION IF NOT EXISTS timescaledb`,
+		`CREATE TABLE market_orders (
+			generated_at TIMESTAMPTZ NOT NULL,
+			order_id BIGINT NOT NULL,
+			region_id BIGINT NOT NULL,
+			type_id BIGINT NOT NULL,
+			is_buy BOOLEAN NOT NULL,
+			price DOUBLE PRECISION NOT NULL,
+			volume_remaining BIGINT NOT NULL,
+			volume_entered BIGINT NOT NULL,
+			min_volume BIGINT NOT NULL,
+			order_range INTEGER NOT NULL,
+			issued TIMESTAMPTZ NOT NULL,
+			duration INTEGER NOT NULL,
+			station_id BIGINT NOT NULL,
+			solar_system_id BIGINT NOT NULL,
+			PRIMARY KEY (order_id, generated_at)
+		)`,
+		`SELECT create_hypertable('market_orders', 'generated_at', chunk_time_interval => INTERVAL '` + timescaleOrdersChunk + `')`,
+		`CREATE INDEX market_orders_market ON market_orders (region_id, type_id, generated_at DESC)`,
+		postgresDialect.migrations[2],
+		`SELECT create_hypertable('market_history', 'date', chunk_time_interval => INTERVAL '` + timescaleHistoryChunk + `')`,
+	},
+	upsertOrders:  `ON CONFLICT (order_id, generated_at) DO NOTHING`,
+	upsertHistory: postgresDialect.upsertHistory,
+	keepOrders:    true,
+	setup:         timescaleRetain,
+}
+
+func init() {
+	registerSink(func() (sink, error) {
+		if *timescaleSink == "" {
+			return nil, nil
+		}
+		return newSQLSink(timescaleDialect, *timescaleSink)
+	})
+}
+
+// timescaleRetain replaces the orders retention policy with the configured
+// one.
+func timescaleRetain(db *sqlx.DB) error {
+	if _, err := db.Exec(`SELECT remove_retention_policy('market_orders', if_exists => true)`); err != nil {
+		return err
+	}
+	if *timescaleRetention <= 0 {
+		return nil
+	}
+	_, err := db.Exec(`SELECT add_retention_policy('market_orders', make_interval(secs => $1))`, timescaleRetention.Seconds())
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// tlsSettings configures the TLS client side of a destination, for private
+// ingest services that want a client certificate or use their own CA.
+type tlsSettings struct {
+	// Client certificate and key, PEM encoded.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	// CA bundle to verify the server against instead of the system's.
+	CA string `json:"ca"`
+
+	// Server name to verify, if not the endpoint's host.
+	ServerName string `json:"serverName"`
+}
+
+// clientConfig loads the certificates into a TLS configuration.
+func (t *tlsSettings) clientConfig() (*tls.Config, error) {
+	c := &tls.Config{ServerName: t.ServerName}
+
+	if t.Cert != "" || t.Key != "" {
+		if t.Cert == "" || t.Key == "" {
+			return nil, fmt.Errorf("tls: a client certificate needs both cert and key")
+		}
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates in %s", t.CA)
+		}
+		c.RootCAs = pool
+	}
+
+	return c, nil
+}
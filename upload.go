@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the upload pool is resized against measured latency.
+var uploaderResizeInterval = time.Second * 30
+
+// Latency assumed for an endpoint that hasn't been posted to yet.
+// Kept low so new endpoints are tried straight away.
+var endpointInitialLatency = time.Millisecond * 100
+
+// Latency charged against an endpoint for a failed post.
+var endpointFailurePenalty = time.Second * 5
+
+// Gateway failover
+// An endpoint is taken out of rotation after this many consecutive failed
+// posts or health checks, and put back once a health check succeeds.
+var endpointDownAfter = flag.Int("endpoint-down-after", 3, "consecutive failures before an upload endpoint is taken out of rotation")
+var endpointCheckInterval = flag.Duration("endpoint-check-interval", time.Second*30, "how often upload endpoints are health checked")
+
+// Cooldown when a gateway rate limits the bridge without saying how long
+// for.
+var uploadCooldown = time.Minute
+
+// Holds every upload back while a gateway is rate limiting the bridge.
+// Messages queue up meanwhile.
+var uploadGate = &fetchPause{clock: clk, what: "uploads"}
+
+// Limits bytes posted by every uploader, if -upload-bandwidth is set.
+var uploadLimiter *tokenBucket
+
+// startUploadLimiter applies -upload-bandwidth, allowing a second's worth
+// of bytes in a burst.
+func startUploadLimiter() {
+	if *uploadBandwidth > 0 {
+		uploadLimiter = newTokenBucket(float64(*uploadBandwidth), *uploadBandwidth)
+	}
+}
+
+// endpoint is a single upload gateway and its observed load.
+type endpoint struct {
+	url      string
+	weight   float64
+	inflight int
+	latency  time.Duration // moving average of a single post
+	failures int           // consecutive
+	down     bool
+}
+
+// uploader posts UUDIF messages to one destination's gateways using a
+// pool of goroutines. The pool grows and shrinks between min and max so
+// that enough posts are in flight to keep up with the rate messages
+// arrive at the measured gateway latency.
+type uploader struct {
+	name      string
+	endpoints []*endpoint
+	client    *http.Client
+	queue     chan *marketUUDIF
+	retire    chan bool
+	enrich    bool
+	columns   []derivedColumn
+	gzipLevel int // 0 to send uncompressed
+	maxBytes  int // 0 for no limit
+	spool     *spool
+	dead      *deadLetterStore
+	header    http.Header  // sent with every request
+	limiter   *tokenBucket // nil for no rate limit
+	checksum  string       // integrity header algorithm, if any
+	format    string       // what is posted: UUDIF or aggregator records
+
+	// Structure location policy and placeholder stationID.
+	structures  string
+	placeholder int64
+
+	min int
+	max int
+
+	retries int
+	backoff time.Duration
+	upWait  time.Duration // longest a post waits for the gateway, 0 for ever
+
+	stats  *expvar.Map
+	health *sinkHealth
+	clock  clock
+
+	mu      sync.Mutex
+	workers int
+	latency time.Duration // moving average of a single post
+	posted  int64         // posts since the last resize
+
+	// Whether the gateways can be reached at all.
+	state        string
+	stateSince   time.Time
+	stateChanged *sync.Cond
+}
+
+func newUploader(c destinationConfig) (*uploader, error) {
+	min, max := c.Uploaders, c.MaxUploaders
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	// Pool of transports.
+	transport := newTransport(max)
+	if c.TLS != nil {
+		var err error
+		if transport.TLSClientConfig, err = c.TLS.clientConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	u := &uploader{
+		name:    c.Name,
+		client:  newClient(transport),
+		queue:   make(chan *marketUUDIF, c.QueueSize),
+		enrich:  c.Enrich,
+		retire:  make(chan bool),
+		min:     min,
+		max:     max,
+		retries: *c.Retries,
+		backoff: c.RetryBackoff.Duration,
+		stats:   new(expvar.Map).Init(),
+		health:  newSinkHealth(c.Name, *c.Critical),
+		clock:   clk,
+	}
+	u.structures, u.placeholder = c.StructureLocations, c.StructurePlaceholder
+	u.state, u.stateSince, u.stateChanged = gatewayConnecting, u.clock.Now(), sync.NewCond(&u.mu)
+	u.gzipLevel, u.maxBytes = *c.GzipLevel, c.MaxMessageBytes
+	if c.Rate != nil && *c.Rate > 0 {
+		u.limiter = newTokenBucket(*c.Rate, 1)
+	}
+	u.checksum, u.format = c.Checksum, c.Format
+	u.header = http.Header{}
+	for k, v := range c.Headers {
+		u.header.Set(k, os.ExpandEnv(v))
+	}
+	for _, def := range c.Columns {
+		d, _ := parseColumn(def) // Checked by loadConfig.
+		u.columns = append(u.columns, d)
+	}
+	u.stats.Set("queued", expvar.Func(func() interface{} { return len(u.queue) }))
+	sinkStats.Set(c.Name, u.stats)
+	u.publishState()
+
+	if *spoolDir != "" {
+		var err error
+		u.spool, err = newSpool(c.Name, filepath.Join(*spoolDir, c.Name), u.stats)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *deadLetterDir != "" {
+		var err error
+		u.dead, err = newDeadLetterStore(c.Name, filepath.Join(*deadLetterDir, c.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range c.Endpoints {
+		ep := &endpoint{url: e.URL, weight: e.Weight, latency: endpointInitialLatency}
+
+		// Start from how the endpoint did before, discounting ones that
+		// have often failed.
+		if h, ok := endpointHistory(e.URL); ok {
+			if h.Latency.Duration > 0 {
+				ep.latency = h.Latency.Duration
+			}
+			ep.weight *= h.successRate()
+		}
+		u.endpoints = append(u.endpoints, ep)
+	}
+
+	// Best endpoints first, so they win ties.
+	sort.SliceStable(u.endpoints, func(i, j int) bool {
+		return float64(u.endpoints[i].latency)/u.endpoints[i].weight < float64(u.endpoints[j].latency)/u.endpoints[j].weight
+	})
+
+	return u, nil
+}
+
+// deliver queues a message for upload. A destination that falls behind
+// drops messages rather than holding up the others.
+func (u *uploader) deliver(m *marketUUDIF) {
+	select {
+	case u.queue <- m:
+	default:
+		u.stats.Add("dropped", 1)
+		forgetSent(m)
+	}
+}
+
+// start spawns the minimum pool and the resize loop.
+func (u *uploader) start() {
+	if u.spool != nil {
+		u.spool.start(u.resend)
+	}
+	go u.reach()
+
+	go func() {
+		for i := 0; i < u.min; i++ {
+			// Don't spawn them all at once.
+			u.clock.Sleep(time.Second / 2)
+			u.spawn()
+		}
+
+		for {
+			u.clock.Sleep(uploaderResizeInterval)
+			u.resize()
+		}
+	}()
+
+	if len(u.endpoints) > 1 && *endpointCheckInterval > 0 {
+		go func() {
+			for {
+				u.clock.Sleep(*endpointCheckInterval)
+				u.checkEndpoints()
+			}
+		}()
+	}
+}
+
+func (u *uploader) spawn() {
+	u.mu.Lock()
+	u.workers++
+	u.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case msg := <-u.queue:
+				u.send(msg)
+			case <-u.retire:
+				return
+			}
+		}
+	}()
+}
+
+// resize applies Little's law to pick a pool size: the number of posts in
+// flight needed is the arrival rate multiplied by the time each one takes.
+// Half again is added as headroom for latency spikes.
+func (u *uploader) resize() {
+	u.mu.Lock()
+	rate := float64(u.posted) / uploaderResizeInterval.Seconds()
+	want := int(rate*u.latency.Seconds()*1.5) + 1
+	u.posted = 0
+	have := u.workers
+	u.mu.Unlock()
+
+	if want < u.min {
+		want = u.min
+	}
+	if want > u.max {
+		want = u.max
+	}
+
+	if want != have {
+		logs.with(logFields{"destination": u.name}).infof("Resizing upload pool %d -> %d (%.1f msg/s, %s latency)", have, want, rate, u.latency)
+	}
+
+	for ; have < want; have++ {
+		u.spawn()
+	}
+	for ; have > want; have-- {
+		u.retire <- true
+		u.mu.Lock()
+		u.workers--
+		u.mu.Unlock()
+	}
+}
+
+// pick chooses the least loaded endpoint: the one where another post is
+// expected to finish soonest once its weight is taken into account.
+// Endpoints that are down are only used if every one is.
+func (u *uploader) pick() *endpoint {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	up := 0
+	for _, e := range u.endpoints {
+		if !e.down {
+			up++
+		}
+	}
+
+	var best *endpoint
+	var bestScore float64
+	for _, e := range u.endpoints {
+		if e.down && up > 0 {
+			continue
+		}
+		score := float64(e.inflight+1) * float64(e.latency) / e.weight
+		if best == nil || score < bestScore {
+			best, bestScore = e, score
+		}
+	}
+	best.inflight++
+
+	return best
+}
+
+// send posts a message, split up if it is too big for the gateway. A
+// message that is lost rather than posted or spooled is forgotten as sent.
+func (u *uploader) send(m *marketUUDIF) {
+	if !u.sendParts(m) {
+		forgetSent(m)
+	}
+}
+
+// sendParts posts a message, in parts if need be, saying whether every
+// part was posted or spooled.
+func (u *uploader) sendParts(m *marketUUDIF) bool {
+	m = applyStructurePolicy(m, u.structures, u.placeholder)
+	if u.enrich {
+		m = enrichUUDIF(m)
+	}
+	if len(u.columns) > 0 {
+		m = addColumns(m, u.columns)
+	}
+
+	msg, err := u.encode(m)
+	if err != nil {
+		logs.with(logFields{"destination": u.name}).err(err).errorf("Encoding failed")
+		u.stats.Add("failed", 1)
+		return false
+	}
+	if u.maxBytes > 0 && len(msg) > u.maxBytes {
+		parts := splitUUDIF(m, u.maxBytes)
+		u.stats.Add("split", 1)
+		ok := true
+		for _, p := range parts {
+			msg, err := u.encode(p)
+			if err != nil || !u.sendOne(msg, m.ResultType) {
+				ok = false
+			}
+		}
+		return ok
+	}
+	return u.sendOne(msg, m.ResultType)
+}
+
+// sendOne posts an encoded message, retrying with a doubling backoff on
+// failure, and says whether it was posted or spooled to be posted later.
+func (u *uploader) sendOne(msg []byte, resultType string) bool {
+	var err error
+	if u.gzipLevel != 0 {
+		u.stats.Add("bytesUncompressed", int64(len(msg)))
+		msg, err = compress(msg, u.gzipLevel)
+	}
+	if err != nil {
+		logs.with(logFields{"destination": u.name}).err(err).errorf("Compressing failed")
+		u.stats.Add("failed", 1)
+		return false
+	}
+
+	backoff := u.backoff
+	for attempt := 0; ; attempt++ {
+		// Until the gateway can be reached, keep messages in the spool if
+		// there is one, or hold them here.
+		if u.spool != nil && !u.up() {
+			if err := u.spool.put(msg, u.gzipLevel != 0); err == nil {
+				return true
+			}
+		}
+		if !u.waitUp() {
+			u.stats.Add("failed", 1)
+			return false
+		}
+
+		// Hold off while the destination's circuit is open.
+		if d := u.health.wait(); d > 0 {
+			u.clock.Sleep(d)
+		}
+		uploadGate.wait()
+
+		err = u.post(msg, u.gzipLevel != 0, resultType)
+		u.health.record(!gatewayFault(err))
+		if err == nil {
+			u.stats.Add("posted", 1)
+			u.stats.Add("bytes", int64(len(msg)))
+			progress.upload()
+			if u.spool != nil {
+				u.spool.kick()
+			}
+			return true
+		}
+
+		logs.with(logFields{"destination": u.name}).err(err).warnf("Upload failed")
+		if e, ok := err.(*uploadError); ok && e.code == http.StatusTooManyRequests {
+			// Not the message's fault; try again once the cooldown is over.
+			attempt--
+			continue
+		}
+		if rejected(err) {
+			// Sending it again won't change the answer.
+			u.reject(msg, u.gzipLevel != 0, err)
+			return false
+		}
+		if attempt >= u.retries {
+			if u.spool != nil {
+				if err := u.spool.put(msg, u.gzipLevel != 0); err == nil {
+					return true
+				}
+				logs.with(logFields{"destination": u.name}).err(err).errorf("Spooling failed")
+			}
+			u.stats.Add("failed", 1)
+			return false
+		}
+
+		u.stats.Add("retried", 1)
+		u.clock.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// resend posts a spooled message once, leaving it spooled on failure.
+func (u *uploader) resend(msg []byte, gzipped bool) error {
+	if u.health.wait() > 0 {
+		return errCircuitOpen
+	}
+	if !u.up() {
+		return errGatewayDown
+	}
+	uploadGate.wait()
+
+	err := u.post(msg, gzipped, spooledResultType)
+	u.health.record(!gatewayFault(err))
+	if err == nil {
+		u.stats.Add("posted", 1)
+		u.stats.Add("bytes", int64(len(msg)))
+		progress.upload()
+	}
+	if rejected(err) {
+		u.reject(msg, gzipped, err)
+	}
+	return err
+}
+
+// reject counts a message the gateway refused, keeping it as a dead letter
+// if they are being kept.
+func (u *uploader) reject(msg []byte, gzipped bool, err error) {
+	u.stats.Add("rejected", 1)
+	if u.dead == nil {
+		return
+	}
+	if err := u.dead.put(msg, gzipped, err.(*uploadError)); err != nil {
+		logs.with(logFields{"destination": u.name}).err(err).errorf("Dead lettering failed")
+		return
+	}
+	u.stats.Add("deadLettered", 1)
+}
+
+func (u *uploader) post(msg []byte, gzipped bool, resultType string) error {
+	e := u.pick()
+
+	req, err := newRequest("POST", e.url, bytes.NewReader(msg))
+	if err != nil {
+		u.observe(e, endpointFailurePenalty, false)
+		return err
+	}
+	req.Header = u.header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	setChecksum(req.Header, u.checksum, msg)
+
+	if u.limiter != nil {
+		u.limiter.wait()
+	}
+	if uploadLimiter != nil {
+		uploadLimiter.take(float64(len(msg)))
+	}
+
+	start := u.clock.Now()
+	response, err := u.client.Do(req)
+	took := u.clock.Now().Sub(start)
+
+	if err != nil {
+		u.observe(e, took+endpointFailurePenalty, false)
+		recordEndpoint(e.url, false, took)
+		recordUpload(resultType, len(msg), 0, false, took)
+		return err
+	}
+	// Must read everything to close the body and reuse connection
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		until, ok := retryAfter(response.Header, u.clock.Now())
+		if !ok {
+			until = u.clock.Now().Add(uploadCooldown)
+		}
+		u.stats.Add("rateLimited", 1)
+		uploadGate.pauseUntil(until, e.url+" rate limiting")
+	}
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		// Being asked to slow down says nothing about the gateway's
+		// health or speed, so it isn't held against the endpoint.
+		u.release(e)
+		recordUpload(resultType, len(msg), response.StatusCode, false, took)
+		return &uploadError{response.StatusCode, response.Status, body}
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// A rejected message says nothing about the gateway itself.
+		rejected := !retryableStatus(response.StatusCode)
+		if rejected {
+			u.observe(e, took, true)
+		} else {
+			u.observe(e, took+endpointFailurePenalty, false)
+		}
+		recordEndpoint(e.url, rejected, took)
+		recordUpload(resultType, len(msg), response.StatusCode, false, took)
+		return &uploadError{response.StatusCode, response.Status, body}
+	}
+
+	u.observe(e, took, true)
+	recordEndpoint(e.url, true, took)
+	recordUpload(resultType, len(msg), response.StatusCode, true, took)
+	return nil
+}
+
+// uploadError is a post the gateway answered with something other than
+// success.
+type uploadError struct {
+	code   int
+	status string
+	body   []byte
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("%s: %s", e.status, e.body)
+}
+
+// retryableStatus says whether a post that got code might work if sent
+// again: server errors and rate limiting. Anything else is the gateway
+// rejecting the message itself.
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// rejected says whether err is the gateway refusing a message for good.
+// Network errors and server errors are worth retrying.
+func rejected(err error) bool {
+	e, ok := err.(*uploadError)
+	return ok && !retryableStatus(e.code)
+}
+
+// release ends a post without it counting for or against the endpoint.
+func (u *uploader) release(e *endpoint) {
+	u.mu.Lock()
+	e.inflight--
+	u.mu.Unlock()
+}
+
+// gatewayFault says whether a failed post counts against the destination's
+// health: it couldn't be reached or had a server error. A message refused,
+// or a request to slow down, says nothing about how it is coping.
+func gatewayFault(err error) bool {
+	if err == nil {
+		return false
+	}
+	e, ok := err.(*uploadError)
+	return !ok || e.code >= 500
+}
+
+// observe folds a post duration into the endpoint and pool moving averages.
+func (u *uploader) observe(e *endpoint, d time.Duration, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	e.inflight--
+	e.latency = (e.latency*7 + d) / 8
+	u.markLocked(e, ok)
+
+	u.posted++
+	if u.latency == 0 {
+		u.latency = d
+	} else {
+		u.latency = (u.latency*7 + d) / 8
+	}
+}
+
+// markLocked counts an endpoint's consecutive failures, taking it out of
+// rotation once there are too many and back in once it works again.
+func (u *uploader) markLocked(e *endpoint, ok bool) {
+	if ok {
+		if e.down {
+			logs.with(logFields{"destination": u.name, "endpoint": e.url}).infof("Endpoint is back up")
+		}
+		e.failures = 0
+		e.down = false
+		u.setStateLocked(gatewayUp)
+		return
+	}
+
+	e.failures++
+	if !e.down && e.failures >= *endpointDownAfter {
+		e.down = true
+		u.stats.Add("failovers", 1)
+		logs.with(logFields{"destination": u.name, "endpoint": e.url}).warnf("Endpoint is down, failing over")
+		if u.state == gatewayUp && u.allDownLocked() {
+			u.setStateLocked(gatewayDown)
+		}
+	}
+}
+
+// checkEndpoints probes every endpoint, bringing back ones that answer.
+// Any response short of a server error means the gateway is up, since an
+// empty request isn't expected to be accepted.
+func (u *uploader) checkEndpoints() {
+	for _, e := range u.endpoints {
+		start := u.clock.Now()
+		ok := false
+		req, err := newRequest("GET", e.url, nil)
+		if err != nil {
+			continue
+		}
+		req.Header = u.header.Clone()
+		response, err := u.client.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+			ok = response.StatusCode < 500
+		}
+		took := u.clock.Now().Sub(start)
+
+		u.mu.Lock()
+		if ok {
+			e.latency = (e.latency*7 + took) / 8
+		}
+		u.markLocked(e, ok)
+		u.mu.Unlock()
+	}
+}
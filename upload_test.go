@@ -0,0 +1,172 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestUploader posts to a gateway answering with codes in turn, and
+// 200 once they run out, recording when each post arrived.
+func newTestUploader(t *testing.T, c *simClock, codes ...int) (*uploader, func() []time.Duration) {
+	var mu sync.Mutex
+	var arrived []time.Duration
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		code := http.StatusOK
+		if len(arrived) < len(codes) {
+			code = codes[len(arrived)]
+		}
+		arrived = append(arrived, c.Now().Sub(simStart))
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(gateway.Close)
+
+	u := &uploader{
+		name:      "test",
+		endpoints: []*endpoint{{url: gateway.URL, weight: 1}},
+		client:    gateway.Client(),
+		header:    http.Header{},
+		retries:   2,
+		backoff:   time.Second,
+		stats:     new(expvar.Map).Init(),
+		health:    &sinkHealth{name: "test", clock: c},
+		clock:     c,
+		state:     gatewayUp,
+	}
+	u.stateChanged = sync.NewCond(&u.mu)
+
+	return u, func() []time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]time.Duration{}, arrived...)
+	}
+}
+
+// sendInBackground runs sendOne, waking each backoff sleep as it starts.
+func sendInBackground(t *testing.T, c *simClock, u *uploader, sleeps int) bool {
+	result := make(chan bool)
+	go func() {
+		result <- u.sendOne([]byte("{}"), "orders")
+	}()
+	for i := 0; i < sleeps; i++ {
+		waitSleeping(t, c, 1)
+		c.AdvanceToNext()
+	}
+	return <-result
+}
+
+func sameDurations(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUploadRetryBackoff(t *testing.T) {
+	c := newSimClock(simStart)
+	u, arrived := newTestUploader(t, c, 500, 502)
+
+	if !sendInBackground(t, c, u, 2) {
+		t.Fatal("message not posted")
+	}
+	want := []time.Duration{0, time.Second, time.Second * 3}
+	if got := arrived(); !sameDurations(got, want) {
+		t.Errorf("posts at %v, want %v doubling the backoff", got, want)
+	}
+	if got := u.stats.Get("retried").String(); got != "2" {
+		t.Errorf("retried %s times, want 2", got)
+	}
+}
+
+func TestUploadRetryGivesUp(t *testing.T) {
+	c := newSimClock(simStart)
+	u, arrived := newTestUploader(t, c, 500, 500, 500, 500)
+
+	if sendInBackground(t, c, u, 2) {
+		t.Fatal("failing message reported sent")
+	}
+	if got := len(arrived()); got != 3 {
+		t.Errorf("posted %d times, want 3", got)
+	}
+	if got := u.stats.Get("failed").String(); got != "1" {
+		t.Errorf("failed counted %s, want 1", got)
+	}
+}
+
+func TestUploadRejectedNotRetried(t *testing.T) {
+	c := newSimClock(simStart)
+	u, arrived := newTestUploader(t, c, 400)
+
+	if sendInBackground(t, c, u, 0) {
+		t.Fatal("rejected message reported sent")
+	}
+	if got := len(arrived()); got != 1 {
+		t.Errorf("posted %d times, want 1", got)
+	}
+	if got := u.stats.Get("rejected").String(); got != "1" {
+		t.Errorf("rejected counted %s, want 1", got)
+	}
+}
+
+func TestUploadGivesUpWaitingForGateway(t *testing.T) {
+	c := newSimClock(simStart)
+	u, arrived := newTestUploader(t, c)
+	u.state, u.upWait = gatewayDown, time.Minute
+
+	if sendInBackground(t, c, u, 1) {
+		t.Fatal("message reported sent while the gateway was down")
+	}
+	if got := len(arrived()); got != 0 {
+		t.Errorf("posted %d times to a gateway that was down", got)
+	}
+	if got := c.Now().Sub(simStart); got != time.Minute {
+		t.Errorf("waited %s, want a minute", got)
+	}
+}
+
+func TestUploadRateLimitNotHeldAgainstEndpoint(t *testing.T) {
+	c := newSimClock(simStart)
+	u, _ := newTestUploader(t, c)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer gateway.Close()
+	e := &endpoint{url: gateway.URL, weight: 1, latency: time.Millisecond * 50}
+	u.endpoints = []*endpoint{e}
+
+	for i := 0; i < *endpointDownAfter; i++ {
+		if err := u.post([]byte("{}"), false, "orders"); !retryableStatus(err.(*uploadError).code) {
+			t.Fatalf("post got %v", err)
+		}
+	}
+	if e.down || e.failures != 0 || e.inflight != 0 || e.latency != time.Millisecond*50 {
+		t.Errorf("endpoint down %t, %d failures, %d in flight, latency %s after rate limiting", e.down, e.failures, e.inflight, e.latency)
+	}
+}
+
+func TestUploadRejectionKeepsSinkHealthy(t *testing.T) {
+	c := newSimClock(simStart)
+	codes := make([]int, sinkCircuitFailures)
+	for i := range codes {
+		codes[i] = http.StatusBadRequest
+	}
+	u, _ := newTestUploader(t, c, codes...)
+
+	for range codes {
+		sendInBackground(t, c, u, 0)
+	}
+	if got := u.health.circuit(); got != circuitClosed {
+		t.Errorf("circuit %s after rejected messages", got)
+	}
+}
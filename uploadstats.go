@@ -0,0 +1,117 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often upload statistics are summarized in the log.
+var uploadSummaryInterval = flag.Duration("upload-summary", time.Minute*10, "how often to log a summary of uploads, or 0 never to")
+
+// Result type uploads replayed from a spool are counted under, as the
+// spool doesn't keep it.
+const spooledResultType = "spooled"
+
+// uploadTally counts posts of one result type to every destination.
+type uploadTally struct {
+	Posted   int64            `json:"posted"`
+	Bytes    int64            `json:"bytes"`
+	Failed   int64            `json:"failed"`
+	Failures map[string]int64 `json:"failures"` // by status code, or "network"
+	Latency  duration         `json:"latency"`  // moving average of successful posts
+}
+
+var uploadTallies = struct {
+	sync.Mutex
+	m map[string]*uploadTally
+}{m: make(map[string]*uploadTally)}
+
+// recordUpload counts one post. code is 0 if no response came back.
+func recordUpload(resultType string, bytes int, code int, ok bool, took time.Duration) {
+	uploadTallies.Lock()
+	defer uploadTallies.Unlock()
+
+	t, found := uploadTallies.m[resultType]
+	if !found {
+		t = &uploadTally{Failures: make(map[string]int64), Latency: duration{took}}
+		uploadTallies.m[resultType] = t
+	}
+
+	if !ok {
+		t.Failed++
+		reason := "network"
+		if code != 0 {
+			reason = strconv.Itoa(code)
+		}
+		t.Failures[reason]++
+		return
+	}
+
+	t.Posted++
+	t.Bytes += int64(bytes)
+	t.Latency.Duration = (t.Latency.Duration*7 + took) / 8
+}
+
+// uploadSummary describes the uploads so far, a line per result type.
+func uploadSummary() []string {
+	uploadTallies.Lock()
+	defer uploadTallies.Unlock()
+
+	lines := []string{}
+	for resultType, t := range uploadTallies.m {
+		line := fmt.Sprintf("%s: %d posted (%.1f MB, %s average), %d failed", resultType, t.Posted, float64(t.Bytes)/(1<<20), t.Latency.Truncate(time.Millisecond), t.Failed)
+
+		if len(t.Failures) > 0 {
+			reasons := []string{}
+			for reason, n := range t.Failures {
+				reasons = append(reasons, fmt.Sprintf("%s: %d", reason, n))
+			}
+			sort.Strings(reasons)
+			line += " (" + strings.Join(reasons, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	return lines
+}
+
+// startUploadSummary logs the summary periodically.
+func startUploadSummary() {
+	if *uploadSummaryInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			clk.Sleep(*uploadSummaryInterval)
+			for _, line := range uploadSummary() {
+				logs.infof("Uploads %s", line)
+			}
+		}
+	}()
+}
+
+func init() {
+	expvar.Publish("uploads", expvar.Func(func() interface{} {
+		uploadTallies.Lock()
+		defer uploadTallies.Unlock()
+
+		// Copied, as the encoder runs after the lock is released.
+		m := make(map[string]uploadTally)
+		for resultType, t := range uploadTallies.m {
+			c := *t
+			c.Failures = make(map[string]int64)
+			for reason, n := range t.Failures {
+				c.Failures[reason] = n
+			}
+			m[resultType] = c
+		}
+		return m
+	}))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// Messages that failed validation, keyed by result type.
+var invalidStats = expvar.NewMap("invalid")
+
+// Columns holding timestamps, which must be RFC3339.
+var timestampColumns = map[string]bool{
+	"date":      true,
+	"issueDate": true,
+}
+
+// validateUUDIF checks a message is well formed before it is posted:
+// the header is filled in, every rowset names its market and every row has
+// a value for each column, with timestamps EMDR can parse.
+func validateUUDIF(m *marketUUDIF) error {
+	switch m.ResultType {
+	case "history", "orders":
+	default:
+		return fmt.Errorf("unknown result type %q", m.ResultType)
+	}
+	if m.Version == "" || m.Generator.Name == "" || m.CurrentTime.IsZero() {
+		return errors.New("incomplete header")
+	}
+	if len(m.Columns) == 0 {
+		return errors.New("no columns")
+	}
+
+	for _, rs := range m.Rowsets {
+		if rs.RegionID <= 0 || rs.TypeID <= 0 || rs.GeneratedAt.IsZero() {
+			return fmt.Errorf("rowset %d/%d: incomplete header", rs.RegionID, rs.TypeID)
+		}
+
+		for i, row := range rs.Rows {
+			if len(row) != len(m.Columns) {
+				return fmt.Errorf("rowset %d/%d row %d: %d values for %d columns", rs.RegionID, rs.TypeID, i, len(row), len(m.Columns))
+			}
+			for j, v := range row {
+				if v == nil {
+					return fmt.Errorf("rowset %d/%d row %d: no %s", rs.RegionID, rs.TypeID, i, m.Columns[j])
+				}
+				if !timestampColumns[m.Columns[j]] {
+					continue
+				}
+				s, ok := v.(string)
+				if !ok {
+					return fmt.Errorf("rowset %d/%d row %d: %s is not a timestamp", rs.RegionID, rs.TypeID, i, m.Columns[j])
+				}
+				if _, err := time.Parse(time.RFC3339, s); err != nil {
+					return fmt.Errorf("rowset %d/%d row %d: %s", rs.RegionID, rs.TypeID, i, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// valid validates a message, logging and counting it if it isn't.
+func valid(m *marketUUDIF) bool {
+	if err := validateUUDIF(m); err != nil {
+		logs.with(logFields{"resultType": m.ResultType}).err(err).warnf("Invalid message")
+		invalidStats.Add(m.ResultType, 1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watch folder
+// UUDIF files dropped here by other tools are validated and sent on with
+// everything the bridge generates itself. Sent files are deleted and
+// invalid ones moved into a rejected subdirectory. Writers should write
+// aside and rename into place so half written files aren't picked up.
+var watchDir = flag.String("watch-dir", "", "directory to forward UUDIF files dropped into, or empty not to")
+var watchInterval = flag.Duration("watch-interval", time.Second*5, "how often the watch directory is checked")
+
+// Files forwarded from the watch folder.
+var watchStats = expvar.NewMap("watch")
+
+// Files younger than this may still be being written.
+var watchSettle = time.Second
+
+// startWatchFolder forwards files from dir to postChan in the background.
+func startWatchFolder(dir string, postChan chan *marketUUDIF) error {
+	if err := os.MkdirAll(filepath.Join(dir, "rejected"), 0755); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			warnCheck(forwardWatched(dir, postChan))
+			clk.Sleep(*watchInterval)
+		}
+	}()
+	return nil
+}
+
+// forwardWatched sends on every settled file in dir.
+func forwardWatched(dir string, postChan chan *marketUUDIF) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") || clk.Now().Sub(f.ModTime()) < watchSettle {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		m, err := decodeUUDIF(b)
+		if err != nil {
+			logs.with(logFields{"file": path}).err(err).warnf("Reloading failed")
+			rejectWatched(dir, f.Name())
+			continue
+		}
+		if !valid(m) {
+			rejectWatched(dir, f.Name())
+			continue
+		}
+
+		status.itemGenerated()
+		postChan <- m
+		os.Remove(path)
+		watchStats.Add("forwarded", 1)
+	}
+
+	return nil
+}
+
+// rejectWatched moves an invalid file aside so it isn't read again.
+func rejectWatched(dir, name string) {
+	watchStats.Add("rejected", 1)
+	warnCheck(os.Rename(filepath.Join(dir, name), filepath.Join(dir, "rejected", name)))
+}
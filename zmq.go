@@ -0,0 +1,56 @@
+//go:build zmq
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"flag"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// ZeroMQ relay
+// Publishes every message the way EMDR relays do, zlib compressed JSON on
+// a PUB socket, so local consumers can subscribe without the public relay
+// network. Needs libzmq, so is only built with -tags=zmq.
+var zmqBind = flag.String("zmq-bind", "", "address to publish UUDIF messages on as an EMDR relay, e.g. tcp://*:8050")
+
+// Messages held for slow subscribers before ZeroMQ drops them.
+var zmqHighWaterMark = 1000
+
+func init() {
+	registerSink(newZMQSink)
+}
+
+func newZMQSink() (sink, error) {
+	if *zmqBind == "" {
+		return nil, nil
+	}
+
+	sock, err := zmq.NewSocket(zmq.PUB)
+	if err != nil {
+		return nil, err
+	}
+	if err := sock.SetSndhwm(zmqHighWaterMark); err != nil {
+		return nil, err
+	}
+	if err := sock.Bind(*zmqBind); err != nil {
+		return nil, err
+	}
+
+	// Sockets aren't safe to share, but the queue writes from one goroutine.
+	return newQueuedSink("zmq", func(m *marketUUDIF) error {
+		var buf bytes.Buffer
+		z := zlib.NewWriter(&buf)
+		if err := json.NewEncoder(z).Encode(m); err != nil {
+			return err
+		}
+		if err := z.Close(); err != nil {
+			return err
+		}
+		_, err := sock.SendBytes(buf.Bytes(), 0)
+		return err
+	}), nil
+}